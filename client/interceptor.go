@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"time"
+)
+
+// CallInfo describes a session, as seen by interceptors.
+type CallInfo struct {
+	Endpoint uint16
+	// Context is the session's context (see ServiceReadWriter.Context).
+	Context context.Context
+	// Started is when the session started opening, which is useful for measuring latency.
+	Started time.Time
+
+	// Metadata and Token are sent with the session request. Open interceptors can change them (e.g. to add tracing
+	// metadata or inject a token), but other interceptors must treat them as read-only.
+	Metadata Metadata
+	Token    *string
+}
+
+// Interceptor observes every session opened by a WebSocketRouter. Any of its functions can be nil. They're called from
+// the goroutines using the session, so they must be safe to call concurrently.
+type Interceptor struct {
+	// Open is called before the session request is sent. Returning an error prevents the session from being opened.
+	Open func(call *CallInfo) error
+	// Send is called before every unit is sent. Returning an error prevents it from being sent.
+	Send func(call *CallInfo, unit encoder.UserFacingHermodUnit) error
+	// Receive is called with every unit received, before it's returned to the caller.
+	Receive func(call *CallInfo, unit encoder.UserFacingHermodUnit)
+	// Close is called once the session has ended, with the error that ended it (or nil if it ended normally).
+	Close func(call *CallInfo, err error)
+}
+
+func (router *WebSocketRouter) interceptOpen(call *CallInfo) error {
+	for _, interceptor := range router.Interceptors {
+		if interceptor.Open == nil {
+			continue
+		}
+
+		err := interceptor.Open(call)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (router *WebSocketRouter) interceptSend(call *CallInfo, unit encoder.UserFacingHermodUnit) error {
+	for _, interceptor := range router.Interceptors {
+		if interceptor.Send == nil {
+			continue
+		}
+
+		err := interceptor.Send(call, unit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (router *WebSocketRouter) interceptReceive(call *CallInfo, unit encoder.UserFacingHermodUnit) {
+	for _, interceptor := range router.Interceptors {
+		if interceptor.Receive != nil {
+			interceptor.Receive(call, unit)
+		}
+	}
+}
+
+func (router *WebSocketRouter) interceptClose(call *CallInfo, err error) {
+	for _, interceptor := range router.Interceptors {
+		if interceptor.Close != nil {
+			interceptor.Close(call, err)
+		}
+	}
+}
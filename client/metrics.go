@@ -0,0 +1,32 @@
+package client
+
+import (
+	"errors"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/metrics"
+)
+
+// metrics returns the Recorder that metrics should be sent to, which is metrics.Discard if none has been set.
+func (router *WebSocketRouter) metrics() metrics.Recorder {
+	if router.Metrics == nil {
+		return metrics.Discard
+	}
+	return router.Metrics
+}
+
+// errorKind classifies an error that ended a session. Errors sent by the server are classed as authentication errors if
+// they're StatusUnauthenticated or StatusPermissionDenied, and as handler errors otherwise.
+func errorKind(err error) metrics.ErrorKind {
+	var status *Status
+	if errors.As(err, &status) {
+		switch status.Code {
+		case framing.StatusUnauthenticated, framing.StatusPermissionDenied:
+			return metrics.ErrorAuth
+		case framing.StatusNotFound:
+			return metrics.ErrorEndpointNotFound
+		case framing.StatusResourceExhausted:
+			return metrics.ErrorLimit
+		}
+	}
+	return metrics.ErrorHandler
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"github.com/palkerecsenyi/hermod/framing"
+	"time"
+)
+
+// Metadata is a set of key/value pairs attached to a session. See framing.Metadata.
+type Metadata = framing.Metadata
+
+// RequestOption configures a single session. Options are passed to the generated Request<Endpoint> functions, which
+// pass them on to ServiceReadWriter.Init.
+type RequestOption func(options *requestOptions)
+
+type requestOptions struct {
+	token    *string
+	metadata Metadata
+	timeout  time.Duration
+
+	resumable bool
+}
+
+// WithToken authenticates the session (and this session only) using the specified token.
+func WithToken(token string) RequestOption {
+	return func(options *requestOptions) {
+		options.token = &token
+	}
+}
+
+// WithMetadata attaches key/value pairs to the session request, which are visible to the handler as Request.Metadata.
+// It can be used multiple times, in which case the pairs are merged.
+func WithMetadata(metadata Metadata) RequestOption {
+	return func(options *requestOptions) {
+		if options.metadata == nil {
+			options.metadata = Metadata{}
+		}
+
+		for key, value := range metadata {
+			options.metadata.Set(key, value)
+		}
+	}
+}
+
+// WithTimeout limits how long the session may last. The timeout is sent to the server, which cancels the handler's
+// context once it expires, and the client closes the session when ServiceReadWriter.Context expires. You can also set
+// a deadline by assigning a context with a deadline to ServiceReadWriter.Context before opening the session.
+func WithTimeout(timeout time.Duration) RequestOption {
+	return func(options *requestOptions) {
+		options.timeout = timeout
+	}
+}
+
+// Resumable marks the session as safe to re-open automatically. If the router reconnects (see
+// WebSocketRouter.Reconnect) while the session is open, a new session is requested on the new connection and every
+// message sent so far is sent again, so it's best suited to subscriptions with little or no input. The handler will
+// run again from the start, so messages received before the connection was lost may be received again.
+//
+// Sessions of endpoints marked as resumable on the server don't need this option: they're resumed where they left off
+// after reconnecting, without running the handler again.
+func Resumable() RequestOption {
+	return func(options *requestOptions) {
+		options.resumable = true
+	}
+}
+
+func newRequestOptions(options []RequestOption) *requestOptions {
+	o := requestOptions{}
+	for _, option := range options {
+		option(&o)
+	}
+	return &o
+}
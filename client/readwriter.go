@@ -4,8 +4,17 @@ import (
 	"context"
 	"fmt"
 	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/metrics"
+	"github.com/palkerecsenyi/hermod/tracing"
+	"sync"
+	"time"
 )
 
+// Status is the structured error sent by the server in error frames. Errors returned by ServiceReadWriter wrap a
+// *Status whenever the server sent one, so it can be retrieved with errors.As. See framing.Status.
+type Status = framing.Status
+
 type DummyOutSample struct{}
 
 func (DummyOutSample) GetDefinition() *encoder.Unit {
@@ -23,19 +32,29 @@ type ServiceReadWriter[In encoder.UserFacingHermodUnit, Out encoder.UserFacingHe
 	HasIn     bool
 	OutSample Out
 
+	// Context controls the lifetime of the session. If it's nil when the session is opened, a context derived from the
+	// router's is used. When it ends (e.g. once its deadline passes), the session is closed.
 	Context context.Context
 	cancel  context.CancelFunc
 	route   *webSocketRoute
+
+	// messages and errors are the channels returned by Messages, once the session has been opened
+	messages <-chan Out
+	errors   <-chan error
+	// call is passed to the router's interceptors, once they've been called to open the session
+	call *CallInfo
+	// span records the session for tracing, once it has been opened
+	span tracing.Span
 }
 
 // Init is called in generated code and must always be run before any other method will work as expected.
 // It calls rw.Router.initRoute to reserve a new client ID and create the route struct.
-func (rw *ServiceReadWriter[In, Out]) Init(token ...string) error {
+func (rw *ServiceReadWriter[In, Out]) Init(options ...RequestOption) error {
 	if rw.Router == nil {
 		return fmt.Errorf("router must not be nil")
 	}
 
-	route, err := rw.Router.initRoute(rw.Endpoint, token...)
+	route, err := rw.Router.initRoute(rw.Endpoint, newRequestOptions(options))
 	if err != nil {
 		return fmt.Errorf("initing route: %s", err)
 	}
@@ -46,10 +65,49 @@ func (rw *ServiceReadWriter[In, Out]) Init(token ...string) error {
 
 // Messages opens the session and returns a pair of channels: one for data values and another for session-specific
 // errors. It blocks until the session has been opened, and returns an error (as the 3rd return value) if the session
-// handshake times out.
+// handshake times out. Once the session has been opened, it returns the same channels every time.
 func (rw *ServiceReadWriter[In, Out]) Messages() (<-chan Out, <-chan error, error) {
-	if rw.Context == nil {
-		rw.Context, rw.cancel = context.WithCancel(rw.Router.context)
+	if rw.messages != nil {
+		return rw.messages, rw.errors, nil
+	}
+
+	if rw.cancel == nil {
+		if rw.Context == nil {
+			rw.Context = rw.Router.context
+		}
+
+		if rw.route.timeout > 0 {
+			rw.Context, rw.cancel = context.WithTimeout(rw.Context, rw.route.timeout)
+		} else {
+			rw.Context, rw.cancel = context.WithCancel(rw.Context)
+		}
+
+		go rw.route.watch(rw.Context)
+	}
+
+	if rw.call == nil {
+		rw.route.Lock()
+		rw.call = &CallInfo{
+			Endpoint: rw.Endpoint,
+			Context:  rw.Context,
+			Started:  time.Now(),
+			Metadata: rw.route.metadata.Copy(),
+			Token:    rw.route.token,
+		}
+		rw.route.Unlock()
+		rw.startSpan()
+
+		err := rw.Router.interceptOpen(rw.call)
+		if err != nil {
+			rw.span.End(err)
+			rw.cancel()
+			return nil, nil, fmt.Errorf("opening session: %w", err)
+		}
+
+		rw.route.Lock()
+		rw.route.metadata = rw.call.Metadata
+		rw.route.token = rw.call.Token
+		rw.route.Unlock()
 	}
 
 	rw.Router.openMutex.Lock()
@@ -58,38 +116,71 @@ func (rw *ServiceReadWriter[In, Out]) Messages() (<-chan Out, <-chan error, erro
 	outputChan := make(chan Out)
 	errorChan := make(chan error)
 	openChan := make(chan struct{})
+	// openError receives the error that stopped the session from being opened (e.g. one sent by the server in response
+	// to the session request), since the error channel isn't returned until the session has been opened
+	openError := make(chan error, 1)
+	var openOnce sync.Once
 	go func() {
+		opened := false
+		// sessionError is the error that ended the session, if any
+		var sessionError error
 		defer func() {
+			if opened {
+				rw.Router.metrics().SessionClosed(rw.Endpoint, time.Since(rw.call.Started))
+			}
+			if sessionError != nil {
+				rw.Router.metrics().Error(errorKind(sessionError), rw.Endpoint)
+			}
+			rw.span.End(sessionError)
+			rw.Router.interceptClose(rw.call, sessionError)
 			close(outputChan)
 			close(errorChan)
 		}()
 
 		for nextData := range rw.route.received {
 			if nextData.event == eventSessionAck {
-				close(openChan)
+				// resumable sessions are acknowledged again each time they're re-opened
+				openOnce.Do(func() {
+					rw.Router.metrics().SessionOpened(rw.Endpoint)
+					close(openChan)
+				})
+				opened = true
 				continue
 			}
 
 			if nextData.error != nil {
+				sessionError = nextData.error
+				if !opened {
+					openError <- nextData.error
+					continue
+				}
+
 				errorChan <- nextData.error
 				continue
 			}
 
 			if nextData.event == eventData {
+				rw.Router.metrics().MessageReceived(rw.Endpoint, len(nextData.data))
+				rw.span.AddEvent(tracing.MessageEvent, tracing.Message(false, len(nextData.data))...)
 				decoded, err := encoder.UserDecode(rw.OutSample, &nextData.data)
 				if err != nil {
+					rw.Router.metrics().Error(metrics.ErrorDecode, rw.Endpoint)
 					errorChan <- fmt.Errorf("failed to decode: %s", err)
 					continue
 				}
 
+				rw.Router.interceptReceive(rw.call, decoded)
 				outputChan <- decoded.(Out)
 			}
 		}
 
 	}()
 
-	err := rw.route.open()
+	// if the session can't be opened, it's closed like any other session, which ends the goroutine above and lets the
+	// close interceptors run
+	err := rw.route.open(rw.Context)
 	if err != nil {
+		rw.cancel()
 		return nil, nil, err
 	}
 
@@ -98,9 +189,17 @@ func (rw *ServiceReadWriter[In, Out]) Messages() (<-chan Out, <-chan error, erro
 
 	select {
 	case <-timeout.Done():
+		rw.cancel()
+		if rw.Router.context.Err() != nil {
+			return nil, nil, fmt.Errorf("opening session: %w", rw.Router.connectionError())
+		}
 		return nil, nil, fmt.Errorf("session open timeout")
+	case err := <-openError:
+		rw.cancel()
+		return nil, nil, err
 	// wait for the open to complete
 	case <-openChan:
+		rw.messages, rw.errors = outputChan, errorChan
 		return outputChan, errorChan, nil
 	}
 }
@@ -135,6 +234,13 @@ func (rw *ServiceReadWriter[In, Out]) Send(data In) error {
 		return fmt.Errorf("endpoint doesn't have input parameter")
 	}
 
+	if rw.call != nil {
+		err := rw.Router.interceptSend(rw.call, data)
+		if err != nil {
+			return err
+		}
+	}
+
 	encoded, err := encoder.UserEncode(data)
 	if err != nil {
 		return fmt.Errorf("encoding input data: %s", err)
@@ -144,10 +250,21 @@ func (rw *ServiceReadWriter[In, Out]) Send(data In) error {
 	if err != nil {
 		return fmt.Errorf("sending encoded data: %s", err)
 	}
+	rw.Router.metrics().MessageSent(rw.Endpoint, len(*encoded))
+	if rw.span != nil {
+		rw.span.AddEvent(tracing.MessageEvent, tracing.Message(true, len(*encoded))...)
+	}
 
 	return nil
 }
 
+// CloseSend tells the server that no more messages will be sent on the session, while still allowing messages to be
+// received. For endpoints with a streamed input, the handler's Data channel is closed, letting it know that the input
+// has finished. Send will return an error once CloseSend has been called.
+func (rw *ServiceReadWriter[In, Out]) CloseSend() error {
+	return rw.route.closeSend()
+}
+
 // Call opens the session, sends one message, and reads one message. Best for unary-in unary-out functions.
 func (rw *ServiceReadWriter[In, Out]) Call(data In) (*Out, error) {
 	readyChan := make(chan interface{})
@@ -163,7 +280,13 @@ func (rw *ServiceReadWriter[In, Out]) Call(data In) (*Out, error) {
 		}
 	}()
 
-	<-readyChan
+	// if the session can't be opened, readyChan is never closed
+	select {
+	case <-readyChan:
+	case err := <-errorChan:
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
 	err := rw.Send(data)
 	if err != nil {
 		return nil, fmt.Errorf("send: %s", err)
@@ -173,10 +296,19 @@ func (rw *ServiceReadWriter[In, Out]) Call(data In) (*Out, error) {
 	case response := <-responseChan:
 		return response, nil
 	case err = <-errorChan:
-		return nil, fmt.Errorf("receive: %s", err)
+		return nil, fmt.Errorf("receive: %w", err)
 	}
 }
 
+// Trailer returns the trailing metadata sent by the server when it closed the session. It's only populated once the
+// session has been closed by the server (i.e. once the channels returned by Messages have been closed), and will be nil
+// if the server didn't set any trailers.
+func (rw *ServiceReadWriter[In, Out]) Trailer() Metadata {
+	rw.route.Lock()
+	defer rw.route.Unlock()
+	return rw.route.trailers
+}
+
 // Close closes the route. Re-opening is not supported and may result in unexpected behaviour.
 func (rw *ServiceReadWriter[In, Out]) Close() error {
 	if rw.cancel == nil {
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"errors"
+	"github.com/palkerecsenyi/hermod/framing"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ConnectionState describes the state of a WebSocketRouter's connection.
+type ConnectionState int
+
+const (
+	// StateDisconnected means that Connect hasn't been called yet
+	StateDisconnected ConnectionState = iota
+	// StateConnected means that the connection is open and can be used
+	StateConnected
+	// StateGoingAway means that the server is shutting down. Sessions that are already open carry on as usual, but new
+	// ones can't be opened until the server closes the connection and the router reconnects (if it has a
+	// ReconnectPolicy). Opening a session fails with a StatusUnavailable error in the meantime.
+	StateGoingAway
+	// StateReconnecting means that the connection was lost and the router is trying to reconnect
+	StateReconnecting
+	// StateClosed means that the router has been closed (either manually or because the connection was lost and couldn't
+	// be re-established) and can't be used anymore
+	StateClosed
+)
+
+func (state ConnectionState) String() string {
+	switch state {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnected:
+		return "connected"
+	case StateGoingAway:
+		return "going away"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// ReconnectPolicy configures how a WebSocketRouter reconnects after losing its connection. Attempts are made with
+// exponential backoff and jitter. Any fields left as 0 are given sensible defaults.
+//
+// When the connection is lost, sessions that were opened with the Resumable option are re-opened transparently once
+// the router has reconnected. All other sessions fail with a framing.StatusUnavailable error (see IsRetriable).
+type ReconnectPolicy struct {
+	// InitialBackoff is how long to wait before the first attempt. Default: 500ms
+	InitialBackoff time.Duration
+	// MaxBackoff is the longest time to wait between attempts. Default: 30s
+	MaxBackoff time.Duration
+	// Multiplier is what the backoff is multiplied by after each failed attempt. Default: 2
+	Multiplier float64
+	// Jitter randomises each backoff by up to this fraction in either direction, to avoid many clients reconnecting at
+	// the same time. Set it to a negative value to disable jitter. Default: 0.2
+	Jitter float64
+	// MaxAttempts is the number of attempts to make before giving up and closing the router. Default: unlimited
+	MaxAttempts int
+}
+
+func (policy *ReconnectPolicy) withDefaults() ReconnectPolicy {
+	p := *policy
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 500 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 30 * time.Second
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter == 0 {
+		p.Jitter = 0.2
+	} else if p.Jitter < 0 {
+		p.Jitter = 0
+	}
+	return p
+}
+
+// backoff returns how long to wait before the specified attempt (starting at 0).
+func (policy ReconnectPolicy) backoff(attempt int) time.Duration {
+	backoff := float64(policy.InitialBackoff) * math.Pow(policy.Multiplier, float64(attempt))
+	if backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+
+	backoff *= 1 + policy.Jitter*(2*rand.Float64()-1)
+	return time.Duration(backoff)
+}
+
+// IsRetriable returns true if err was caused by a temporary problem (such as the connection being lost), meaning that
+// the same request could succeed if it's retried.
+func IsRetriable(err error) bool {
+	var status *framing.Status
+	if errors.As(err, &status) {
+		return status.Code == framing.StatusUnavailable
+	}
+	return false
+}
@@ -0,0 +1,369 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/transport"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeServer is a fake server that the router connects to over in-memory pipes. It acknowledges every session request,
+// and records every message it receives.
+type pipeServer struct {
+	mutex sync.Mutex
+	conns []transport.Conn
+	dials []time.Time
+	// failDials is how many dials to fail after the first one (which always succeeds)
+	failDials int
+	// ackDelay delays acknowledging session requests
+	ackDelay time.Duration
+	session  uint32
+
+	requests chan *framing.SessionFrame
+	closes   chan uint32
+}
+
+func newPipeServer() *pipeServer {
+	return &pipeServer{
+		requests: make(chan *framing.SessionFrame, 100),
+		closes:   make(chan uint32, 100),
+	}
+}
+
+func (server *pipeServer) dial(context.Context) (transport.Conn, error) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.dials = append(server.dials, time.Now())
+	if len(server.dials) > 1 && server.failDials > 0 {
+		server.failDials -= 1
+		return nil, errors.New("connection refused")
+	}
+
+	serverConn, clientConn := transport.Pipe()
+	server.conns = append(server.conns, serverConn)
+	go server.serve(serverConn)
+	return clientConn, nil
+}
+
+func (server *pipeServer) serve(conn transport.Conn) {
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		switch framing.BaseFlag(message[2]) {
+		case framing.ClientSessionRequest:
+			request, err := framing.DecodeSessionRequest(message)
+			if err != nil {
+				continue
+			}
+
+			server.mutex.Lock()
+			server.session += 1
+			session, delay := server.session, server.ackDelay
+			server.mutex.Unlock()
+
+			server.requests <- request
+			go func() {
+				time.Sleep(delay)
+				_ = conn.WriteMessage(transport.BinaryMessage, *request.Ack(session))
+			}()
+		case framing.Close:
+			server.closes <- encoder.SliceToU32(message[3:7])
+		}
+	}
+}
+
+// drop closes the current connection, as if the network had failed.
+func (server *pipeServer) drop() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	_ = server.conns[len(server.conns)-1].Close()
+}
+
+// send writes message to the current connection.
+func (server *pipeServer) send(t *testing.T, message []byte) {
+	t.Helper()
+
+	server.mutex.Lock()
+	conn := server.conns[len(server.conns)-1]
+	server.mutex.Unlock()
+
+	err := conn.WriteMessage(transport.BinaryMessage, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (server *pipeServer) dialTimes() []time.Time {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]time.Time{}, server.dials...)
+}
+
+// connect connects a router to server, returning a channel that receives every state the router changes to.
+func connect(t *testing.T, server *pipeServer, policy *ReconnectPolicy) (*WebSocketRouter, <-chan ConnectionState) {
+	t.Helper()
+
+	states := make(chan ConnectionState, 100)
+	router := &WebSocketRouter{
+		Timeout:   time.Second,
+		Dial:      server.dial,
+		Reconnect: policy,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		OnStateChange: func(state ConnectionState, err error) {
+			states <- state
+		},
+	}
+
+	err := router.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = router.Close()
+	})
+
+	expectState(t, states, StateConnected)
+	return router, states
+}
+
+func expectState(t *testing.T, states <-chan ConnectionState, want ConnectionState) {
+	t.Helper()
+
+	select {
+	case state := <-states:
+		if state != want {
+			t.Fatalf("got state %s, want %s", state, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for state %s", want)
+	}
+}
+
+func openSession(t *testing.T, router *WebSocketRouter, options ...RequestOption) (<-chan DummyOutSample, <-chan error) {
+	t.Helper()
+
+	rw := &ServiceReadWriter[DummyOutSample, DummyOutSample]{
+		Router:   router,
+		Endpoint: 1,
+	}
+	err := rw.Init(options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, errs, err := rw.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages, errs
+}
+
+func expectRequest(t *testing.T, server *pipeServer) *framing.SessionFrame {
+	t.Helper()
+
+	select {
+	case request := <-server.requests:
+		return request
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for session request")
+		return nil
+	}
+}
+
+func TestBackoffWithoutJitter(t *testing.T) {
+	policy := (&ReconnectPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     3,
+		Jitter:         -1,
+	}).withDefaults()
+
+	want := []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second, time.Second}
+	for i := 0; i < 10; i++ {
+		for attempt, backoff := range want {
+			if got := policy.backoff(attempt); got != backoff {
+				t.Fatalf("got backoff %s for attempt %d, want %s", got, attempt, backoff)
+			}
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	policy := (&ReconnectPolicy{InitialBackoff: time.Second}).withDefaults()
+
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(0)
+		if backoff < 800*time.Millisecond || backoff > 1200*time.Millisecond {
+			t.Fatalf("got backoff %s, want 1s ± 20%%", backoff)
+		}
+		seen[backoff] = true
+	}
+
+	if len(seen) < 2 {
+		t.Error("backoff isn't randomised by default")
+	}
+}
+
+func TestReconnectBacksOff(t *testing.T) {
+	server := newPipeServer()
+	server.failDials = 2
+	_, states := connect(t, server, &ReconnectPolicy{
+		InitialBackoff: 20 * time.Millisecond,
+		Multiplier:     2,
+		Jitter:         -1,
+	})
+
+	dropped := time.Now()
+	server.drop()
+	expectState(t, states, StateReconnecting)
+	expectState(t, states, StateConnected)
+
+	dials := server.dialTimes()
+	if len(dials) != 4 {
+		t.Fatalf("router dialled %d times, want 4", len(dials))
+	}
+
+	previous := dropped
+	for attempt, backoff := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond} {
+		if waited := dials[attempt+1].Sub(previous); waited < backoff {
+			t.Errorf("attempt %d was made after %s, want at least %s", attempt, waited, backoff)
+		}
+		previous = dials[attempt+1]
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	server := newPipeServer()
+	server.failDials = 10
+	router, states := connect(t, server, &ReconnectPolicy{
+		InitialBackoff: time.Millisecond,
+		MaxAttempts:    3,
+	})
+	_, errs := openSession(t, router)
+
+	server.drop()
+	expectState(t, states, StateReconnecting)
+	expectState(t, states, StateClosed)
+
+	if dials := len(server.dialTimes()); dials != 4 {
+		t.Errorf("router dialled %d times, want 4", dials)
+	}
+
+	err := <-errs
+	if !IsRetriable(err) {
+		t.Errorf("got %v, want a retriable error", err)
+	}
+}
+
+func TestReconnectNotifiesRoutes(t *testing.T) {
+	server := newPipeServer()
+	router, states := connect(t, server, &ReconnectPolicy{
+		InitialBackoff: time.Millisecond,
+		Jitter:         -1,
+	})
+
+	_, plainErrors := openSession(t, router)
+	expectRequest(t, server)
+	_, resumableErrors := openSession(t, router, WithMetadata(Metadata{"resumable": "true"}), Resumable())
+	expectRequest(t, server)
+
+	server.drop()
+	expectState(t, states, StateReconnecting)
+	expectState(t, states, StateConnected)
+
+	// sessions that can't be resumed fail as soon as the connection is lost
+	select {
+	case err := <-plainErrors:
+		if !IsRetriable(err) {
+			t.Errorf("got %v, want a retriable error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session wasn't told that the connection was lost")
+	}
+
+	// resumable sessions are requested again on the new connection
+	request := expectRequest(t, server)
+	if request.Metadata.Get("resumable") != "true" {
+		t.Errorf("got request with metadata %v, want the resumable session to be re-opened", request.Metadata)
+	}
+	select {
+	case err := <-resumableErrors:
+		t.Fatalf("resumable session failed: %s", err)
+	default:
+	}
+}
+
+func TestCloseLateSession(t *testing.T) {
+	server := newPipeServer()
+	server.ackDelay = 70 * time.Millisecond
+	router, _ := connect(t, server, nil)
+	router.Timeout = 50 * time.Millisecond
+
+	rw := &ServiceReadWriter[DummyOutSample, DummyOutSample]{
+		Router:   router,
+		Endpoint: 1,
+	}
+	if err := rw.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rw.Messages(); err == nil {
+		t.Fatal("opened session that was acknowledged too late")
+	}
+
+	// the session is acknowledged after the client has given up, so the client closes it
+	select {
+	case session := <-server.closes:
+		if session != 1 {
+			t.Errorf("got close for session %d, want 1", session)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session acknowledged too late wasn't closed")
+	}
+}
+
+func TestReconnectWhileSending(t *testing.T) {
+	server := newPipeServer()
+	router, states := connect(t, server, &ReconnectPolicy{
+		InitialBackoff: time.Millisecond,
+		Jitter:         -1,
+	})
+
+	// opening sessions races with the connection being replaced, which the race detector checks
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			rw := &ServiceReadWriter[DummyOutSample, DummyOutSample]{
+				Router:   router,
+				Endpoint: 1,
+			}
+			if err := rw.Init(); err != nil {
+				return
+			}
+			_, _, _ = rw.Messages()
+		}()
+	}
+
+	server.drop()
+	expectState(t, states, StateReconnecting)
+	expectState(t, states, StateConnected)
+	wg.Wait()
+
+	if err := router.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, states, StateClosed)
+}
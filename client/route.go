@@ -6,6 +6,7 @@ import (
 	"github.com/palkerecsenyi/hermod/encoder"
 	"github.com/palkerecsenyi/hermod/framing"
 	"sync"
+	"time"
 )
 
 type webSocketRoute struct {
@@ -16,12 +17,46 @@ type webSocketRoute struct {
 	client             uint32
 	session            *uint32
 	sessionRequestSent bool
+	sendClosed         bool
+
+	token    *string
+	metadata Metadata
+	trailers Metadata
+	timeout  time.Duration
+
+	// resumable routes are re-opened after the router reconnects, using openContext, and then every message in sent is
+	// sent again
+	resumable   bool
+	openContext context.Context
+	sent        [][]byte
+	reopening   bool
+
+	// resumeToken is sent by the server if the session can be resumed after reconnecting, in which case resuming is set
+	// until the server has acknowledged the resumption. lastSequence is the sequence number of the last message received.
+	resumeToken  []byte
+	lastSequence uint32
+	resuming     bool
+
+	inbox    chan routeEvent
+	received chan receiveOutput
+	router   *WebSocketRouter
+
+	// stopped is closed (with the reason in stopError) to make receive return early
+	stopped   chan struct{}
+	stopError error
+	stopOnce  sync.Once
+	// done is closed once receive has returned
+	done chan struct{}
+}
 
-	token *string
-
-	websocketIn <-chan *[]byte
-	received    chan receiveOutput
-	router      *WebSocketRouter
+// routeEvent is delivered to a route by the router. Exactly one of its fields is set.
+type routeEvent struct {
+	// data is a message received from the server
+	data []byte
+	// lost is set when the connection has been lost, and the router is trying to reconnect
+	lost error
+	// reconnected is set once the router has reconnected after losing the connection
+	reconnected bool
 }
 
 const (
@@ -35,38 +70,111 @@ type receiveOutput struct {
 	event int
 }
 
-func (route *webSocketRoute) receive(ctx context.Context) {
+// deliver passes an event to receive. It blocks until receive has accepted it, or until receive has returned.
+func (route *webSocketRoute) deliver(event routeEvent) {
+	select {
+	case route.inbox <- event:
+	case <-route.done:
+	}
+}
+
+func (route *webSocketRoute) receive() {
 	defer func() {
 		close(route.received)
 	}()
 
 	for {
 		select {
-		case <-ctx.Done():
+		case <-route.router.context.Done():
 			route.received <- receiveOutput{
-				error: fmt.Errorf("context ended"),
+				error: fmt.Errorf("connection ended: %w", route.router.connectionError()),
 			}
 			return
-		case _data, ok := <-route.websocketIn:
-			data := *_data
+		case <-route.stopped:
+			route.received <- receiveOutput{
+				error: fmt.Errorf("session ended: %w", route.stopError),
+			}
+			return
+		case event := <-route.inbox:
+			if event.lost != nil {
+				route.Lock()
+				requested := route.sessionRequestSent
+				canResume := route.session != nil && route.resumeToken != nil
+				if canResume {
+					route.session = nil
+					route.resuming = true
+				}
+				route.Unlock()
+
+				// routes that haven't been opened yet can just be opened on the new connection
+				if !requested || canResume {
+					continue
+				}
+
+				if !route.resumable {
+					route.received <- receiveOutput{
+						error: fmt.Errorf("connection ended: %w", event.lost),
+					}
+					return
+				}
 
-			if !ok {
+				route.router.unlockClientID(route.client)
+				route.Lock()
+				route.session = nil
+				route.sessionRequestSent = false
+				route.reopening = true
+				route.Unlock()
+				continue
+			}
+
+			if event.reconnected {
+				err := route.reopen()
+				if err != nil {
+					route.received <- receiveOutput{
+						error: fmt.Errorf("re-opening session: %w", err),
+					}
+					return
+				}
+				continue
+			}
+
+			data := event.data
+			// every message has a client or session ID after its flag, and acknowledgements also have a session ID after that
+			flag := framing.BaseFlag(data[2])
+			if len(data) < 7 || (flag == framing.ServerSessionAck && len(data) < 11) {
 				route.received <- receiveOutput{
-					error: fmt.Errorf("connection closed"),
+					error: fmt.Errorf("decoding message: %d bytes is too short for flag %d", len(data), flag),
 				}
 				return
 			}
 
-			flag := data[2]
+			// client IDs are released once a session has been acknowledged, so acknowledgements and client ID errors sent to
+			// a route that already has a session are for another route that has been given the same client ID since
+			session, hasSession := route.sessionId()
+
 			if flag == framing.ServerSessionAck {
 				client := encoder.SliceToU32(data[3:7])
-				if client != route.client {
+				if client != route.client || hasSession {
 					continue
 				}
 
 				sessionId := encoder.SliceToU32(data[7:11])
 				route.router.unlockClientID(route.client)
+				route.Lock()
 				route.session = &sessionId
+				route.resuming = false
+				if data[2]&framing.AckResumeToken != 0 {
+					route.resumeToken = append([]byte{}, data[11:]...)
+				}
+				route.Unlock()
+
+				err := route.replay()
+				if err != nil {
+					route.received <- receiveOutput{
+						error: fmt.Errorf("replaying messages: %w", err),
+					}
+					return
+				}
 
 				route.received <- receiveOutput{
 					event: eventSessionAck,
@@ -76,18 +184,24 @@ func (route *webSocketRoute) receive(ctx context.Context) {
 
 			if flag == framing.ErrorClientID || flag == framing.ErrorSessionID {
 				clientOrSession := encoder.SliceToU32(data[3:7])
-				if route.session != nil && flag == framing.ErrorSessionID && clientOrSession == *route.session {
-					message := data[7:]
-					route.received <- receiveOutput{
-						error: fmt.Errorf("server (session ID): %s", message),
+				isSessionError := hasSession && flag == framing.ErrorSessionID && clientOrSession == session
+				isClientError := !hasSession && flag == framing.ErrorClientID && clientOrSession == route.client
+				if isSessionError || isClientError {
+					status, err := framing.DecodeError(data[2], data[7:])
+					if err != nil {
+						route.received <- receiveOutput{
+							error: fmt.Errorf("decoding server error: %s", err),
+						}
+						return
+					}
+
+					idType := "session ID"
+					if isClientError {
+						idType = "client ID"
 					}
-					return
-				}
 
-				if flag == framing.ErrorClientID && clientOrSession == route.client {
-					message := data[7:]
 					route.received <- receiveOutput{
-						error: fmt.Errorf("server (client ID): %s", message),
+						error: fmt.Errorf("server (%s): %w", idType, status),
 					}
 					return
 				}
@@ -95,22 +209,57 @@ func (route *webSocketRoute) receive(ctx context.Context) {
 				continue
 			}
 
-			if route.session == nil {
-				continue
-			}
-
-			session := encoder.SliceToU32(data[3:7])
-			if session != *route.session {
+			if !hasSession || encoder.SliceToU32(data[3:7]) != session {
 				continue
 			}
 
 			if flag == framing.Close {
+				if data[2]&framing.CloseTrailers != 0 {
+					trailers, _, err := framing.DecodeMetadata(data[7:])
+					if err != nil {
+						route.received <- receiveOutput{
+							error: fmt.Errorf("decoding trailers: %s", err),
+						}
+						return
+					}
+
+					route.Lock()
+					route.trailers = trailers
+					route.Unlock()
+				}
 				return
 			}
 
+			if flag == framing.TokenExpiring {
+				// the token the session was opened with can't be refreshed, so the session will fail once it expires
+				frame, err := framing.DecodeTokenExpiringFrame(data)
+				if err != nil {
+					route.router.logger().Warn("received malformed token-expiring message", "endpoint", route.endpoint, "session", session, "error", err)
+					continue
+				}
+				route.router.logger().Warn("session token is about to expire", "endpoint", route.endpoint, "session", session, "remaining", frame.Remaining)
+				continue
+			}
+
 			if flag == framing.Data {
+				sequence, unit, err := framing.DecodeData(data[2], data[7:])
+				if err != nil {
+					route.received <- receiveOutput{
+						error: fmt.Errorf("decoding data: %s", err),
+					}
+					return
+				}
+
+				if sequence != 0 {
+					// messages that had already been received before resuming the session are skipped
+					if sequence <= route.lastSequence {
+						continue
+					}
+					route.lastSequence = sequence
+				}
+
 				route.received <- receiveOutput{
-					data:  data[7:],
+					data:  unit,
 					event: eventData,
 				}
 			}
@@ -118,9 +267,166 @@ func (route *webSocketRoute) receive(ctx context.Context) {
 	}
 }
 
-// open sends an ClientSessionRequest message.
+// closeLateSession is called once receive has returned. If the route was stopped after requesting a session but before
+// the server acknowledged it (e.g. because opening it timed out), it waits up to the router's Timeout for the
+// acknowledgement and closes the session straight away, so that the server doesn't keep running it.
+func (route *webSocketRoute) closeLateSession() {
+	select {
+	case <-route.stopped:
+	default:
+		return
+	}
+
+	route.Lock()
+	pending := route.sessionRequestSent && route.session == nil
+	route.Unlock()
+	if !pending {
+		return
+	}
+
+	timeout := time.NewTimer(route.router.Timeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-route.router.context.Done():
+			return
+		case <-timeout.C:
+			return
+		case event := <-route.inbox:
+			if event.lost != nil {
+				return
+			}
+			if len(event.data) < 7 || encoder.SliceToU32(event.data[3:7]) != route.client {
+				continue
+			}
+
+			flag := framing.BaseFlag(event.data[2])
+			if flag == framing.ErrorClientID {
+				return
+			}
+			if flag != framing.ServerSessionAck || len(event.data) < 11 {
+				continue
+			}
+
+			sessionId := encoder.SliceToU32(event.data[7:11])
+			route.router.unlockClientID(route.client)
+			route.Lock()
+			route.session = &sessionId
+			route.Unlock()
+
+			_ = route.close()
+			return
+		}
+	}
+}
+
+// reopen resumes the session (if the server sent a resume token) or requests a new session (if the route is Resumable)
+// after the router has reconnected. It does nothing if the route wasn't open when the connection was lost.
+func (route *webSocketRoute) reopen() error {
+	route.Lock()
+	reopening, resuming := route.reopening, route.resuming
+	route.Unlock()
+	if !reopening && !resuming {
+		return nil
+	}
+
+	err := route.router.reserveClientID(route)
+	if err != nil {
+		return err
+	}
+
+	if resuming {
+		return route.resume()
+	}
+	return route.open(route.openContext)
+}
+
+// resume sends a ResumeSession message, asking the server to continue the session from the last message received.
+func (route *webSocketRoute) resume() error {
+	route.Lock()
+	defer route.Unlock()
+
+	frame := framing.ResumeFrame{
+		EndpointId:   route.endpoint,
+		ClientId:     route.client,
+		LastSequence: route.lastSequence,
+		Token:        route.resumeToken,
+	}
+	err := route.router.send(frame.Encode())
+	if err != nil {
+		return fmt.Errorf("sending resume frame: %w", err)
+	}
+
+	return nil
+}
+
+// replay sends every message sent so far again after a resumable route has been re-opened, followed by a HalfClose if
+// sending had been closed. It does nothing if the route isn't being re-opened.
+func (route *webSocketRoute) replay() error {
+	route.Lock()
+	defer route.Unlock()
+
+	if !route.reopening {
+		return nil
+	}
+	route.reopening = false
+
+	frame := framing.MessageFrame{
+		EndpointId: route.endpoint,
+		Flag:       framing.Data,
+		SessionId:  *route.session,
+	}
+	for _, message := range route.sent {
+		frame.Data = message
+		err := route.router.send(frame.Encode())
+		if err != nil {
+			return err
+		}
+	}
+
+	if route.sendClosed {
+		return route.router.send(frame.HalfClose())
+	}
+	return nil
+}
+
+// stop makes receive return with the specified error. It's safe to call multiple times, but only the first error is
+// kept.
+func (route *webSocketRoute) stop(err error) {
+	route.stopOnce.Do(func() {
+		route.stopError = err
+		close(route.stopped)
+	})
+}
+
+// watch waits for ctx to end, and then closes the session and stops the route. If the route finishes by itself first,
+// watch returns without doing anything.
+func (route *webSocketRoute) watch(ctx context.Context) {
+	select {
+	case <-route.done:
+	case <-ctx.Done():
+		// if the session hasn't been opened yet, the server will abandon it once its own deadline has passed
+		_ = route.close()
+		route.stop(ctx.Err())
+	}
+}
+
+// sessionId returns the session ID assigned by the server, or false if the session hasn't been opened yet.
+func (route *webSocketRoute) sessionId() (uint32, bool) {
+	route.Lock()
+	defer route.Unlock()
+
+	if route.session == nil {
+		return 0, false
+	}
+	return *route.session, true
+}
+
+// open sends an ClientSessionRequest message. If ctx has a deadline, the time remaining until the deadline is sent to
+// the server as the session's timeout.
 // If the session has already been opened, open returns immediately and without error.
-func (route *webSocketRoute) open() error {
+func (route *webSocketRoute) open(ctx context.Context) error {
 	route.Lock()
 	defer route.Unlock()
 
@@ -128,6 +434,10 @@ func (route *webSocketRoute) open() error {
 		return nil
 	}
 
+	if route.router.State() == StateGoingAway {
+		return framing.NewStatus(framing.StatusUnavailable, "server is shutting down")
+	}
+
 	var flag uint8 = framing.ClientSessionRequest
 	var token string
 	if route.token != nil {
@@ -140,44 +450,72 @@ func (route *webSocketRoute) open() error {
 		Flag:       flag,
 		ClientId:   route.client,
 		Token:      token,
+		Metadata:   route.metadata,
 	}
 
-	err := route.router.send(frame.Encode())
+	if deadline, ok := ctx.Deadline(); ok {
+		frame.Timeout = time.Until(deadline)
+		if frame.Timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+
+	encoded, err := frame.Encode()
+	if err != nil {
+		return fmt.Errorf("encoding open frame: %s", err)
+	}
+
+	err = route.router.send(encoded)
 	if err != nil {
-		return fmt.Errorf("sending open frame: %s", err)
+		return fmt.Errorf("sending open frame: %w", err)
 	}
 
+	route.openContext = ctx
 	route.sessionRequestSent = true
 	return nil
 }
 
 func (route *webSocketRoute) send(message []byte) error {
+	route.Lock()
+	defer route.Unlock()
+
+	if route.reopening || route.resuming {
+		return framing.NewStatus(framing.StatusUnavailable, "session is being re-opened")
+	}
 	if route.session == nil {
 		return fmt.Errorf("session not open")
 	}
+	if route.sendClosed {
+		return fmt.Errorf("sending has been closed")
+	}
+	session := *route.session
 
 	frame := framing.MessageFrame{
 		EndpointId: route.endpoint,
 		Flag:       framing.Data,
-		SessionId:  *route.session,
+		SessionId:  session,
 		Data:       message,
 	}
 	err := route.router.send(frame.Encode())
 	if err != nil {
-		return fmt.Errorf("sending messsage: %s", err)
+		return fmt.Errorf("sending messsage: %w", err)
 	}
 
+	if route.resumable {
+		route.sent = append(route.sent, message)
+	}
 	return nil
 }
 
 func (route *webSocketRoute) close() error {
-	if route.session == nil {
+	session, ok := route.sessionId()
+	if !ok {
 		return fmt.Errorf("cannot close, session not open")
 	}
 
 	frame := framing.MessageFrame{
 		EndpointId: route.endpoint,
-		SessionId:  *route.session,
+		SessionId:  session,
 	}
 	err := route.router.send(frame.Close())
 	if err != nil {
@@ -186,3 +524,29 @@ func (route *webSocketRoute) close() error {
 
 	return nil
 }
+
+// closeSend sends a HalfClose message, and prevents any further messages from being sent on the route.
+func (route *webSocketRoute) closeSend() error {
+	session, ok := route.sessionId()
+	if !ok {
+		return fmt.Errorf("cannot close sending, session not open")
+	}
+
+	route.Lock()
+	defer route.Unlock()
+	if route.sendClosed {
+		return nil
+	}
+
+	frame := framing.MessageFrame{
+		EndpointId: route.endpoint,
+		SessionId:  session,
+	}
+	err := route.router.send(frame.HalfClose())
+	if err != nil {
+		return fmt.Errorf("sending half-close: %s", err)
+	}
+
+	route.sendClosed = true
+	return nil
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"github.com/palkerecsenyi/hermod/framing"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteRejectsTruncatedMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+	}{
+		{"data", []byte{0, 1, framing.Data, 0, 0}},
+		{"close", []byte{0, 1, framing.Close}},
+		{"ack", []byte{0, 1, framing.ServerSessionAck, 0, 0, 0, 1, 0, 0}},
+		{"client error", []byte{0, 1, framing.ErrorClientID, 0, 0, 0}},
+		{"session error", []byte{0, 1, framing.ErrorSessionID, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newPipeServer()
+			router, _ := connect(t, server, nil)
+			_, errs := openSession(t, router)
+
+			server.send(t, test.message)
+
+			select {
+			case err := <-errs:
+				if err == nil || !strings.Contains(err.Error(), "too short") {
+					t.Errorf("got %v, want a decoding error", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("truncated message didn't end the session")
+			}
+		})
+	}
+}
+
+func TestRouteIgnoresMessagesForReusedClientID(t *testing.T) {
+	server := newPipeServer()
+	router, _ := connect(t, server, nil)
+	messages, errs := openSession(t, router)
+	request := expectRequest(t, server)
+
+	// the client ID was released once the session was acknowledged, so these are for a later session that was given the
+	// same one
+	server.send(t, *request.Ack(99))
+	server.send(t, framing.CreateErrorClient(1, request.ClientId, framing.NewStatus(framing.StatusResourceExhausted, "refused")))
+
+	// the session carries on with its original session ID, so it's closed normally
+	frame := framing.MessageFrame{EndpointId: 1, SessionId: 1}
+	server.send(t, frame.Close())
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("received unexpected message")
+		}
+	case err, ok := <-errs:
+		if ok {
+			t.Fatalf("session failed: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session wasn't closed by a message for its original session ID")
+	}
+}
@@ -3,11 +3,13 @@ package client
 import (
 	"context"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"github.com/palkerecsenyi/hermod/encoder"
-	"log"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/metrics"
+	"github.com/palkerecsenyi/hermod/tracing"
+	"github.com/palkerecsenyi/hermod/transport"
+	"log/slog"
 	"net/url"
-	"runtime"
 	"sync"
 	"time"
 )
@@ -16,17 +18,66 @@ type WebSocketRouter struct {
 	URL     url.URL
 	Timeout time.Duration
 
-	routeStore      map[uint32]*webSocketRoute
+	// Dial opens a connection to the server, and is used instead of connecting to URL over WebSocket. This allows other
+	// transports (see the transport package) to be used. If a token is passed to Connect, it's sent in an
+	// Authentication message after each connection is opened.
+	Dial func(ctx context.Context) (transport.Conn, error)
+
+	// PingInterval is how often to send keep-alive pings to the server. If it's 0, no pings are sent and a dead
+	// connection may go unnoticed.
+	PingInterval time.Duration
+	// PongTimeout is how long to wait for a pong (or any other message) after a ping is due before regarding the
+	// connection as dead. All open sessions then fail with a framing.StatusUnavailable error. Only used if PingInterval
+	// is set.
+	PongTimeout time.Duration
+
+	// Reconnect enables automatic reconnection when the connection is lost. If it's nil, the router closes permanently
+	// instead. See ReconnectPolicy.
+	Reconnect *ReconnectPolicy
+	// OnStateChange is called whenever the state of the connection changes. It's called synchronously from the
+	// goroutine managing the connection, so it must not block.
+	OnStateChange func(state ConnectionState, err error)
+
+	// RefreshToken is called when the server warns that the connection's token is about to expire. The token it returns
+	// is sent to the server (see Authenticate), so that sessions carry on without being interrupted. If it's nil (or
+	// returns an error), sessions using the connection's token end with a framing.StatusUnauthenticated error once it
+	// expires.
+	RefreshToken func(ctx context.Context) (string, error)
+
+	// Interceptors observe every session opened using the router, and are called in order. See Interceptor.
+	Interceptors []Interceptor
+	// Metrics receives metrics about the router's connections and sessions. See the metrics package.
+	Metrics metrics.Recorder
+	// Tracer records a span for each session, whose context is sent to the server in the session's metadata. Spans are
+	// children of the span carried by the session's context (see ServiceReadWriter.Context). See the tracing package.
+	Tracer tracing.Tracer
+	// Logger receives the router's log messages, which have "endpoint", "session" and "flag" attributes where relevant.
+	// If it's nil, slog.Default() is used.
+	Logger *slog.Logger
+
+	// routeStore contains routes that have reserved a client ID and are waiting for a ServerSessionAck
+	routeStore map[uint32]*webSocketRoute
+	// routes contains every route that's still receiving messages
+	routes          map[*webSocketRoute]struct{}
 	routeStoreMutex sync.Mutex
 
 	connectionMutex sync.Mutex
-	connection      *websocket.Conn
+	connection      transport.Conn
+	// tokenMutex protects token and URL's query, which are changed by Authenticate
+	tokenMutex sync.Mutex
+	token      string
 
 	openMutex sync.Mutex
 
-	data    chan []byte
+	state      ConnectionState
+	stateMutex sync.Mutex
+
 	context context.Context
 	cancel  context.CancelFunc
+
+	// closeError explains why context was cancelled
+	closeError      error
+	closeErrorMutex sync.Mutex
 }
 
 func (router *WebSocketRouter) Connect(token ...string) error {
@@ -39,159 +90,418 @@ func (router *WebSocketRouter) Connect(token ...string) error {
 	}
 
 	if len(token) == 1 {
-		router.URL.Query().Add("token", token[0])
+		router.token = token[0]
+		query := router.URL.Query()
+		query.Set("token", token[0])
+		router.URL.RawQuery = query.Encode()
 	}
 
 	if router.context != nil {
-		return fmt.Errorf("connect already called (reconnect not supported)")
+		return fmt.Errorf("connect already called")
 	}
 
-	connection, _, err := websocket.DefaultDialer.Dial(router.URL.String(), nil)
+	connection, err := router.dial()
 	if err != nil {
-		return fmt.Errorf("opening websocket: %s", err)
+		return err
 	}
 
+	router.connectionMutex.Lock()
 	router.connection = connection
+	router.connectionMutex.Unlock()
 	router.routeStore = map[uint32]*webSocketRoute{}
-	router.data = make(chan []byte)
+	router.routes = map[*webSocketRoute]struct{}{}
 
 	router.context, router.cancel = context.WithCancel(context.Background())
+	router.setState(StateConnected, nil)
+	router.metrics().ConnectionOpened()
+	go router.run(connection)
+	return nil
+}
+
+func (router *WebSocketRouter) dial() (transport.Conn, error) {
+	router.tokenMutex.Lock()
+	address, token := router.URL.String(), router.token
+	router.tokenMutex.Unlock()
+
+	if router.Dial == nil {
+		connection, err := transport.DialWebSocket(context.Background(), address, nil)
+		if err != nil {
+			return nil, fmt.Errorf("opening websocket: %s", err)
+		}
+
+		return connection, nil
+	}
+
+	connection, err := router.Dial(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("opening connection: %s", err)
+	}
+
+	if token != "" {
+		frame := framing.AuthenticationFrame{
+			Token: token,
+		}
+		err = connection.WriteMessage(transport.BinaryMessage, frame.Encode())
+		if err != nil {
+			_ = connection.Close()
+			return nil, fmt.Errorf("sending token: %s", err)
+		}
+	}
+
+	return connection, nil
+}
+
+// run reads from connection until it fails, and then either reconnects (and carries on reading from the new
+// connection) or closes the router permanently.
+func (router *WebSocketRouter) run(connection transport.Conn) {
+	for {
+		err := router.read(connection)
+		router.metrics().ConnectionClosed()
+		if router.context.Err() != nil {
+			router.setState(StateClosed, router.connectionError())
+			return
+		}
+
+		lostError := framing.Errorf(framing.StatusUnavailable, "connection lost: %s", err)
+		router.logger().Warn("connection lost", "error", err)
+		if router.Reconnect == nil {
+			router.fail(lostError)
+			router.setState(StateClosed, lostError)
+			return
+		}
+
+		router.setState(StateReconnecting, lostError)
+		router.broadcast(routeEvent{
+			lost: lostError,
+		})
+
+		connection, err = router.reconnect()
+		if err != nil {
+			router.logger().Error("failed to reconnect", "error", err)
+			router.fail(framing.Errorf(framing.StatusUnavailable, "reconnecting: %s", err))
+			router.setState(StateClosed, router.connectionError())
+			return
+		}
+
+		router.setState(StateConnected, nil)
+		router.metrics().ConnectionOpened()
+		router.logger().Info("reconnected")
+		router.broadcast(routeEvent{
+			reconnected: true,
+		})
+	}
+}
+
+// read dispatches messages from connection to routes until reading fails.
+func (router *WebSocketRouter) read(connection transport.Conn) error {
+	ctx, cancel := context.WithCancel(router.context)
+	defer cancel()
+
+	extendDeadline := router.keepAlive(ctx, connection)
+	for {
+		messageType, message, err := connection.ReadMessage()
+		if err != nil {
+			return err
+		}
+		extendDeadline()
+
+		// text messages are fatal connection-level errors
+		if messageType == transport.TextMessage {
+			_ = connection.Close()
+			return fmt.Errorf("server error: %s", message)
+		}
+
+		if len(message) < 3 {
+			continue
+		}
+
+		if encoder.SliceToU16(message[0:2]) == framing.ConnectionEndpoint && message[2] == framing.GoAway {
+			router.logger().Info("server is shutting down")
+			router.setState(StateGoingAway, framing.NewStatus(framing.StatusUnavailable, "server is shutting down"))
+			continue
+		}
+
+		if encoder.SliceToU16(message[0:2]) == framing.ConnectionEndpoint && message[2] == framing.TokenExpiring {
+			// refreshing involves sending a message, so it can't block reading
+			go router.refreshToken(message)
+			continue
+		}
+
+		if encoder.SliceToU16(message[0:2]) == framing.ConnectionEndpoint && framing.BaseFlag(message[2]) == framing.ErrorClientID {
+			router.tokenRejected(message)
+			continue
+		}
+
+		router.dispatch(message)
+	}
+}
+
+// reconnect dials the server repeatedly according to the router's ReconnectPolicy, until either a connection is
+// established, the maximum number of attempts is reached, or the router is closed.
+func (router *WebSocketRouter) reconnect() (transport.Conn, error) {
+	policy := router.Reconnect.withDefaults()
+
+	var err error
+	for attempt := 0; policy.MaxAttempts == 0 || attempt < policy.MaxAttempts; attempt++ {
+		select {
+		case <-router.context.Done():
+			return nil, router.context.Err()
+		case <-time.After(policy.backoff(attempt)):
+		}
+
+		var connection transport.Conn
+		connection, err = router.dial()
+		if err != nil {
+			continue
+		}
+
+		router.connectionMutex.Lock()
+		router.connection = connection
+		router.connectionMutex.Unlock()
+		return connection, nil
+	}
+
+	return nil, fmt.Errorf("gave up after %d attempts: %s", policy.MaxAttempts, err)
+}
+
+// keepAlive pings the server every PingInterval until ctx ends, and sets a read deadline so that reads fail if no pong
+// (or other message) arrives in time. It returns a function that must be called after every successful read to extend
+// the deadline.
+func (router *WebSocketRouter) keepAlive(ctx context.Context, c transport.Conn) func() {
+	connection, ok := c.(transport.KeepAliveConn)
+	if router.PingInterval <= 0 || !ok {
+		return func() {}
+	}
+
+	extendDeadline := func() {
+		_ = connection.SetReadDeadline(time.Now().Add(router.PingInterval + router.PongTimeout))
+	}
+	extendDeadline()
+
+	connection.SetPongHandler(extendDeadline)
+
 	go func() {
+		ticker := time.NewTicker(router.PingInterval)
+		defer ticker.Stop()
+
 		for {
 			select {
-			case <-router.context.Done():
-				close(router.data)
+			case <-ctx.Done():
 				return
-			default:
-				_, message, err := connection.ReadMessage()
+			case <-ticker.C:
+				err := connection.Ping(time.Now().Add(router.PongTimeout))
 				if err != nil {
-					log.Printf("hermod read error: %s\n", err)
-					continue
+					return
 				}
-
-				router.data <- message
 			}
 		}
 	}()
-	return nil
+
+	return extendDeadline
 }
 
-func (router *WebSocketRouter) Close() error {
-	if router.connection == nil {
-		return fmt.Errorf("no connection exists")
+// logger returns the Logger that log messages should be sent to, which is slog.Default() if none has been set.
+func (router *WebSocketRouter) logger() *slog.Logger {
+	if router.Logger == nil {
+		return slog.Default()
 	}
+	return router.Logger
+}
 
-	err := router.connection.Close()
-	if err != nil {
-		return err
+// dispatch delivers a message to every route with a matching endpoint. Routes are responsible for checking whether the
+// message is actually meant for their client or session ID.
+func (router *WebSocketRouter) dispatch(message []byte) {
+	endpoint := encoder.SliceToU16(message[0:2])
+
+	router.routeStoreMutex.Lock()
+	var routes []*webSocketRoute
+	for route := range router.routes {
+		if route.endpoint == endpoint {
+			routes = append(routes, route)
+		}
 	}
+	router.routeStoreMutex.Unlock()
 
-	if router.cancel != nil {
-		router.cancel()
+	if len(routes) == 0 {
+		router.logger().Debug("received message for endpoint without any sessions", "endpoint", endpoint, "flag", message[2])
+		return
 	}
 
-	return nil
+	for _, route := range routes {
+		route.deliver(routeEvent{
+			data: message,
+		})
+	}
 }
 
-func (router *WebSocketRouter) send(data interface{}) error {
-	if router.connection == nil {
-		return fmt.Errorf("connection required to send message")
+// broadcast delivers an event to every route, regardless of endpoint.
+func (router *WebSocketRouter) broadcast(event routeEvent) {
+	router.routeStoreMutex.Lock()
+	routes := make([]*webSocketRoute, 0, len(router.routes))
+	for route := range router.routes {
+		routes = append(routes, route)
+	}
+	router.routeStoreMutex.Unlock()
+
+	for _, route := range routes {
+		route.deliver(event)
+	}
+}
+
+// State returns the current state of the connection.
+func (router *WebSocketRouter) State() ConnectionState {
+	router.stateMutex.Lock()
+	defer router.stateMutex.Unlock()
+	return router.state
+}
+
+func (router *WebSocketRouter) setState(state ConnectionState, err error) {
+	router.stateMutex.Lock()
+	changed := router.state != state
+	router.state = state
+	router.stateMutex.Unlock()
+
+	if changed && router.OnStateChange != nil {
+		router.OnStateChange(state, err)
+	}
+}
+
+// fail cancels the router's context, recording err as the reason. Only the first reason is kept.
+func (router *WebSocketRouter) fail(err error) {
+	router.closeErrorMutex.Lock()
+	if router.closeError == nil {
+		router.closeError = err
+	}
+	router.closeErrorMutex.Unlock()
+
+	router.cancel()
+}
+
+// connectionError returns the reason the router's context was cancelled.
+func (router *WebSocketRouter) connectionError() error {
+	router.closeErrorMutex.Lock()
+	defer router.closeErrorMutex.Unlock()
+
+	if router.closeError == nil {
+		return framing.NewStatus(framing.StatusCancelled, "router closed")
 	}
+	return router.closeError
+}
 
+// getConnection returns the current connection, which is replaced whenever the router reconnects.
+func (router *WebSocketRouter) getConnection() transport.Conn {
 	router.connectionMutex.Lock()
 	defer router.connectionMutex.Unlock()
+	return router.connection
+}
 
-	if stringData, ok := data.(string); ok {
-		return router.connection.WriteMessage(websocket.TextMessage, []byte(stringData))
+func (router *WebSocketRouter) Close() error {
+	if router.getConnection() == nil {
+		return fmt.Errorf("no connection exists")
 	}
 
-	if binaryData, ok := data.([]byte); ok {
-		return router.connection.WriteMessage(websocket.BinaryMessage, binaryData)
+	// the context must be cancelled first, so that the read error caused by closing the connection isn't reported as a
+	// lost connection
+	if router.cancel != nil {
+		router.fail(framing.NewStatus(framing.StatusCancelled, "router closed"))
 	}
 
-	return fmt.Errorf("unsupported message type")
+	router.connectionMutex.Lock()
+	defer router.connectionMutex.Unlock()
+	return router.connection.Close()
 }
 
-func (router *WebSocketRouter) initRoute(endpoint uint16, token ...string) (*webSocketRoute, error) {
-	if router.connection == nil {
-		return nil, fmt.Errorf("connection required before opening route")
+func (router *WebSocketRouter) send(data interface{}) error {
+	if router.getConnection() == nil {
+		return fmt.Errorf("connection required to send message")
 	}
 
-	router.routeStoreMutex.Lock()
-	defer router.routeStoreMutex.Unlock()
+	if state := router.State(); state != StateConnected && state != StateGoingAway {
+		return framing.NewStatus(framing.StatusUnavailable, "not connected")
+	}
 
-	// find an unused client ID
-	var client uint32 = 0
-	for i := uint32(0); i <= uint32(0xffffffff); i++ {
-		_, clientInUse := router.routeStore[i]
-		if !clientInUse {
-			client = i
-			break
-		}
+	router.connectionMutex.Lock()
+	defer router.connectionMutex.Unlock()
 
-		if i+1 > 0xffffffff {
-			return nil, fmt.Errorf("no more client IDs remaining")
-		}
+	if stringData, ok := data.(string); ok {
+		return router.connection.WriteMessage(transport.TextMessage, []byte(stringData))
 	}
 
-	routeChan := make(chan *[]byte)
-	receiveDoneChan := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-router.context.Done():
-				close(routeChan)
-				return
-			case <-receiveDoneChan:
-				close(routeChan)
-				return
-			case data, ok := <-router.data:
-				if !ok {
-					close(routeChan)
-					return
-				}
+	if binaryData, ok := data.([]byte); ok {
+		return router.connection.WriteMessage(transport.BinaryMessage, binaryData)
+	}
 
-				// a lightweight check to reduce the load on individual routes.
-				// obviously this doesn't filter multiple same-endpoint sessions though.
-				dataEndpoint := encoder.SliceToU16(data[0:2])
-				if dataEndpoint != endpoint {
-					continue
-				}
+	return fmt.Errorf("unsupported message type")
+}
 
-				routeChan <- &data
-			}
-		}
-	}()
+func (router *WebSocketRouter) initRoute(endpoint uint16, options *requestOptions) (*webSocketRoute, error) {
+	if router.getConnection() == nil {
+		return nil, fmt.Errorf("connection required before opening route")
+	}
 
-	received := make(chan receiveOutput)
 	route := webSocketRoute{
-		client:      client,
-		endpoint:    endpoint,
-		router:      router,
-		websocketIn: routeChan,
-		received:    received,
+		endpoint:  endpoint,
+		router:    router,
+		inbox:     make(chan routeEvent),
+		received:  make(chan receiveOutput),
+		token:     options.token,
+		metadata:  options.metadata,
+		timeout:   options.timeout,
+		resumable: options.resumable,
+		stopped:   make(chan struct{}),
+		done:      make(chan struct{}),
 	}
 
-	if len(token) == 1 {
-		t := token[0]
-		route.token = &t
+	err := router.reserveClientID(&route)
+	if err != nil {
+		return nil, err
 	}
 
-	router.routeStore[client] = &route
+	router.routeStoreMutex.Lock()
+	router.routes[&route] = struct{}{}
+	router.routeStoreMutex.Unlock()
 
 	go func() {
-		route.receive(router.context)
-		// let the for-loop in the goroutine above know to stop listening
-		close(receiveDoneChan)
+		route.receive()
+		route.closeLateSession()
+		router.removeRoute(&route)
+		close(route.done)
 	}()
 
-	// make sure the route.receive call in the goroutine is actually ready before continuing
-	runtime.Gosched()
 	return &route, nil
 }
 
+// reserveClientID finds an unused client ID and assigns it to route.
+func (router *WebSocketRouter) reserveClientID(route *webSocketRoute) error {
+	router.routeStoreMutex.Lock()
+	defer router.routeStoreMutex.Unlock()
+
+	for i := uint32(0); ; i++ {
+		if _, clientInUse := router.routeStore[i]; !clientInUse {
+			router.routeStore[i] = route
+			route.client = i
+			return nil
+		}
+
+		if i == 0xffffffff {
+			return fmt.Errorf("no more client IDs remaining")
+		}
+	}
+}
+
 func (router *WebSocketRouter) unlockClientID(client uint32) {
 	router.routeStoreMutex.Lock()
 	defer router.routeStoreMutex.Unlock()
 	delete(router.routeStore, client)
 }
+
+// removeRoute stops delivering messages to route, and frees its client ID if it's still reserved.
+func (router *WebSocketRouter) removeRoute(route *webSocketRoute) {
+	router.routeStoreMutex.Lock()
+	defer router.routeStoreMutex.Unlock()
+
+	delete(router.routes, route)
+	if router.routeStore[route.client] == route {
+		delete(router.routeStore, route.client)
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"fmt"
+	"github.com/palkerecsenyi/hermod/framing"
+)
+
+// Authenticate sends a new token for the connection to the server, replacing the one passed to Connect (or the previous
+// call to Authenticate). Sessions using the connection's token carry on using the new one. The token is also used if the
+// router reconnects. Sessions opened with their own token (see WithToken) aren't affected. If the server rejects the
+// new token (e.g. because it's for a different subject), the error is logged and the connection carries on using the
+// previous token, unless it has already expired, in which case the server closes the connection.
+func (router *WebSocketRouter) Authenticate(token string) error {
+	router.tokenMutex.Lock()
+	router.token = token
+	query := router.URL.Query()
+	query.Set("token", token)
+	router.URL.RawQuery = query.Encode()
+	router.tokenMutex.Unlock()
+
+	frame := framing.AuthenticationFrame{
+		Token: token,
+	}
+	err := router.send(frame.Encode())
+	if err != nil {
+		return fmt.Errorf("sending token: %w", err)
+	}
+	return nil
+}
+
+// refreshToken handles a TokenExpiring message for the connection's token, getting a new token from RefreshToken and
+// sending it to the server.
+func (router *WebSocketRouter) refreshToken(message []byte) {
+	frame, err := framing.DecodeTokenExpiringFrame(message)
+	if err != nil {
+		router.logger().Warn("received malformed token-expiring message", "error", err)
+		return
+	}
+
+	if router.RefreshToken == nil {
+		router.logger().Warn("connection token is about to expire", "remaining", frame.Remaining)
+		return
+	}
+
+	token, err := router.RefreshToken(router.context)
+	if err != nil {
+		router.logger().Error("failed to refresh token", "error", err)
+		return
+	}
+
+	err = router.Authenticate(token)
+	if err != nil {
+		router.logger().Error("failed to send refreshed token", "error", err)
+	}
+}
+
+// tokenRejected handles the error the server sends if it rejects a token sent by Authenticate.
+func (router *WebSocketRouter) tokenRejected(message []byte) {
+	if len(message) < 7 {
+		router.logger().Warn("received malformed token rejection")
+		return
+	}
+
+	status, err := framing.DecodeError(message[2], message[7:])
+	if err != nil {
+		router.logger().Warn("received malformed token rejection", "error", err)
+		return
+	}
+	router.logger().Error("server rejected token", "error", status)
+}
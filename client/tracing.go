@@ -0,0 +1,29 @@
+package client
+
+import (
+	"fmt"
+	"github.com/palkerecsenyi/hermod/tracing"
+)
+
+// tracer returns the Tracer that spans should be sent to, which is tracing.Noop if none has been set.
+func (router *WebSocketRouter) tracer() tracing.Tracer {
+	if router.Tracer == nil {
+		return tracing.Noop
+	}
+	return router.Tracer
+}
+
+// startSpan starts the span of a session, as a child of the span carried by the session's context (if there is one).
+// The span's context is added to the session's metadata, so that the server's span is a child of it.
+func (rw *ServiceReadWriter[In, Out]) startSpan() {
+	ctx, span := rw.Router.tracer().Start(rw.Context, fmt.Sprintf("hermod endpoint %d", rw.Endpoint), tracing.SpanKindClient, tracing.Attribute{
+		Key:   "hermod.endpoint",
+		Value: fmt.Sprint(rw.Endpoint),
+	})
+	rw.span = span
+	rw.call.Context = ctx
+
+	if sc := span.SpanContext(); sc.IsValid() {
+		rw.call.Metadata.Set(tracing.TraceparentKey, sc.Traceparent())
+	}
+}
@@ -1,8 +1,8 @@
 package compiler
 
 import (
+	"fmt"
 	"github.com/iancoleman/strcase"
-	"log"
 	"os"
 	"path"
 	"strings"
@@ -13,7 +13,9 @@ type fileConfigPair struct {
 	file   file
 }
 
-func CompileFiles(in, out, packageName, acronyms string) {
+// CompileFiles compiles every Hermod YAML file in the in directory to Go files in the out directory. It stops at the first
+// file that fails to compile, and returns an error describing it.
+func CompileFiles(in, out, packageName, acronyms string) error {
 	// configure strcase acronyms
 	// the ID acronym is for common usage with GORM and other ORMs. you can override it by passing ID=id.
 	strcase.ConfigureAcronym("ID", "ID")
@@ -21,7 +23,7 @@ func CompileFiles(in, out, packageName, acronyms string) {
 		for _, mapping := range strings.Split(acronyms, ",") {
 			splitString := strings.Split(mapping, "=")
 			if len(splitString) != 2 {
-				log.Fatalln("Couldn't parse acronym mappings")
+				return fmt.Errorf("couldn't parse acronym mapping %q", mapping)
 			}
 			strcase.ConfigureAcronym(splitString[0], splitString[1])
 		}
@@ -29,22 +31,19 @@ func CompileFiles(in, out, packageName, acronyms string) {
 
 	files, err := getYamlList(in)
 	if err != nil {
-		log.Println("Failed to find list of files to compile.")
-		log.Fatalln(err)
+		return fmt.Errorf("failed to find list of files to compile: %w", err)
 	}
 
 	var configs []*fileConfigPair
 	for _, file := range files {
 		contents, err := os.ReadFile(path.Join(file.path, file.name))
 		if err != nil {
-			log.Printf("Couldn't read file %s", file.name)
-			log.Fatalln(err)
+			return fmt.Errorf("couldn't read file %s: %w", file.name, err)
 		}
 
 		data, err := parseFile(contents)
 		if err != nil {
-			log.Printf("Failed to parse YAML in file %s", file.name)
-			log.Fatalln(err)
+			return fmt.Errorf("failed to parse YAML in file %s: %w", file.name, err)
 		}
 		configs = append(configs, &fileConfigPair{
 			config: data,
@@ -55,8 +54,9 @@ func CompileFiles(in, out, packageName, acronyms string) {
 	for _, pair := range configs {
 		err = outputConfig(pair.config, pair.file, configs, out, packageName)
 		if err != nil {
-			log.Printf("Failed to generate output for file %s", pair.file.name)
-			log.Fatalln(err)
+			return fmt.Errorf("failed to generate output for file %s: %w", pair.file.name, err)
 		}
 	}
+
+	return nil
 }
@@ -68,7 +68,11 @@ func outputConfig(config *config, file file, configs []*fileConfigPair, outPath,
 	}
 
 	for _, service := range config.Services {
-		imports = append(imports, writeService(&contentBuffer, &service, packageName)...)
+		newImports, err := writeService(&contentBuffer, &service, packageName)
+		if err != nil {
+			return err
+		}
+		imports = append(imports, newImports...)
 	}
 
 	var importBuffer bytes.Buffer
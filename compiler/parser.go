@@ -29,6 +29,12 @@ type endpointDefinition struct {
 	Id   uint16
 	In   endpointArgumentDefinition
 	Out  endpointArgumentDefinition
+	// Resumable endpoints let clients resume sessions after reconnecting
+	Resumable bool
+	// Auth is "required", "optional" or "none". Scopes and Roles must be held by authenticated clients.
+	Auth   string
+	Scopes []string
+	Roles  []string
 }
 
 type serviceDefinition struct {
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/iancoleman/strcase"
-	"log"
 	"strings"
 )
 
@@ -32,6 +31,7 @@ func writeRequest(w *bytes.Buffer, publicPathName string, includeData bool) {
 	}
 	_writelni(w, 3, "Context: req.Context,")
 	_writelni(w, 3, "Headers: req.Headers,")
+	_writelni(w, 3, "Metadata: req.Metadata,")
 	_writelni(w, 3, "Auth: req.Auth,")
 	_writelni(w, 2, "}")
 }
@@ -48,18 +48,68 @@ func writeHandlerCall(w *bytes.Buffer, errIsNew bool, doneCall bool, indentModif
 	_writelni(w, 2+indentModifier, "}")
 
 	if doneCall {
-		_writelni(w, 2+indentModifier, "done <- struct{}{}")
+		_writelni(w, 2+indentModifier, "close(done)")
 	}
 }
 
 func writeDecoderCall(w *bytes.Buffer, in, out string, inArgument *endpointArgumentDefinition, indentModifier int) {
 	_writelni(w, 2+indentModifier, fmt.Sprintf("%s, err := Decode%s(%s)", out, getArgumentDataType(inArgument), in))
 	_writelni(w, 2+indentModifier, "if err != nil {")
-	_writelni(w, 3+indentModifier, "res.SendError(fmt.Errorf(\"handler for endpoint with ID %d failed to decode incoming message: %s\", endpointId, err.Error()))")
+	_writelni(w, 3+indentModifier, "res.SendDecodeError(service.Errorf(framing.StatusInvalidArgument, \"handler for endpoint with ID %d failed to decode incoming message: %s\", endpointId, err.Error()))")
 	_writelni(w, 3+indentModifier, "return")
 	_writelni(w, 2+indentModifier, "}")
 }
 
+// writeEndpointArgument writes a service.EndpointArgument field for service.Describe, if the argument is used.
+func writeEndpointArgument(w *bytes.Buffer, fieldName string, argument *endpointArgumentDefinition) {
+	if argument.UnitName == "" {
+		return
+	}
+
+	_writelni(w, 2, fmt.Sprintf("%s: service.EndpointArgument{", fieldName))
+	_writelni(w, 3, fmt.Sprintf("Unit: *%s{}.GetDefinition(),", getArgumentDataType(argument)))
+	_writelni(w, 3, fmt.Sprintf("Streamed: %t,", argument.Streamed))
+	_writelni(w, 2, "},")
+}
+
+// authModes maps the values of an endpoint's auth field to service.AuthMode constants
+var authModes = map[string]string{
+	"none":     "service.AuthNone",
+	"optional": "service.AuthOptional",
+	"required": "service.AuthRequired",
+}
+
+// writeAuthPolicy writes a service.AuthPolicy field for service.Describe, if the endpoint has one. Endpoints with scopes
+// or roles but no auth mode require authentication.
+func writeAuthPolicy(w *bytes.Buffer, endpoint *endpointDefinition) error {
+	auth := endpoint.Auth
+	if auth == "" {
+		if len(endpoint.Scopes) == 0 && len(endpoint.Roles) == 0 {
+			return nil
+		}
+		auth = "required"
+	}
+
+	mode, ok := authModes[auth]
+	if !ok {
+		return fmt.Errorf("endpoint %s has unknown auth mode %q (must be required, optional or none)", endpoint.Path, auth)
+	}
+	if auth == "none" && (len(endpoint.Scopes) != 0 || len(endpoint.Roles) != 0) {
+		return fmt.Errorf("endpoint %s has scopes or roles, but doesn't use auth", endpoint.Path)
+	}
+
+	_writelni(w, 2, "Auth: service.AuthPolicy{")
+	_writelni(w, 3, fmt.Sprintf("Mode: %s,", mode))
+	if len(endpoint.Scopes) != 0 {
+		_writelni(w, 3, fmt.Sprintf("Scopes: %#v,", endpoint.Scopes))
+	}
+	if len(endpoint.Roles) != 0 {
+		_writelni(w, 3, fmt.Sprintf("Roles: %#v,", endpoint.Roles))
+	}
+	_writelni(w, 2, "},")
+	return nil
+}
+
 func writeClientStub(w *bytes.Buffer, endpointId uint16, publicPathName string, inArgument, outArgument endpointArgumentDefinition) {
 	var (
 		inName  = "encoder.UserFacingHermodUnit"
@@ -75,7 +125,7 @@ func writeClientStub(w *bytes.Buffer, endpointId uint16, publicPathName string,
 	}
 
 	serviceReadWriterType := fmt.Sprintf(`client.ServiceReadWriter[%s, %s]`, inName, outName)
-	_writeln(w, fmt.Sprintf("func Request%s(router *client.WebSocketRouter, token ...string) (*%s, error) {", publicPathName, serviceReadWriterType))
+	_writeln(w, fmt.Sprintf("func Request%s(router *client.WebSocketRouter, options ...client.RequestOption) (*%s, error) {", publicPathName, serviceReadWriterType))
 	_writelni(w, 1, fmt.Sprintf("rw := %s{", serviceReadWriterType))
 	_writelni(w, 2, "Router: router,")
 	_writelni(w, 2, fmt.Sprintf("Endpoint: %d,", endpointId))
@@ -83,12 +133,12 @@ func writeClientStub(w *bytes.Buffer, endpointId uint16, publicPathName string,
 	_writelni(w, 2, fmt.Sprintf("OutSample: %s{},", outName))
 	_writelni(w, 1, "}")
 
-	_writelni(w, 1, "err := rw.Init(token...)")
+	_writelni(w, 1, "err := rw.Init(options...)")
 	_writelni(w, 1, "return &rw, err")
 	_writeln(w, "}")
 }
 
-func writeService(w *bytes.Buffer, service *serviceDefinition, packageName string) (imports []string) {
+func writeService(w *bytes.Buffer, service *serviceDefinition, packageName string) (imports []string, err error) {
 	for _, endpoint := range service.Endpoints {
 		publicPathComponents := strings.Split(endpoint.Path, "/")
 		var publicPathName string
@@ -97,8 +147,7 @@ func writeService(w *bytes.Buffer, service *serviceDefinition, packageName strin
 		}
 
 		if endpoint.Id == 0xFFFF {
-			log.Fatalln("encountered endpoint with illegal ID 0xFFFF")
-			return
+			return nil, fmt.Errorf("endpoint %s has illegal ID 0xFFFF", endpoint.Path)
 		}
 
 		imports = append(imports, fmt.Sprintf("%s/client", packageName))
@@ -112,57 +161,81 @@ func writeService(w *bytes.Buffer, service *serviceDefinition, packageName strin
 		imports = append(imports, fmt.Sprintf("%s/service", packageName))
 		_writelni(w, 1, "Context context.Context")
 		_writelni(w, 1, "Headers http.Header")
+		_writelni(w, 1, "Metadata service.Metadata")
 		_writelni(w, 1, "Auth *service.AuthAPI")
 		_writeln(w, fmt.Sprintf("}"))
 
 		_writeln(w, fmt.Sprintf("type %s_Response struct {", publicPathName))
 		_writelni(w, 1, "sendFunction func(data *[]byte)")
+		_writelni(w, 1, "errorFunction func(err error)")
+		_writelni(w, 1, "trailerFunction func(key, value string)")
+		_writeln(w, "}")
+
+		_writeln(w, fmt.Sprintf("func (res *%s_Response) SetTrailer(key, value string) {", publicPathName))
+		_writelni(w, 1, "res.trailerFunction(key, value)")
 		_writeln(w, "}")
 
 		if endpoint.Out.UnitName != "" {
+			imports = append(imports, fmt.Sprintf("%s/framing", packageName))
 			_writeln(w, fmt.Sprintf("func (res *%s_Response) Send(data *%s) {", publicPathName, getArgumentDataType(&endpoint.Out)))
 			_writelni(w, 1, "encoded, err := data.Encode()")
 			_writelni(w, 1, "if err != nil {")
-			_writelni(w, 2, "t := []byte(\"couldn't encode data\")")
-			_writelni(w, 2, "res.sendFunction(&t)")
+			_writelni(w, 2, "res.errorFunction(service.Errorf(framing.StatusInternal, \"couldn't encode data: %s\", err))")
 			_writelni(w, 2, "return")
 			_writelni(w, 1, "}")
 			_writelni(w, 1, "res.sendFunction(encoded)")
 			_writeln(w, "}")
 		}
 
-		_writeln(w, fmt.Sprintf("func Register%sHandler(handler func(req *%s_Request, res *%s_Response) error) {", publicPathName, publicPathName, publicPathName))
+		_writeln(w, fmt.Sprintf("func Register%sHandler(server *service.Server, handler func(req *%s_Request, res *%s_Response) error) {", publicPathName, publicPathName, publicPathName))
 		_writelni(w, 1, fmt.Sprintf("endpointId := uint16(%d)", endpoint.Id))
-		_writelni(w, 1, "service.RegisterEndpoint(endpointId, func(req *service.Request, res *service.Response) {")
+		_writelni(w, 1, "server.RegisterEndpoint(endpointId, func(req *service.Request, res *service.Response) {")
 		_writelni(w, 2, fmt.Sprintf("response := %s_Response{", publicPathName))
 		_writelni(w, 3, "sendFunction: res.Send,")
+		_writelni(w, 3, "errorFunction: res.SendError,")
+		_writelni(w, 3, "trailerFunction: res.SetTrailer,")
 		_writelni(w, 2, "}")
 
 		if endpoint.In.UnitName != "" {
-			imports = append(imports, "fmt")
+			imports = append(imports, fmt.Sprintf("%s/framing", packageName))
 			if endpoint.In.Streamed {
 				_writelni(w, 2, fmt.Sprintf("d := make(chan *%s)", getArgumentDataType(&endpoint.In)))
 				writeRequest(w, publicPathName, true)
 
 				_writelni(w, 2, "done := make(chan struct{})")
 				_writelni(w, 2, "go func() {")
+				_writelni(w, 3, "defer res.Recover()")
 				writeHandlerCall(w, true, true, 1)
 				_writelni(w, 2, "}()")
 
+				// input is set to nil once the client half-closes the session, so that it's no longer selected
+				_writelni(w, 2, "input := req.Data")
 				_writelni(w, 2, "for {")
 				_writelni(w, 3, "select {")
 				_writelni(w, 3, "case <-req.Context.Done():")
 				_writelni(w, 4, "return")
 				_writelni(w, 3, "case <-done:")
 				_writelni(w, 4, "return")
-				_writelni(w, 3, "case data := <-req.Data:")
+				_writelni(w, 3, "case data, ok := <-input:")
+
+				_writelni(w, 4, "if !ok {")
+				_writelni(w, 5, "close(d)")
+				_writelni(w, 5, "input = nil")
+				_writelni(w, 5, "continue")
+				_writelni(w, 4, "}")
 
 				_writelni(w, 4, "if data == nil {")
 				_writelni(w, 5, "continue")
 				_writelni(w, 4, "}")
 
 				writeDecoderCall(w, "data", "decoded", &endpoint.In, 2)
-				_writelni(w, 4, "request.Data <- decoded")
+				_writelni(w, 4, "select {")
+				_writelni(w, 4, "case request.Data <- decoded:")
+				_writelni(w, 4, "case <-req.Context.Done():")
+				_writelni(w, 5, "return")
+				_writelni(w, 4, "case <-done:")
+				_writelni(w, 5, "return")
+				_writelni(w, 4, "}")
 				_writelni(w, 3, "}")
 				_writelni(w, 2, "}")
 			} else {
@@ -181,7 +254,20 @@ func writeService(w *bytes.Buffer, service *serviceDefinition, packageName strin
 			writeHandlerCall(w, true, false, 0)
 		}
 
-		_writelni(w, 1, "})")
+		_writelni(w, 1, "}, service.Describe(service.Endpoint{")
+		_writelni(w, 2, fmt.Sprintf("Service: &service.Service{Name: %q},", service.Name))
+		_writelni(w, 2, fmt.Sprintf("Path: %q,", endpoint.Path))
+		writeEndpointArgument(w, "In", &endpoint.In)
+		writeEndpointArgument(w, "Out", &endpoint.Out)
+		err = writeAuthPolicy(w, &endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint.Resumable {
+			_writelni(w, 1, "}), service.Resumable())")
+		} else {
+			_writelni(w, 1, "}))")
+		}
 		_writeln(w, "}")
 	}
 
@@ -2,62 +2,130 @@ package framing
 
 import (
 	"crypto/sha256"
+	"fmt"
 	"github.com/palkerecsenyi/hermod/encoder"
+	"time"
 )
 
 const (
 	Data                         = 0
 	ClientSessionRequest         = 1
-	ClientSessionRequestWithAuth = 0b10000001
+	ClientSessionRequestWithAuth = ClientSessionRequest | SessionRequestAuth
 	ServerSessionAck             = 2
 	Close                        = 3
 	ErrorClientID                = 4
 	ErrorSessionID               = 5
 	Authentication               = 6
 	AuthenticationAck            = 7
+	HalfClose                    = 8
+	ResumeSession                = 9
+	GoAway                       = 10
+	TokenExpiring                = 11
 )
 
+// Option bits can be combined with some flags to signal that the frame contains optional sections. The meaning of each
+// bit depends on the flag it's combined with. Use BaseFlag to strip them.
+const (
+	// SessionRequestAuth signals that a session request ends with a token
+	SessionRequestAuth = 0b10000000
+	// SessionRequestMetadata signals that a session request contains a Metadata block after the Client ID
+	SessionRequestMetadata = 0b01000000
+	// SessionRequestTimeout signals that a session request contains a timeout in milliseconds, after the Metadata block
+	// (if any)
+	SessionRequestTimeout = 0b00100000
+	// CloseTrailers signals that a Close frame contains a Metadata block of trailers
+	CloseTrailers = 0b01000000
+	// ErrorStatus signals that an ErrorClientID or ErrorSessionID frame contains an encoded Status rather than a plain
+	// string message
+	ErrorStatus = 0b01000000
+	// AckResumeToken signals that a ServerSessionAck frame ends with a resume token, meaning that the session can be
+	// resumed with a ResumeSession frame if the connection is lost
+	AckResumeToken = 0b10000000
+	// DataSequence signals that a Data frame contains a sequence number after the Session ID
+	DataSequence = 0b10000000
+)
+
+const optionMask = 0b11100000
+
+// BaseFlag returns flag without any option bits.
+func BaseFlag(flag uint8) uint8 {
+	return flag &^ optionMask
+}
+
 // AuthenticationEndpoint is a phantom endpoint that's used to signify an authentication message
 const AuthenticationEndpoint = 0xFFFF
 
+// ConnectionEndpoint is the phantom endpoint used by other connection-level messages that don't belong to a session,
+// like GoAway. It's the same as AuthenticationEndpoint.
+const ConnectionEndpoint = AuthenticationEndpoint
+
 type MessageFrame struct {
 	EndpointId uint16
 	Flag       uint8
 	SessionId  uint32
-	Data       []byte
+	// Sequence is only sent if Flag has the DataSequence bit set
+	Sequence uint32
+	Data     []byte
 }
 
-func CreateErrorClient(endpointId uint16, clientId uint32, message string) []byte {
+func CreateErrorClient(endpointId uint16, clientId uint32, status *Status) []byte {
 	errorFrame := MessageFrame{
 		EndpointId: endpointId,
 		SessionId:  clientId,
-		Flag:       ErrorClientID,
-		Data:       []byte(message),
+		Flag:       ErrorClientID | ErrorStatus,
+		Data:       status.Encode(),
 	}
 
 	return errorFrame.Encode()
 }
 
-func CreateErrorSession(endpointId uint16, sessionId uint32, message string) []byte {
+func CreateErrorSession(endpointId uint16, sessionId uint32, status *Status) []byte {
 	errorFrame := MessageFrame{
 		EndpointId: endpointId,
 		SessionId:  sessionId,
-		Flag:       ErrorSessionID,
-		Data:       []byte(message),
+		Flag:       ErrorSessionID | ErrorStatus,
+		Data:       status.Encode(),
 	}
 
 	return errorFrame.Encode()
 }
 
+// DecodeError decodes the contents of an ErrorClientID or ErrorSessionID frame (i.e. everything after the Session or
+// Client ID). Plain string messages sent without the ErrorStatus bit are converted to a Status with the StatusUnknown
+// code.
+func DecodeError(flag uint8, data []byte) (*Status, error) {
+	if flag&ErrorStatus == 0 {
+		return NewStatus(StatusUnknown, string(data)), nil
+	}
+
+	return DecodeStatus(data)
+}
+
 func (frame MessageFrame) Encode() []byte {
 	var data []byte
 	data = *encoder.Add16ToSlice(frame.EndpointId, &data)
 	data = append(data, frame.Flag)
 	data = *encoder.Add32ToSlice(frame.SessionId, &data)
+	if BaseFlag(frame.Flag) == Data && frame.Flag&DataSequence != 0 {
+		data = *encoder.Add32ToSlice(frame.Sequence, &data)
+	}
 	data = append(data, frame.Data...)
 	return data
 }
 
+// DecodeData decodes the contents of a Data frame (i.e. everything after the Session ID), returning the sequence number
+// (or 0 if there isn't one) and the encoded unit.
+func DecodeData(flag uint8, data []byte) (uint32, []byte, error) {
+	if flag&DataSequence == 0 {
+		return 0, data, nil
+	}
+
+	if len(data) < 4 {
+		return 0, nil, fmt.Errorf("data sequence number truncated")
+	}
+	return encoder.SliceToU32(data[0:4]), data[4:], nil
+}
+
 func (frame *MessageFrame) Close() []byte {
 	m := MessageFrame{
 		EndpointId: frame.EndpointId,
@@ -69,27 +137,151 @@ func (frame *MessageFrame) Close() []byte {
 	return encoded
 }
 
+// HalfClose returns a HalfClose frame for the session, which tells the server that the client won't send any more Data
+// messages but still wants to receive messages.
+func (frame *MessageFrame) HalfClose() []byte {
+	m := MessageFrame{
+		EndpointId: frame.EndpointId,
+		Flag:       HalfClose,
+		SessionId:  frame.SessionId,
+		Data:       []byte{},
+	}
+	return m.Encode()
+}
+
+// CloseWithTrailers is like Close, but also attaches trailing Metadata to the Close frame. If trailers is empty, the
+// result is identical to Close.
+func (frame *MessageFrame) CloseWithTrailers(trailers Metadata) ([]byte, error) {
+	if len(trailers) == 0 {
+		return frame.Close(), nil
+	}
+
+	encodedTrailers, err := trailers.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	m := MessageFrame{
+		EndpointId: frame.EndpointId,
+		Flag:       Close | CloseTrailers,
+		SessionId:  frame.SessionId,
+		Data:       encodedTrailers,
+	}
+	return m.Encode(), nil
+}
+
 type SessionFrame struct {
 	EndpointId uint16
 	Flag       uint8
 	ClientId   uint32
 	Token      string
 	SessionId  *uint32
+	// Metadata is only sent with session requests. The SessionRequestMetadata bit is added to the flag automatically
+	// if it isn't empty.
+	Metadata Metadata
+	// Timeout is only sent with session requests, and tells the server how long the client is willing to wait for the
+	// session to complete. The SessionRequestTimeout bit is added to the flag automatically if it's positive. It's sent
+	// with millisecond precision.
+	Timeout time.Duration
+	// ResumeToken is only sent with acks. The AckResumeToken bit is added to the flag automatically if it isn't empty.
+	ResumeToken []byte
 }
 
-func (frame *SessionFrame) Encode() []byte {
+// maxTimeout is the longest timeout that can be represented in a session request
+const maxTimeout = time.Duration(0xffffffff) * time.Millisecond
+
+func (frame *SessionFrame) Encode() ([]byte, error) {
+	flag := frame.Flag
+	if frame.SessionId == nil && len(frame.Metadata) != 0 {
+		flag |= SessionRequestMetadata
+	}
+	if frame.SessionId == nil && frame.Timeout > 0 {
+		flag |= SessionRequestTimeout
+	}
+
 	var data []byte
 	data = *encoder.Add16ToSlice(frame.EndpointId, &data)
-	data = append(data, frame.Flag)
+	data = append(data, flag)
 	data = *encoder.Add32ToSlice(frame.ClientId, &data)
 
 	if frame.SessionId != nil {
 		data = *encoder.Add32ToSlice(*frame.SessionId, &data)
-	} else if frame.Flag == ClientSessionRequestWithAuth {
+		if len(frame.ResumeToken) != 0 {
+			data[2] |= AckResumeToken
+			data = append(data, frame.ResumeToken...)
+		}
+		return data, nil
+	}
+
+	if flag&SessionRequestMetadata != 0 {
+		encodedMetadata, err := frame.Metadata.Encode()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, encodedMetadata...)
+	}
+
+	if flag&SessionRequestTimeout != 0 {
+		timeout := frame.Timeout
+		if timeout > maxTimeout {
+			timeout = maxTimeout
+		}
+
+		// round up so that very short timeouts aren't sent as 0
+		milliseconds := (timeout + time.Millisecond - 1) / time.Millisecond
+		data = *encoder.Add32ToSlice(uint32(milliseconds), &data)
+	}
+
+	// the token must always come last, since it isn't length-prefixed
+	if flag&SessionRequestAuth != 0 {
 		data = append(data, []byte(frame.Token)...)
 	}
 
-	return data
+	return data, nil
+}
+
+// DecodeSessionRequest decodes a session request frame (i.e. one with the ClientSessionRequest base flag) including any
+// optional sections signalled by its option bits.
+func DecodeSessionRequest(data []byte) (*SessionFrame, error) {
+	if len(data) < 7 {
+		return nil, fmt.Errorf("session request too short")
+	}
+
+	frame := SessionFrame{
+		EndpointId: encoder.SliceToU16(data[0:2]),
+		Flag:       data[2],
+		ClientId:   encoder.SliceToU32(data[3:7]),
+	}
+
+	if BaseFlag(frame.Flag) != ClientSessionRequest {
+		return nil, fmt.Errorf("flag %b is not a session request", frame.Flag)
+	}
+
+	index := 7
+	if frame.Flag&SessionRequestMetadata != 0 {
+		md, n, err := DecodeMetadata(data[index:])
+		if err != nil {
+			return nil, err
+		}
+
+		frame.Metadata = md
+		index += n
+	}
+
+	if frame.Flag&SessionRequestTimeout != 0 {
+		if len(data) < index+4 {
+			return nil, fmt.Errorf("session request timeout truncated")
+		}
+
+		frame.Timeout = time.Duration(encoder.SliceToU32(data[index:index+4])) * time.Millisecond
+		index += 4
+	}
+
+	if frame.Flag&SessionRequestAuth != 0 {
+		frame.Token = string(data[index:])
+	}
+
+	return &frame, nil
 }
 
 func (frame *SessionFrame) Ack(sessionId uint32) *[]byte {
@@ -99,10 +291,76 @@ func (frame *SessionFrame) Ack(sessionId uint32) *[]byte {
 		ClientId:   frame.ClientId,
 		SessionId:  &sessionId,
 	}
-	encoded := m.Encode()
+	// acks never contain metadata, so encoding can't fail
+	encoded, _ := m.Encode()
+	return &encoded
+}
+
+// AckWithResumeToken is like Ack, but also sends a token that the client can use to resume the session on a new
+// connection.
+func (frame *SessionFrame) AckWithResumeToken(sessionId uint32, token []byte) *[]byte {
+	m := SessionFrame{
+		EndpointId:  frame.EndpointId,
+		Flag:        ServerSessionAck,
+		ClientId:    frame.ClientId,
+		SessionId:   &sessionId,
+		ResumeToken: token,
+	}
+	encoded, _ := m.Encode()
 	return &encoded
 }
 
+// ResumeFrame is sent by a client to resume a session on a new connection, using the token from the session's
+// ServerSessionAck. The server replies with a ServerSessionAck (containing a new Session ID) or an ErrorClientID, just
+// like with a session request.
+type ResumeFrame struct {
+	EndpointId uint16
+	ClientId   uint32
+	// LastSequence is the sequence number of the last Data message the client received, or 0 if it hasn't received any
+	LastSequence uint32
+	Token        []byte
+}
+
+func (frame *ResumeFrame) Encode() []byte {
+	var data []byte
+	data = *encoder.Add16ToSlice(frame.EndpointId, &data)
+	data = append(data, ResumeSession)
+	data = *encoder.Add32ToSlice(frame.ClientId, &data)
+	data = *encoder.Add32ToSlice(frame.LastSequence, &data)
+	data = append(data, frame.Token...)
+	return data
+}
+
+func DecodeResumeFrame(data []byte) (*ResumeFrame, error) {
+	if len(data) < 11 {
+		return nil, fmt.Errorf("resume frame too short")
+	}
+
+	if BaseFlag(data[2]) != ResumeSession {
+		return nil, fmt.Errorf("flag %b is not a resume request", data[2])
+	}
+
+	return &ResumeFrame{
+		EndpointId:   encoder.SliceToU16(data[0:2]),
+		ClientId:     encoder.SliceToU32(data[3:7]),
+		LastSequence: encoder.SliceToU32(data[7:11]),
+		Token:        data[11:],
+	}, nil
+}
+
+// AuthenticationFrame authenticates the connection (i.e. every session without a session-specific token) using Token.
+type AuthenticationFrame struct {
+	Token string
+}
+
+func (frame *AuthenticationFrame) Encode() []byte {
+	var data []byte
+	data = *encoder.Add16ToSlice(AuthenticationEndpoint, &data)
+	data = append(data, Authentication)
+	data = append(data, []byte(frame.Token)...)
+	return data
+}
+
 type AuthenticationAckFrame struct {
 	TokenHash [32]byte
 }
@@ -120,3 +378,85 @@ func (frame *AuthenticationAckFrame) Encode() *[]byte {
 	data = append(data, frame.TokenHash[:]...)
 	return &data
 }
+
+// GoAwayFrame tells the client that the server is shutting down. Sessions that are already open carry on as usual, but
+// the client must not open any more sessions on the connection. The server closes the connection once its sessions
+// have finished, or once Timeout has passed (if it's positive).
+type GoAwayFrame struct {
+	Timeout time.Duration
+}
+
+func (frame *GoAwayFrame) Encode() []byte {
+	timeout := frame.Timeout
+	if timeout < 0 {
+		timeout = 0
+	}
+	if timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+
+	var data []byte
+	data = *encoder.Add16ToSlice(ConnectionEndpoint, &data)
+	data = append(data, GoAway)
+	data = *encoder.Add32ToSlice(uint32(timeout/time.Millisecond), &data)
+	return data
+}
+
+// TokenExpiringFrame warns the client that a token is about to expire. If SessionId is 0 and EndpointId is
+// ConnectionEndpoint, it's the connection's token, which the client can refresh by sending an Authentication frame.
+// Otherwise, it's the token the session was opened with. Sessions using the token are ended with an Unauthenticated error
+// once Remaining has passed, unless the token has been refreshed.
+type TokenExpiringFrame struct {
+	EndpointId uint16
+	SessionId  uint32
+	Remaining  time.Duration
+}
+
+func (frame *TokenExpiringFrame) Encode() []byte {
+	remaining := frame.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+	if remaining > maxTimeout {
+		remaining = maxTimeout
+	}
+
+	var data []byte
+	data = *encoder.Add16ToSlice(frame.EndpointId, &data)
+	data = append(data, TokenExpiring)
+	data = *encoder.Add32ToSlice(frame.SessionId, &data)
+	data = *encoder.Add32ToSlice(uint32(remaining/time.Millisecond), &data)
+	return data
+}
+
+// DecodeTokenExpiringFrame decodes an entire TokenExpiring message (including the endpoint ID and flag).
+func DecodeTokenExpiringFrame(data []byte) (*TokenExpiringFrame, error) {
+	if len(data) < 11 {
+		return nil, fmt.Errorf("token-expiring message too short")
+	}
+
+	if data[2] != TokenExpiring {
+		return nil, fmt.Errorf("message is not a token-expiring message")
+	}
+
+	return &TokenExpiringFrame{
+		EndpointId: encoder.SliceToU16(data[0:2]),
+		SessionId:  encoder.SliceToU32(data[3:7]),
+		Remaining:  time.Duration(encoder.SliceToU32(data[7:11])) * time.Millisecond,
+	}, nil
+}
+
+// DecodeGoAwayFrame decodes an entire GoAway message (including the endpoint ID and flag).
+func DecodeGoAwayFrame(data []byte) (*GoAwayFrame, error) {
+	if len(data) < 7 {
+		return nil, fmt.Errorf("go-away message too short")
+	}
+
+	if encoder.SliceToU16(data[0:2]) != ConnectionEndpoint || data[2] != GoAway {
+		return nil, fmt.Errorf("message is not a go-away message")
+	}
+
+	return &GoAwayFrame{
+		Timeout: time.Duration(encoder.SliceToU32(data[3:7])) * time.Millisecond,
+	}, nil
+}
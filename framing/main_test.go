@@ -0,0 +1,162 @@
+package framing
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionRequestOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		request SessionFrame
+		flag    uint8
+	}{
+		{"plain", SessionFrame{Flag: ClientSessionRequest}, ClientSessionRequest},
+		{"auth", SessionFrame{Flag: ClientSessionRequestWithAuth, Token: "token"}, ClientSessionRequestWithAuth},
+		{"timeout", SessionFrame{Flag: ClientSessionRequest, Timeout: 1500 * time.Millisecond}, ClientSessionRequest | SessionRequestTimeout},
+		{"auth and timeout", SessionFrame{
+			Flag:    ClientSessionRequestWithAuth,
+			Token:   "token",
+			Timeout: time.Second,
+		}, ClientSessionRequestWithAuth | SessionRequestTimeout},
+		{"metadata and timeout", SessionFrame{
+			Flag:     ClientSessionRequest,
+			Metadata: Metadata{"key": "value"},
+			Timeout:  time.Second,
+		}, ClientSessionRequest | SessionRequestMetadata | SessionRequestTimeout},
+		{"auth, metadata and timeout", SessionFrame{
+			Flag:     ClientSessionRequestWithAuth,
+			Token:    "token",
+			Metadata: Metadata{"key": "value"},
+			Timeout:  time.Second,
+		}, ClientSessionRequestWithAuth | SessionRequestMetadata | SessionRequestTimeout},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.request.EndpointId = 12
+			test.request.ClientId = 34
+
+			encoded, err := test.request.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoded[2] != test.flag {
+				t.Errorf("got flag %b, want %b", encoded[2], test.flag)
+			}
+			if BaseFlag(encoded[2]) != ClientSessionRequest {
+				t.Errorf("got base flag %d, want %d", BaseFlag(encoded[2]), ClientSessionRequest)
+			}
+
+			decoded, err := DecodeSessionRequest(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := test.request
+			want.Flag = test.flag
+			if want.Metadata == nil && decoded.Metadata != nil {
+				t.Errorf("got metadata %v, want none", decoded.Metadata)
+			}
+			decoded.Metadata, want.Metadata = nil, nil
+			if !reflect.DeepEqual(*decoded, want) {
+				t.Errorf("got %+v, want %+v", *decoded, want)
+			}
+		})
+	}
+}
+
+func TestSessionRequestTimeoutPrecision(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    time.Duration
+	}{
+		// timeouts are rounded up to the next millisecond, so that they're never sent as 0
+		{time.Nanosecond, time.Millisecond},
+		{1500 * time.Microsecond, 2 * time.Millisecond},
+		{time.Hour, time.Hour},
+		{maxTimeout + time.Hour, maxTimeout},
+	}
+
+	for _, test := range tests {
+		request := SessionFrame{Flag: ClientSessionRequest, Timeout: test.timeout}
+		encoded, err := request.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := DecodeSessionRequest(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Timeout != test.want {
+			t.Errorf("got timeout %s for %s, want %s", decoded.Timeout, test.timeout, test.want)
+		}
+	}
+
+	// negative timeouts aren't sent
+	request := SessionFrame{Flag: ClientSessionRequest, Timeout: -time.Second}
+	encoded, _ := request.Encode()
+	if encoded[2]&SessionRequestTimeout != 0 {
+		t.Errorf("got flag %b for a negative timeout, want the timeout bit to be unset", encoded[2])
+	}
+}
+
+func TestDecodeTruncatedSessionRequestTimeout(t *testing.T) {
+	request := SessionFrame{
+		Flag:     ClientSessionRequest,
+		Metadata: Metadata{"key": "value"},
+		Timeout:  time.Second,
+	}
+	encoded, err := request.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(encoded); i++ {
+		if _, err := DecodeSessionRequest(encoded[:i]); err == nil {
+			t.Errorf("decoded request truncated to %d of %d bytes", i, len(encoded))
+		}
+	}
+}
+
+func TestDecodeSessionRequestRejectsOtherFlags(t *testing.T) {
+	frame := MessageFrame{Flag: Data, SessionId: 1}
+	if _, err := DecodeSessionRequest(frame.Encode()); err == nil {
+		t.Error("decoded a Data frame as a session request")
+	}
+}
+
+func TestAckNeverHasRequestOptions(t *testing.T) {
+	request := SessionFrame{
+		EndpointId: 12,
+		Flag:       ClientSessionRequest,
+		ClientId:   34,
+		Metadata:   Metadata{"key": "value"},
+		Timeout:    time.Second,
+	}
+
+	ack := *request.Ack(56)
+	if len(ack) != 11 || ack[2] != ServerSessionAck {
+		t.Errorf("got ack %v, want an 11 byte ack without any option bits", ack)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	frame := MessageFrame{EndpointId: 0x1234, Flag: Data, SessionId: 0x56789abc, Data: []byte{1, 2, 3}}
+
+	halfClose := frame.HalfClose()
+	want := []byte{0x12, 0x34, HalfClose, 0x56, 0x78, 0x9a, 0xbc}
+	if !reflect.DeepEqual(halfClose, want) {
+		t.Errorf("got %v, want %v", halfClose, want)
+	}
+
+	// HalfClose doesn't share a value with any option bit, so it's unaffected by BaseFlag
+	if BaseFlag(halfClose[2]) != HalfClose {
+		t.Errorf("got base flag %d, want %d", BaseFlag(halfClose[2]), HalfClose)
+	}
+	if BaseFlag(halfClose[2]) == Close {
+		t.Error("HalfClose can't be told apart from Close")
+	}
+}
@@ -0,0 +1,109 @@
+package framing
+
+import (
+	"fmt"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"sort"
+)
+
+// Metadata is a set of key/value pairs attached to a session. Clients can send Metadata when opening a session (e.g.
+// request IDs, locale or tenant), and servers can send Metadata back as trailers when closing a session.
+type Metadata map[string]string
+
+// Get returns the value for key, or an empty string if it isn't set. It's safe to call on a nil Metadata.
+func (md Metadata) Get(key string) string {
+	if md == nil {
+		return ""
+	}
+
+	return md[key]
+}
+
+// Set sets the value for key, overwriting any previous value.
+func (md Metadata) Set(key, value string) {
+	md[key] = value
+}
+
+// Copy returns a shallow copy of the Metadata that can be modified without affecting the original.
+func (md Metadata) Copy() Metadata {
+	c := Metadata{}
+	for key, value := range md {
+		c[key] = value
+	}
+	return c
+}
+
+// Encode converts the Metadata into its binary form:
+// [2 bytes pair count] then for each pair:
+// [2 bytes key length (k)] [k bytes key] [2 bytes value length (v)] [v bytes value]
+// Keys are sorted to make the output deterministic.
+func (md Metadata) Encode() ([]byte, error) {
+	if len(md) > 0xffff {
+		return nil, fmt.Errorf("metadata has too many pairs (%d)", len(md))
+	}
+
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var data []byte
+	data = *encoder.Add16ToSlice(uint16(len(md)), &data)
+	for _, key := range keys {
+		value := md[key]
+		if len(key) > 0xffff || len(value) > 0xffff {
+			return nil, fmt.Errorf("metadata pair %s is over size limit", key)
+		}
+
+		data = *encoder.Add16ToSlice(uint16(len(key)), &data)
+		data = append(data, key...)
+		data = *encoder.Add16ToSlice(uint16(len(value)), &data)
+		data = append(data, value...)
+	}
+
+	return data, nil
+}
+
+// DecodeMetadata decodes a Metadata block from the start of data, returning the Metadata and the number of bytes that
+// were consumed.
+func DecodeMetadata(data []byte) (Metadata, int, error) {
+	if len(data) < 2 {
+		return nil, 0, fmt.Errorf("metadata block too short")
+	}
+
+	count := int(encoder.SliceToU16(data[0:2]))
+	index := 2
+
+	readString := func() (string, error) {
+		if len(data) < index+2 {
+			return "", fmt.Errorf("metadata block truncated")
+		}
+		length := int(encoder.SliceToU16(data[index : index+2]))
+		index += 2
+
+		if len(data) < index+length {
+			return "", fmt.Errorf("metadata block truncated")
+		}
+		s := string(data[index : index+length])
+		index += length
+		return s, nil
+	}
+
+	md := Metadata{}
+	for i := 0; i < count; i++ {
+		key, err := readString()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		value, err := readString()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		md[key] = value
+	}
+
+	return md, index, nil
+}
@@ -0,0 +1,161 @@
+package framing
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	tests := []Metadata{
+		{},
+		{"request-id": "abc"},
+		{"locale": "en-GB", "tenant": "", "": "empty key", "unicode": "héllo"},
+	}
+
+	for _, md := range tests {
+		encoded, err := md.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// anything after the block is left alone
+		decoded, n, err := DecodeMetadata(append(encoded, 0xff))
+		if err != nil {
+			t.Fatalf("decoding %v: %s", md, err)
+		}
+		if n != len(encoded) {
+			t.Errorf("decoding %v consumed %d bytes, want %d", md, n, len(encoded))
+		}
+		if !reflect.DeepEqual(decoded, md) {
+			t.Errorf("got %v, want %v", decoded, md)
+		}
+	}
+}
+
+func TestMetadataEncodingIsDeterministic(t *testing.T) {
+	md := Metadata{"b": "2", "a": "1", "c": "3"}
+	first, err := md.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0, 3, 0, 1, 'a', 0, 1, '1', 0, 1, 'b', 0, 1, '2', 0, 1, 'c', 0, 1, '3'}
+	if !bytes.Equal(first, want) {
+		t.Errorf("got %v, want %v", first, want)
+	}
+
+	for i := 0; i < 10; i++ {
+		encoded, _ := md.Encode()
+		if !bytes.Equal(encoded, first) {
+			t.Fatalf("got %v, then %v", first, encoded)
+		}
+	}
+}
+
+func TestMetadataOverSizeLimit(t *testing.T) {
+	if _, err := (Metadata{"key": strings.Repeat("a", 0x10000)}).Encode(); err == nil {
+		t.Error("encoded value longer than 65535 bytes")
+	}
+	if _, err := (Metadata{strings.Repeat("a", 0x10000): "value"}).Encode(); err == nil {
+		t.Error("encoded key longer than 65535 bytes")
+	}
+}
+
+func TestDecodeTruncatedMetadata(t *testing.T) {
+	encoded, err := (Metadata{"key": "value", "other": "value"}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(encoded); i++ {
+		if _, _, err := DecodeMetadata(encoded[:i]); err == nil {
+			t.Errorf("decoded block truncated to %d of %d bytes", i, len(encoded))
+		}
+	}
+}
+
+func TestMetadataGetOnNil(t *testing.T) {
+	var md Metadata
+	if value := md.Get("key"); value != "" {
+		t.Errorf("got %q, want an empty string", value)
+	}
+}
+
+func TestSessionRequestMetadata(t *testing.T) {
+	request := SessionFrame{
+		EndpointId: 12,
+		Flag:       ClientSessionRequest,
+		ClientId:   34,
+		Metadata:   Metadata{"request-id": "abc"},
+	}
+	encoded, err := request.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded[2] != ClientSessionRequest|SessionRequestMetadata {
+		t.Errorf("got flag %b, want the metadata bit to be set", encoded[2])
+	}
+
+	decoded, err := DecodeSessionRequest(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.EndpointId != 12 || decoded.ClientId != 34 || !reflect.DeepEqual(decoded.Metadata, request.Metadata) {
+		t.Errorf("got %+v, want %+v", decoded, request)
+	}
+
+	// requests without metadata don't have the bit set
+	request.Metadata = nil
+	encoded, _ = request.Encode()
+	if encoded[2] != ClientSessionRequest || len(encoded) != 7 {
+		t.Errorf("got %v, want a 7 byte request without any option bits", encoded)
+	}
+}
+
+func TestDecodeTruncatedSessionRequestMetadata(t *testing.T) {
+	request := SessionFrame{
+		Flag:     ClientSessionRequest,
+		Metadata: Metadata{"request-id": "abc"},
+	}
+	encoded, err := request.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < len(encoded); i++ {
+		if _, err := DecodeSessionRequest(encoded[:i]); err == nil {
+			t.Errorf("decoded request truncated to %d of %d bytes", i, len(encoded))
+		}
+	}
+}
+
+func TestCloseWithTrailers(t *testing.T) {
+	frame := MessageFrame{EndpointId: 12, SessionId: 34}
+
+	closeFrame, err := frame.CloseWithTrailers(Metadata{"echoed": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if closeFrame[2] != Close|CloseTrailers {
+		t.Errorf("got flag %b, want the trailers bit to be set", closeFrame[2])
+	}
+
+	trailers, n, err := DecodeMetadata(closeFrame[7:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(closeFrame)-7 || trailers.Get("echoed") != "true" {
+		t.Errorf("got trailers %v (%d bytes), want echoed=true", trailers, n)
+	}
+
+	// without any trailers, the frame is a plain Close frame
+	closeFrame, err = frame.CloseWithTrailers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(closeFrame, frame.Close()) {
+		t.Errorf("got %v, want %v", closeFrame, frame.Close())
+	}
+}
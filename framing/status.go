@@ -0,0 +1,151 @@
+package framing
+
+import (
+	"errors"
+	"fmt"
+	"github.com/palkerecsenyi/hermod/encoder"
+)
+
+// StatusCode describes the category of an error sent in an error frame. The codes and their meanings are the same as
+// gRPC's status codes.
+type StatusCode uint8
+
+const (
+	StatusOK StatusCode = iota
+	StatusCancelled
+	StatusUnknown
+	StatusInvalidArgument
+	StatusDeadlineExceeded
+	StatusNotFound
+	StatusAlreadyExists
+	StatusPermissionDenied
+	StatusResourceExhausted
+	StatusFailedPrecondition
+	StatusAborted
+	StatusOutOfRange
+	StatusUnimplemented
+	StatusInternal
+	StatusUnavailable
+	StatusDataLoss
+	StatusUnauthenticated
+)
+
+var statusCodeNames = map[StatusCode]string{
+	StatusOK:                 "OK",
+	StatusCancelled:          "Cancelled",
+	StatusUnknown:            "Unknown",
+	StatusInvalidArgument:    "InvalidArgument",
+	StatusDeadlineExceeded:   "DeadlineExceeded",
+	StatusNotFound:           "NotFound",
+	StatusAlreadyExists:      "AlreadyExists",
+	StatusPermissionDenied:   "PermissionDenied",
+	StatusResourceExhausted:  "ResourceExhausted",
+	StatusFailedPrecondition: "FailedPrecondition",
+	StatusAborted:            "Aborted",
+	StatusOutOfRange:         "OutOfRange",
+	StatusUnimplemented:      "Unimplemented",
+	StatusInternal:           "Internal",
+	StatusUnavailable:        "Unavailable",
+	StatusDataLoss:           "DataLoss",
+	StatusUnauthenticated:    "Unauthenticated",
+}
+
+func (code StatusCode) String() string {
+	if name, ok := statusCodeNames[code]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("StatusCode(%d)", uint8(code))
+}
+
+// Status is a structured error that's sent to the client in an error frame. It implements the error interface, so
+// handlers can return it like any other error, and clients can retrieve it using errors.As.
+type Status struct {
+	Code    StatusCode
+	Message string
+	// Details is an optional encoded Hermod unit that provides more information about the error. Use SetDetails and
+	// DecodeDetails rather than setting it directly.
+	Details []byte
+}
+
+// NewStatus creates a Status with the specified code and message.
+func NewStatus(code StatusCode, message string) *Status {
+	return &Status{
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Errorf creates a Status with the specified code and a message formatted according to format.
+func Errorf(code StatusCode, format string, a ...any) *Status {
+	return NewStatus(code, fmt.Sprintf(format, a...))
+}
+
+// StatusFromError converts any error into a Status. If err is (or wraps) a Status, that Status is returned. Otherwise,
+// a Status with the StatusUnknown code and the error's message is created.
+func StatusFromError(err error) *Status {
+	var status *Status
+	if errors.As(err, &status) {
+		return status
+	}
+
+	return NewStatus(StatusUnknown, err.Error())
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("%s: %s", s.Code, s.Message)
+}
+
+// SetDetails encodes unit and attaches it to the Status.
+func (s *Status) SetDetails(unit encoder.UserFacingHermodUnit) error {
+	encoded, err := encoder.UserEncode(unit)
+	if err != nil {
+		return fmt.Errorf("encoding details: %s", err)
+	}
+
+	s.Details = *encoded
+	return nil
+}
+
+// DecodeDetails decodes the details attached to the Status. sample is an instance of the unit you expect the details to
+// be (in the same way as encoder.UserDecode). It returns nil without an error if the Status has no details.
+func (s *Status) DecodeDetails(sample encoder.UserFacingHermodUnit) (encoder.UserFacingHermodUnit, error) {
+	if len(s.Details) == 0 {
+		return nil, nil
+	}
+
+	return encoder.UserDecode(sample, &s.Details)
+}
+
+// Encode converts the Status into its binary form:
+// [1 byte status code] [4 bytes message length (n)] [n bytes message] [encoded details unit (optional)]
+func (s *Status) Encode() []byte {
+	data := []byte{byte(s.Code)}
+	data = *encoder.Add32ToSlice(uint32(len(s.Message)), &data)
+	data = append(data, s.Message...)
+	data = append(data, s.Details...)
+	return data
+}
+
+// DecodeStatus decodes the binary form of a Status, as produced by Status.Encode.
+func DecodeStatus(data []byte) (*Status, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("status too short")
+	}
+
+	length := int(encoder.SliceToU32(data[1:5]))
+	if len(data) < 5+length {
+		return nil, fmt.Errorf("status message truncated")
+	}
+
+	status := Status{
+		Code:    StatusCode(data[0]),
+		Message: string(data[5 : 5+length]),
+	}
+
+	if details := data[5+length:]; len(details) != 0 {
+		status.Details = details
+	}
+
+	return &status, nil
+}
@@ -0,0 +1,123 @@
+package framing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestStatusRoundTrip(t *testing.T) {
+	tests := []*Status{
+		NewStatus(StatusOK, ""),
+		NewStatus(StatusNotFound, "user not found"),
+		{Code: StatusInvalidArgument, Message: "bad request", Details: []byte{0, 1, 2, 3}},
+		{Code: StatusCode(200), Message: "unknown code"},
+	}
+
+	for _, status := range tests {
+		decoded, err := DecodeStatus(status.Encode())
+		if err != nil {
+			t.Fatalf("decoding %s: %s", status, err)
+		}
+		if !reflect.DeepEqual(decoded, status) {
+			t.Errorf("got %+v, want %+v", decoded, status)
+		}
+	}
+}
+
+func TestDecodeTruncatedStatus(t *testing.T) {
+	encoded := NewStatus(StatusNotFound, "user not found").Encode()
+
+	for i := 0; i < len(encoded); i++ {
+		if _, err := DecodeStatus(encoded[:i]); err == nil {
+			t.Errorf("decoded status truncated to %d of %d bytes", i, len(encoded))
+		}
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	status := &Status{Code: StatusPermissionDenied, Message: "no", Details: []byte{1, 2}}
+
+	for _, frame := range [][]byte{CreateErrorClient(12, 34, status), CreateErrorSession(12, 34, status)} {
+		if frame[2]&ErrorStatus == 0 {
+			t.Errorf("got flag %b, want the status bit to be set", frame[2])
+		}
+
+		decoded, err := DecodeError(frame[2], frame[7:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, status) {
+			t.Errorf("got %+v, want %+v", decoded, status)
+		}
+	}
+
+	// truncated statuses are reported rather than being decoded as plain messages
+	frame := CreateErrorSession(12, 34, status)
+	if _, err := DecodeError(frame[2], frame[7:10]); err == nil {
+		t.Error("decoded truncated status")
+	}
+}
+
+func TestDecodeErrorWithoutStatus(t *testing.T) {
+	// servers that don't support statuses send a plain message, without the ErrorStatus bit
+	frame := MessageFrame{
+		EndpointId: 12,
+		Flag:       ErrorSessionID,
+		SessionId:  34,
+		Data:       []byte("something went wrong"),
+	}
+	encoded := frame.Encode()
+
+	status, err := DecodeError(encoded[2], encoded[7:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Code != StatusUnknown || status.Message != "something went wrong" {
+		t.Errorf("got %s, want Unknown: something went wrong", status)
+	}
+
+	status, err = DecodeError(ErrorClientID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Code != StatusUnknown || status.Message != "" {
+		t.Errorf("got %s, want Unknown with an empty message", status)
+	}
+}
+
+func TestStatusFromError(t *testing.T) {
+	status := NewStatus(StatusNotFound, "missing")
+	if got := StatusFromError(fmt.Errorf("wrapped: %w", status)); got != status {
+		t.Errorf("got %s, want the wrapped status", got)
+	}
+
+	got := StatusFromError(errors.New("plain"))
+	if got.Code != StatusUnknown || got.Message != "plain" {
+		t.Errorf("got %s, want Unknown: plain", got)
+	}
+}
+
+func TestStatusCodeString(t *testing.T) {
+	if name := StatusResourceExhausted.String(); name != "ResourceExhausted" {
+		t.Errorf("got %s, want ResourceExhausted", name)
+	}
+	if name := StatusCode(200).String(); name != "StatusCode(200)" {
+		t.Errorf("got %s, want StatusCode(200)", name)
+	}
+}
+
+func TestStatusDetails(t *testing.T) {
+	status := NewStatus(StatusInvalidArgument, "bad request")
+	if details, err := status.DecodeDetails(nil); details != nil || err != nil {
+		t.Errorf("got %v, %v for a status without details, want nil, nil", details, err)
+	}
+
+	status.Details = []byte{9, 9}
+	encoded := status.Encode()
+	if !bytes.Equal(encoded[len(encoded)-2:], []byte{9, 9}) {
+		t.Errorf("got %v, want the details at the end", encoded)
+	}
+}
@@ -0,0 +1,131 @@
+package hermodtest
+
+import (
+	"errors"
+	"github.com/palkerecsenyi/hermod/client"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/framing"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Receive opens the session (if it hasn't been opened yet) and waits for n units. The test fails if the session ends,
+// an error is received, or Timeout passes first.
+func Receive[In encoder.UserFacingHermodUnit, Out encoder.UserFacingHermodUnit](t testing.TB, rw *client.ServiceReadWriter[In, Out], n int) []Out {
+	t.Helper()
+
+	messages, errs, err := rw.Messages()
+	if err != nil {
+		t.Fatalf("opening session: %s", err)
+	}
+
+	timeout := time.After(Timeout)
+	units := make([]Out, 0, n)
+	for len(units) < n {
+		select {
+		case unit, ok := <-messages:
+			if !ok {
+				t.Fatalf("session closed after %d of %d units", len(units), n)
+			}
+			units = append(units, unit)
+		case err, ok := <-errs:
+			if !ok {
+				t.Fatalf("session closed after %d of %d units", len(units), n)
+			}
+			t.Fatalf("received error after %d of %d units: %s", len(units), n, err)
+		case <-timeout:
+			t.Fatalf("timed out after receiving %d of %d units", len(units), n)
+		}
+	}
+
+	return units
+}
+
+// ExpectUnits waits for the session to send the specified units, and fails the test if they're different.
+func ExpectUnits[In encoder.UserFacingHermodUnit, Out encoder.UserFacingHermodUnit](t testing.TB, rw *client.ServiceReadWriter[In, Out], want ...Out) {
+	t.Helper()
+
+	got := Receive(t, rw, len(want))
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("unit %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// ExpectError waits for the session to fail, and checks that the server sent a Status with the specified code. The
+// Status is returned so that its message and details can be checked too. Any units received first are ignored.
+func ExpectError[In encoder.UserFacingHermodUnit, Out encoder.UserFacingHermodUnit](t testing.TB, rw *client.ServiceReadWriter[In, Out], code framing.StatusCode) *framing.Status {
+	t.Helper()
+
+	messages, errs, err := rw.Messages()
+	if err != nil {
+		return AssertStatus(t, err, code)
+	}
+
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case _, ok := <-messages:
+			if !ok {
+				t.Fatalf("session closed without an error, want %s", code)
+			}
+		case err, ok := <-errs:
+			if !ok {
+				t.Fatalf("session closed without an error, want %s", code)
+			}
+			return AssertStatus(t, err, code)
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s error", code)
+		}
+	}
+}
+
+// ExpectClose waits for the server to close the session without an error, and returns its trailers. Any units
+// received first are ignored.
+func ExpectClose[In encoder.UserFacingHermodUnit, Out encoder.UserFacingHermodUnit](t testing.TB, rw *client.ServiceReadWriter[In, Out]) client.Metadata {
+	t.Helper()
+
+	messages, errs, err := rw.Messages()
+	if err != nil {
+		t.Fatalf("opening session: %s", err)
+	}
+
+	timeout := time.After(Timeout)
+	for {
+		select {
+		case _, ok := <-messages:
+			if !ok {
+				return rw.Trailer()
+			}
+		case err, ok := <-errs:
+			if !ok {
+				return rw.Trailer()
+			}
+			t.Fatalf("received error while waiting for session to close: %s", err)
+		case <-timeout:
+			t.Fatalf("timed out waiting for session to close")
+		}
+	}
+}
+
+// AssertStatus fails the test unless err is (or wraps) a Status with the specified code. It returns the Status.
+func AssertStatus(t testing.TB, err error, code framing.StatusCode) *framing.Status {
+	t.Helper()
+
+	if err == nil {
+		t.Fatalf("got no error, want %s", code)
+	}
+
+	var status *framing.Status
+	if !errors.As(err, &status) {
+		t.Fatalf("got error without a status (%s), want %s", err, code)
+	}
+
+	if status.Code != code {
+		t.Fatalf("got %s, want %s", status, code)
+	}
+
+	return status
+}
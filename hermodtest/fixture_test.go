@@ -0,0 +1,266 @@
+// GENERATED FILE — DO NOT EDIT
+package hermodtest_test
+
+import (
+	"context"
+	"github.com/palkerecsenyi/hermod/client"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/service"
+	"net/http"
+	"reflect"
+)
+
+// messageDefinition is used internally by Hermod to encode/decode data. Don't use this in your own code.
+var messageDefinition = encoder.Unit{
+	TransmissionId: 0,
+	Name:           "Message",
+	Fields: []encoder.Field{
+		{
+			Name:     "text",
+			FieldId:  0,
+			Extended: false,
+			Repeated: false,
+			Type:     reflect.ValueOf(*new(encoder.String)),
+		},
+	},
+}
+
+type Message struct {
+	Text encoder.String
+}
+
+func (d Message) GetDefinition() *encoder.Unit {
+	return &messageDefinition
+}
+func (d Message) Encode() (*[]byte, error) {
+	return encoder.UserEncode(d)
+}
+func (d Message) DecodeAbstract(data *[]byte) (encoder.UserFacingHermodUnit, error) {
+	return encoder.UserDecode(d, data)
+}
+func DecodeMessage(data *[]byte) (*Message, error) {
+	decodedData, err := encoder.UserDecode(Message{}, data)
+	if err != nil {
+		return nil, err
+	}
+	u := decodedData.(Message)
+	return &u, nil
+}
+func NewMessage() *Message {
+	s := Message{}
+	return &s
+}
+func RequestEcho(router *client.WebSocketRouter, options ...client.RequestOption) (*client.ServiceReadWriter[Message, Message], error) {
+	rw := client.ServiceReadWriter[Message, Message]{
+		Router:    router,
+		Endpoint:  0,
+		HasIn:     true,
+		OutSample: Message{},
+	}
+	err := rw.Init(options...)
+	return &rw, err
+}
+
+type Echo_Request struct {
+	Data     *Message
+	Context  context.Context
+	Headers  http.Header
+	Metadata service.Metadata
+	Auth     *service.AuthAPI
+}
+type Echo_Response struct {
+	sendFunction    func(data *[]byte)
+	errorFunction   func(err error)
+	trailerFunction func(key, value string)
+}
+
+func (res *Echo_Response) SetTrailer(key, value string) {
+	res.trailerFunction(key, value)
+}
+func (res *Echo_Response) Send(data *Message) {
+	encoded, err := data.Encode()
+	if err != nil {
+		res.errorFunction(service.Errorf(framing.StatusInternal, "couldn't encode data: %s", err))
+		return
+	}
+	res.sendFunction(encoded)
+}
+func RegisterEchoHandler(server *service.Server, handler func(req *Echo_Request, res *Echo_Response) error) {
+	endpointId := uint16(0)
+	server.RegisterEndpoint(endpointId, func(req *service.Request, res *service.Response) {
+		response := Echo_Response{
+			sendFunction:    res.Send,
+			errorFunction:   res.SendError,
+			trailerFunction: res.SetTrailer,
+		}
+		initialData, ok := <-req.Data
+		if !ok {
+			return
+		}
+		d, err := DecodeMessage(initialData)
+		if err != nil {
+			res.SendDecodeError(service.Errorf(framing.StatusInvalidArgument, "handler for endpoint with ID %d failed to decode incoming message: %s", endpointId, err.Error()))
+			return
+		}
+		request := Echo_Request{
+			Data:     d,
+			Context:  req.Context,
+			Headers:  req.Headers,
+			Metadata: req.Metadata,
+			Auth:     req.Auth,
+		}
+		err = handler(&request, &response)
+		if err != nil {
+			res.SendError(err)
+		}
+	}, service.Describe(service.Endpoint{
+		Service: &service.Service{Name: "Test"},
+		Path:    "/echo",
+		In: service.EndpointArgument{
+			Unit:     *Message{}.GetDefinition(),
+			Streamed: false,
+		},
+		Out: service.EndpointArgument{
+			Unit:     *Message{}.GetDefinition(),
+			Streamed: false,
+		},
+	}))
+}
+func RequestRepeat(router *client.WebSocketRouter, options ...client.RequestOption) (*client.ServiceReadWriter[Message, Message], error) {
+	rw := client.ServiceReadWriter[Message, Message]{
+		Router:    router,
+		Endpoint:  1,
+		HasIn:     true,
+		OutSample: Message{},
+	}
+	err := rw.Init(options...)
+	return &rw, err
+}
+
+type Repeat_Request struct {
+	Data     *Message
+	Context  context.Context
+	Headers  http.Header
+	Metadata service.Metadata
+	Auth     *service.AuthAPI
+}
+type Repeat_Response struct {
+	sendFunction    func(data *[]byte)
+	errorFunction   func(err error)
+	trailerFunction func(key, value string)
+}
+
+func (res *Repeat_Response) SetTrailer(key, value string) {
+	res.trailerFunction(key, value)
+}
+func (res *Repeat_Response) Send(data *Message) {
+	encoded, err := data.Encode()
+	if err != nil {
+		res.errorFunction(service.Errorf(framing.StatusInternal, "couldn't encode data: %s", err))
+		return
+	}
+	res.sendFunction(encoded)
+}
+func RegisterRepeatHandler(server *service.Server, handler func(req *Repeat_Request, res *Repeat_Response) error) {
+	endpointId := uint16(1)
+	server.RegisterEndpoint(endpointId, func(req *service.Request, res *service.Response) {
+		response := Repeat_Response{
+			sendFunction:    res.Send,
+			errorFunction:   res.SendError,
+			trailerFunction: res.SetTrailer,
+		}
+		initialData, ok := <-req.Data
+		if !ok {
+			return
+		}
+		d, err := DecodeMessage(initialData)
+		if err != nil {
+			res.SendDecodeError(service.Errorf(framing.StatusInvalidArgument, "handler for endpoint with ID %d failed to decode incoming message: %s", endpointId, err.Error()))
+			return
+		}
+		request := Repeat_Request{
+			Data:     d,
+			Context:  req.Context,
+			Headers:  req.Headers,
+			Metadata: req.Metadata,
+			Auth:     req.Auth,
+		}
+		err = handler(&request, &response)
+		if err != nil {
+			res.SendError(err)
+		}
+	}, service.Describe(service.Endpoint{
+		Service: &service.Service{Name: "Test"},
+		Path:    "/repeat",
+		In: service.EndpointArgument{
+			Unit:     *Message{}.GetDefinition(),
+			Streamed: false,
+		},
+		Out: service.EndpointArgument{
+			Unit:     *Message{}.GetDefinition(),
+			Streamed: true,
+		},
+	}))
+}
+func RequestCount(router *client.WebSocketRouter, options ...client.RequestOption) (*client.ServiceReadWriter[encoder.UserFacingHermodUnit, Message], error) {
+	rw := client.ServiceReadWriter[encoder.UserFacingHermodUnit, Message]{
+		Router:    router,
+		Endpoint:  2,
+		HasIn:     false,
+		OutSample: Message{},
+	}
+	err := rw.Init(options...)
+	return &rw, err
+}
+
+type Count_Request struct {
+	Context  context.Context
+	Headers  http.Header
+	Metadata service.Metadata
+	Auth     *service.AuthAPI
+}
+type Count_Response struct {
+	sendFunction    func(data *[]byte)
+	errorFunction   func(err error)
+	trailerFunction func(key, value string)
+}
+
+func (res *Count_Response) SetTrailer(key, value string) {
+	res.trailerFunction(key, value)
+}
+func (res *Count_Response) Send(data *Message) {
+	encoded, err := data.Encode()
+	if err != nil {
+		res.errorFunction(service.Errorf(framing.StatusInternal, "couldn't encode data: %s", err))
+		return
+	}
+	res.sendFunction(encoded)
+}
+func RegisterCountHandler(server *service.Server, handler func(req *Count_Request, res *Count_Response) error) {
+	endpointId := uint16(2)
+	server.RegisterEndpoint(endpointId, func(req *service.Request, res *service.Response) {
+		response := Count_Response{
+			sendFunction:    res.Send,
+			errorFunction:   res.SendError,
+			trailerFunction: res.SetTrailer,
+		}
+		request := Count_Request{
+			Context:  req.Context,
+			Headers:  req.Headers,
+			Metadata: req.Metadata,
+			Auth:     req.Auth,
+		}
+		err := handler(&request, &response)
+		if err != nil {
+			res.SendError(err)
+		}
+	}, service.Describe(service.Endpoint{
+		Service: &service.Service{Name: "Test"},
+		Path:    "/count",
+		Out: service.EndpointArgument{
+			Unit:     *Message{}.GetDefinition(),
+			Streamed: true,
+		},
+	}), service.Resumable())
+}
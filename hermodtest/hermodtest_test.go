@@ -0,0 +1,113 @@
+package hermodtest_test
+
+// fixture_test.go is generated from testdata/fixture.hermod.yaml, by running this from the repository's root and
+// renaming the output:
+//
+//	go run . --in hermodtest/testdata --out <dir> --package github.com/palkerecsenyi/hermod
+
+import (
+	"fmt"
+	"github.com/palkerecsenyi/hermod/client"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/hermodtest"
+	"github.com/palkerecsenyi/hermod/service"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *hermodtest.Server {
+	server := service.NewServer(nil)
+	RegisterEchoHandler(server, func(req *Echo_Request, res *Echo_Response) error {
+		if req.Data.Text == "" {
+			return service.Errorf(framing.StatusInvalidArgument, "text is required")
+		}
+
+		res.SetTrailer("echoed", "true")
+		res.Send(&Message{Text: req.Data.Text + encoder.String(req.Metadata.Get("suffix"))})
+		return nil
+	})
+	RegisterRepeatHandler(server, func(req *Repeat_Request, res *Repeat_Response) error {
+		for i := 0; i < 3; i++ {
+			res.Send(&Message{Text: encoder.String(fmt.Sprintf("%s %d", req.Data.Text, i))})
+		}
+		return nil
+	})
+
+	return hermodtest.NewServer(t, server)
+}
+
+// open opens the session and sends it a message.
+func open(t *testing.T, rw *client.ServiceReadWriter[Message, Message], message Message) {
+	t.Helper()
+
+	if _, _, err := rw.Messages(); err != nil {
+		t.Fatalf("opening session: %s", err)
+	}
+	if err := rw.Send(message); err != nil {
+		t.Fatalf("sending message: %s", err)
+	}
+}
+
+func TestUnary(t *testing.T) {
+	testServer := newTestServer(t)
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hello"})
+
+	hermodtest.ExpectUnits(t, rw, Message{Text: "hello"})
+	trailers := hermodtest.ExpectClose(t, rw)
+	if trailers.Get("echoed") != "true" {
+		t.Errorf("got trailers %v, want echoed=true", trailers)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	testServer := newTestServer(t)
+
+	rw, err := RequestRepeat(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hi"})
+
+	hermodtest.ExpectUnits(t, rw, Message{Text: "hi 0"}, Message{Text: "hi 1"}, Message{Text: "hi 2"})
+	hermodtest.ExpectClose(t, rw)
+}
+
+func TestExpectError(t *testing.T) {
+	testServer := newTestServer(t)
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{})
+
+	status := hermodtest.ExpectError(t, rw, framing.StatusInvalidArgument)
+	if status.Message != "text is required" {
+		t.Errorf("got message %q, want %q", status.Message, "text is required")
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	testServer := newTestServer(t)
+
+	rw, err := RequestEcho(testServer.Router, client.WithMetadata(client.Metadata{"suffix": "!"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hello"})
+
+	hermodtest.ExpectUnits(t, rw, Message{Text: "hello!"})
+}
+
+func TestAssertStatus(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", framing.NewStatus(framing.StatusNotFound, "missing"))
+	status := hermodtest.AssertStatus(t, err, framing.StatusNotFound)
+	if status.Message != "missing" {
+		t.Errorf("got message %q, want %q", status.Message, "missing")
+	}
+}
@@ -0,0 +1,307 @@
+package hermodtest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/palkerecsenyi/hermod/client"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/hermodtest"
+	"github.com/palkerecsenyi/hermod/service"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder records the order in which interceptors and handlers are called.
+type recorder struct {
+	mutex sync.Mutex
+	calls []string
+}
+
+func (r *recorder) record(call string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *recorder) expect(t *testing.T, want ...string) {
+	t.Helper()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !reflect.DeepEqual(r.calls, want) {
+		t.Errorf("got calls %v, want %v", r.calls, want)
+	}
+}
+
+func recordingUnaryInterceptor(r *recorder, name string) service.UnaryInterceptor {
+	return func(ctx context.Context, info *service.SessionInfo, in []byte, next service.UnaryHandler) ([]byte, error) {
+		r.record(name + " before")
+		out, err := next(ctx, in)
+		r.record(name + " after")
+		return out, err
+	}
+}
+
+// countingStream counts the units sent through it.
+type countingStream struct {
+	service.ServerStream
+	sent *int
+}
+
+func (stream countingStream) Send(unit []byte) error {
+	*stream.sent += 1
+	return stream.ServerStream.Send(unit)
+}
+
+func TestUnaryInterceptorOrder(t *testing.T) {
+	calls := &recorder{}
+	server := service.NewServer(&service.HermodConfig{
+		UnaryInterceptors: []service.UnaryInterceptor{
+			recordingUnaryInterceptor(calls, "first"),
+			recordingUnaryInterceptor(calls, "second"),
+		},
+	})
+	RegisterEchoHandler(server, func(req *Echo_Request, res *Echo_Response) error {
+		calls.record("handler")
+		res.Send(req.Data)
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hello"})
+	hermodtest.ExpectUnits(t, rw, Message{Text: "hello"})
+	hermodtest.ExpectClose(t, rw)
+
+	// the first interceptor is the outermost one
+	calls.expect(t, "first before", "second before", "handler", "second after", "first after")
+}
+
+func TestUnaryInterceptorRejectsSession(t *testing.T) {
+	calls := &recorder{}
+	server := service.NewServer(&service.HermodConfig{
+		UnaryInterceptors: []service.UnaryInterceptor{
+			func(ctx context.Context, info *service.SessionInfo, in []byte, next service.UnaryHandler) ([]byte, error) {
+				calls.record("interceptor")
+				return nil, service.NewStatus(framing.StatusPermissionDenied, "not today")
+			},
+			recordingUnaryInterceptor(calls, "second"),
+		},
+	})
+	RegisterEchoHandler(server, func(req *Echo_Request, res *Echo_Response) error {
+		calls.record("handler")
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hello"})
+	status := hermodtest.ExpectError(t, rw, framing.StatusPermissionDenied)
+	if status.Message != "not today" {
+		t.Errorf("got message %q, want %q", status.Message, "not today")
+	}
+
+	// interceptors after the one that rejected the session aren't called, and neither is the handler
+	calls.expect(t, "interceptor")
+}
+
+func TestUnaryInterceptorReplacesError(t *testing.T) {
+	server := service.NewServer(&service.HermodConfig{
+		UnaryInterceptors: []service.UnaryInterceptor{
+			func(ctx context.Context, info *service.SessionInfo, in []byte, next service.UnaryHandler) ([]byte, error) {
+				out, err := next(ctx, in)
+
+				// errors returned by the handler (which generated code sends with SendError) reach interceptors before
+				// the client
+				var status *service.Status
+				if errors.As(err, &status) && status.Code == framing.StatusNotFound {
+					return nil, service.Errorf(framing.StatusUnavailable, "replaced %q", status.Message)
+				}
+				return out, err
+			},
+		},
+	})
+	RegisterEchoHandler(server, func(req *Echo_Request, res *Echo_Response) error {
+		return service.NewStatus(framing.StatusNotFound, "missing")
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hello"})
+	status := hermodtest.ExpectError(t, rw, framing.StatusUnavailable)
+	if status.Message != `replaced "missing"` {
+		t.Errorf("got message %q", status.Message)
+	}
+}
+
+func TestStreamInterceptorOrder(t *testing.T) {
+	calls := &recorder{}
+	sent := 0
+	interceptor := func(name string) service.StreamInterceptor {
+		return func(info *service.SessionInfo, stream service.ServerStream, next service.StreamHandler) error {
+			calls.record(name + " before")
+			err := next(stream)
+			calls.record(name + " after")
+			return err
+		}
+	}
+
+	server := service.NewServer(&service.HermodConfig{
+		StreamInterceptors: []service.StreamInterceptor{
+			interceptor("first"),
+			func(info *service.SessionInfo, stream service.ServerStream, next service.StreamHandler) error {
+				// interceptors can wrap the stream that's passed to the handler
+				return next(countingStream{stream, &sent})
+			},
+			interceptor("second"),
+		},
+	})
+	RegisterRepeatHandler(server, func(req *Repeat_Request, res *Repeat_Response) error {
+		calls.record("handler")
+		for i := 0; i < 3; i++ {
+			res.Send(req.Data)
+		}
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	rw, err := RequestRepeat(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hi"})
+	hermodtest.ExpectUnits(t, rw, Message{Text: "hi"}, Message{Text: "hi"}, Message{Text: "hi"})
+	hermodtest.ExpectClose(t, rw)
+
+	calls.expect(t, "first before", "second before", "handler", "second after", "first after")
+	if sent != 3 {
+		t.Errorf("wrapped stream sent %d units, want 3", sent)
+	}
+}
+
+func recordingClientInterceptor(r *recorder, name string) client.Interceptor {
+	return client.Interceptor{
+		Open: func(call *client.CallInfo) error {
+			r.record(name + " open")
+			return nil
+		},
+		Send: func(call *client.CallInfo, unit encoder.UserFacingHermodUnit) error {
+			r.record(name + " send " + string(unit.(Message).Text))
+			return nil
+		},
+		Receive: func(call *client.CallInfo, unit encoder.UserFacingHermodUnit) {
+			r.record(name + " receive " + string(unit.(Message).Text))
+		},
+		Close: func(call *client.CallInfo, err error) {
+			r.record(fmt.Sprintf("%s close %v", name, err))
+		},
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	testServer := newTestServer(t)
+
+	calls := &recorder{}
+	testServer.Router.Interceptors = []client.Interceptor{
+		recordingClientInterceptor(calls, "first"),
+		{
+			// open interceptors can change the session's metadata
+			Open: func(call *client.CallInfo) error {
+				call.Metadata.Set("suffix", "!")
+				return nil
+			},
+		},
+		recordingClientInterceptor(calls, "second"),
+	}
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hello"})
+	hermodtest.ExpectUnits(t, rw, Message{Text: "hello!"})
+	hermodtest.ExpectClose(t, rw)
+
+	calls.expect(t,
+		"first open", "second open",
+		"first send hello", "second send hello",
+		"first receive hello!", "second receive hello!",
+		"first close <nil>", "second close <nil>",
+	)
+}
+
+func TestClientInterceptorRejectsSession(t *testing.T) {
+	handled := make(chan struct{}, 1)
+	server := service.NewServer(nil)
+	RegisterEchoHandler(server, func(req *Echo_Request, res *Echo_Response) error {
+		handled <- struct{}{}
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	rejection := errors.New("not allowed")
+	testServer.Router.Interceptors = []client.Interceptor{{
+		Open: func(call *client.CallInfo) error {
+			return rejection
+		},
+	}}
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = rw.Messages(); !errors.Is(err, rejection) {
+		t.Fatalf("got %v, want the interceptor's error", err)
+	}
+
+	// the session request was never sent, so the handler doesn't run
+	select {
+	case <-handled:
+		t.Error("handler ran for a session rejected by an interceptor")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientSendInterceptorRejectsUnit(t *testing.T) {
+	testServer := newTestServer(t)
+
+	rejection := errors.New("too long")
+	testServer.Router.Interceptors = []client.Interceptor{{
+		Send: func(call *client.CallInfo, unit encoder.UserFacingHermodUnit) error {
+			if len(unit.(Message).Text) > 5 {
+				return rejection
+			}
+			return nil
+		},
+	}}
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = rw.Messages(); err != nil {
+		t.Fatal(err)
+	}
+	if err = rw.Send(Message{Text: "too long"}); !errors.Is(err, rejection) {
+		t.Fatalf("got %v, want the interceptor's error", err)
+	}
+
+	// the session can carry on with units the interceptor allows
+	if err = rw.Send(Message{Text: "short"}); err != nil {
+		t.Fatal(err)
+	}
+	hermodtest.ExpectUnits(t, rw, Message{Text: "short"})
+}
@@ -0,0 +1,71 @@
+package hermodtest_test
+
+import (
+	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/hermodtest"
+	"github.com/palkerecsenyi/hermod/service"
+	"strings"
+	"testing"
+)
+
+func TestMaxConcurrentHandlers(t *testing.T) {
+	release := make(chan struct{})
+	server := service.NewServer(&service.HermodConfig{
+		MaxConcurrentHandlers: 1,
+	})
+	RegisterCountHandler(server, func(req *Count_Request, res *Count_Response) error {
+		count(res, 0, 1)
+		<-release
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	running, err := RequestCount(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hermodtest.ExpectUnits(t, running, counted(0, 1)...)
+
+	refused, err := RequestCount(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := hermodtest.ExpectError(t, refused, framing.StatusResourceExhausted)
+	if status.Message != "too many concurrent sessions" {
+		t.Errorf("got message %q", status.Message)
+	}
+
+	// the running session isn't affected
+	close(release)
+	hermodtest.ExpectClose(t, running)
+}
+
+func TestMaxBytesInFlight(t *testing.T) {
+	server := service.NewServer(&service.HermodConfig{
+		MaxBytesInFlight: 64,
+	})
+	RegisterEchoHandler(server, func(req *Echo_Request, res *Echo_Response) error {
+		res.Send(req.Data)
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "short"})
+	hermodtest.ExpectUnits(t, rw, Message{Text: "short"})
+
+	// a message that's larger than the limit by itself can never be delivered
+	rw, err = RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: encoder.String(strings.Repeat("a", 100))})
+	status := hermodtest.ExpectError(t, rw, framing.StatusResourceExhausted)
+	if status.Message != "too many bytes in flight" {
+		t.Errorf("got message %q", status.Message)
+	}
+}
@@ -0,0 +1,107 @@
+// Package hermodtest makes it easy to test Hermod endpoint handlers without any sockets. NewServer connects a Hermod
+// server to a client.WebSocketRouter over an in-memory pipe, so generated Request<Endpoint> functions can be called
+// against locally registered handlers:
+//
+//	func TestGetUser(t *testing.T) {
+//		server := service.NewServer(nil)
+//		example.RegisterGetUserHandler(server, getUser)
+//		testServer := hermodtest.NewServer(t, server)
+//
+//		rw, err := example.RequestGetUser(testServer.Router)
+//		...
+//		hermodtest.ExpectUnits(t, rw, example.User{DisplayName: "Alice"})
+//	}
+//
+// The package also provides helpers for asserting the units and errors received in a session.
+package hermodtest
+
+import (
+	"context"
+	"github.com/palkerecsenyi/hermod/client"
+	"github.com/palkerecsenyi/hermod/service"
+	"github.com/palkerecsenyi/hermod/transport"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Timeout is how long helpers wait for something to happen before failing the test.
+var Timeout = 5 * time.Second
+
+// Server serves a service.Server to Router over in-memory pipes.
+type Server struct {
+	Router *client.WebSocketRouter
+	Server *service.Server
+
+	context context.Context
+	cancel  context.CancelFunc
+
+	connectionsMutex sync.Mutex
+	connections      []transport.Conn
+}
+
+// NewServer serves server (or service.DefaultServer if it's nil) and connects Router to it. The router is closed and
+// its connections stop being served automatically when the test finishes. The router reconnects automatically if
+// DropConnection is called.
+func NewServer(t testing.TB, server *service.Server) *Server {
+	t.Helper()
+
+	if server == nil {
+		server = service.DefaultServer
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	testServer := &Server{
+		Server:  server,
+		context: ctx,
+		cancel:  cancel,
+	}
+
+	testServer.Router = &client.WebSocketRouter{
+		Timeout: Timeout,
+		Dial:    testServer.dial,
+		Reconnect: &client.ReconnectPolicy{
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     100 * time.Millisecond,
+		},
+	}
+
+	err := testServer.Router.Connect()
+	if err != nil {
+		cancel()
+		t.Fatalf("connecting to test server: %s", err)
+	}
+
+	t.Cleanup(testServer.Close)
+	return testServer
+}
+
+// dial creates a new pipe, and serves one end of it.
+func (server *Server) dial(context.Context) (transport.Conn, error) {
+	serverConn, clientConn := transport.Pipe()
+
+	server.connectionsMutex.Lock()
+	server.connections = append(server.connections, serverConn)
+	server.connectionsMutex.Unlock()
+
+	go server.Server.ServeConn(server.context, serverConn)
+	return clientConn, nil
+}
+
+// DropConnection closes every connection between the server and Router, as if the network had failed. Router then
+// reconnects, which is useful for testing resumable endpoints.
+func (server *Server) DropConnection() {
+	server.connectionsMutex.Lock()
+	defer server.connectionsMutex.Unlock()
+
+	for _, conn := range server.connections {
+		_ = conn.Close()
+	}
+	server.connections = nil
+}
+
+// Close closes Router and stops the server.
+func (server *Server) Close() {
+	_ = server.Router.Close()
+	server.cancel()
+}
@@ -0,0 +1,59 @@
+package hermodtest_test
+
+import (
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/hermodtest"
+	"github.com/palkerecsenyi/hermod/service"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestPanickingHandler(t *testing.T) {
+	release := make(chan struct{})
+	server := service.NewServer(&service.HermodConfig{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	RegisterEchoHandler(server, func(req *Echo_Request, res *Echo_Response) error {
+		if req.Data.Text == "panic" {
+			panic("handler failed")
+		}
+		res.Send(req.Data)
+		return nil
+	})
+	RegisterCountHandler(server, func(req *Count_Request, res *Count_Response) error {
+		count(res, 0, 1)
+		<-release
+		count(res, 1, 2)
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	counter, err := RequestCount(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hermodtest.ExpectUnits(t, counter, counted(0, 1)...)
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "panic"})
+	status := hermodtest.ExpectError(t, rw, framing.StatusInternal)
+	if status.Message != "internal error" {
+		t.Errorf("got message %q, want the panic to be hidden from the client", status.Message)
+	}
+
+	// the panic only ends its own session, so sessions that were already open carry on, and new ones can be opened
+	close(release)
+	hermodtest.ExpectUnits(t, counter, counted(1, 2)...)
+	hermodtest.ExpectClose(t, counter)
+
+	rw, err = RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hello"})
+	hermodtest.ExpectUnits(t, rw, Message{Text: "hello"})
+}
@@ -0,0 +1,59 @@
+package hermodtest_test
+
+import (
+	"github.com/palkerecsenyi/hermod/client"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/hermodtest"
+	"github.com/palkerecsenyi/hermod/service"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	server := service.NewServer(&service.HermodConfig{
+		RateLimits: map[uint16]*service.RateLimit{
+			// Echo
+			0: {Rate: 5, Burst: 2},
+		},
+	})
+	RegisterEchoHandler(server, func(req *Echo_Request, res *Echo_Response) error {
+		res.Send(req.Data)
+		return nil
+	})
+	RegisterRepeatHandler(server, func(req *Repeat_Request, res *Repeat_Response) error {
+		res.Send(req.Data)
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	echo := func() *client.ServiceReadWriter[Message, Message] {
+		rw, err := RequestEcho(testServer.Router)
+		if err != nil {
+			t.Fatal(err)
+		}
+		open(t, rw, Message{Text: "hello"})
+		return rw
+	}
+
+	// up to Burst sessions can be opened at once
+	for i := 0; i < 2; i++ {
+		hermodtest.ExpectUnits(t, echo(), Message{Text: "hello"})
+	}
+	status := hermodtest.ExpectError(t, echo(), framing.StatusResourceExhausted)
+	if status.Message != "rate limit exceeded" {
+		t.Errorf("got message %q", status.Message)
+	}
+
+	// endpoints without a limit aren't affected
+	rw, err := RequestRepeat(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hi"})
+	hermodtest.ExpectUnits(t, rw, Message{Text: "hi"})
+
+	// after that, a session can be opened every 1/Rate seconds
+	time.Sleep(250 * time.Millisecond)
+	hermodtest.ExpectUnits(t, echo(), Message{Text: "hello"})
+	hermodtest.ExpectError(t, echo(), framing.StatusResourceExhausted)
+}
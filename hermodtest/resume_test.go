@@ -0,0 +1,184 @@
+package hermodtest_test
+
+import (
+	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/hermodtest"
+	"github.com/palkerecsenyi/hermod/metrics"
+	"github.com/palkerecsenyi/hermod/service"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newResumeServer serves the resumable Count endpoint using handler. The router waits a while before reconnecting, so
+// that tests can do things while the session is detached.
+func newResumeServer(t *testing.T, config *service.HermodConfig, handler func(req *Count_Request, res *Count_Response) error) (*hermodtest.Server, *metrics.Memory) {
+	recorder := metrics.NewMemory()
+	config.Metrics = recorder
+
+	server := service.NewServer(config)
+	RegisterCountHandler(server, handler)
+
+	testServer := hermodtest.NewServer(t, server)
+	testServer.Router.Reconnect.InitialBackoff = 200 * time.Millisecond
+	return testServer, recorder
+}
+
+func count(res *Count_Response, from, to int) {
+	for i := from; i < to; i++ {
+		res.Send(&Message{Text: encoder.String(strconv.Itoa(i))})
+	}
+}
+
+func counted(from, to int) []Message {
+	var messages []Message
+	for i := from; i < to; i++ {
+		messages = append(messages, Message{Text: encoder.String(strconv.Itoa(i))})
+	}
+	return messages
+}
+
+// waitForDetach waits until the server has noticed that the connection was dropped, and detached its sessions.
+func waitForDetach(t *testing.T, recorder *metrics.Memory) {
+	t.Helper()
+
+	deadline := time.Now().Add(hermodtest.Timeout)
+	for recorder.ActiveConnections() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the server to notice the dropped connection")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestResumeAfterDroppedConnection(t *testing.T) {
+	release := make(chan struct{})
+	testServer, recorder := newResumeServer(t, &service.HermodConfig{
+		ResumeGracePeriod: hermodtest.Timeout,
+	}, func(req *Count_Request, res *Count_Response) error {
+		count(res, 0, 5)
+
+		select {
+		case <-release:
+		case <-req.Context.Done():
+			return req.Context.Err()
+		}
+
+		// these are sent while the session is detached, and so is the session's Close frame
+		count(res, 5, 8)
+		return nil
+	})
+
+	rw, err := RequestCount(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 3 and 4 may or may not have reached the client before the connection was dropped, but either way they're received
+	// exactly once
+	hermodtest.ExpectUnits(t, rw, counted(0, 3)...)
+	testServer.DropConnection()
+	waitForDetach(t, recorder)
+	close(release)
+
+	messages, errs, err := rw.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []Message
+	timeout := time.After(hermodtest.Timeout)
+	for messages != nil {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				messages = nil
+				continue
+			}
+			got = append(got, message)
+		case err, ok := <-errs:
+			if ok {
+				t.Fatalf("received error after %d units: %s", len(got), err)
+			}
+		case <-timeout:
+			t.Fatalf("timed out after receiving %v", got)
+		}
+	}
+
+	if want := counted(3, 8); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestResumeAfterGracePeriod(t *testing.T) {
+	handlerDone := make(chan struct{})
+	testServer, recorder := newResumeServer(t, &service.HermodConfig{
+		ResumeGracePeriod: 10 * time.Millisecond,
+	}, func(req *Count_Request, res *Count_Response) error {
+		defer close(handlerDone)
+
+		count(res, 0, 1)
+		<-req.Context.Done()
+		return nil
+	})
+
+	rw, err := RequestCount(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hermodtest.ExpectUnits(t, rw, counted(0, 1)...)
+
+	testServer.DropConnection()
+	waitForDetach(t, recorder)
+
+	// the session is ended once the grace period has passed
+	select {
+	case <-handlerDone:
+	case <-time.After(hermodtest.Timeout):
+		t.Fatal("handler wasn't cancelled after the grace period")
+	}
+
+	// so the client's attempt to resume it is refused with an ErrorClientID
+	status := hermodtest.ExpectError(t, rw, framing.StatusNotFound)
+	if status.Message != "session can't be resumed" {
+		t.Errorf("got message %q, want %q", status.Message, "session can't be resumed")
+	}
+}
+
+func TestResumeAfterMissingTooManyMessages(t *testing.T) {
+	release := make(chan struct{})
+	testServer, recorder := newResumeServer(t, &service.HermodConfig{
+		ResumeGracePeriod: hermodtest.Timeout,
+		ResumeBufferSize:  2,
+	}, func(req *Count_Request, res *Count_Response) error {
+		count(res, 0, 1)
+
+		select {
+		case <-release:
+		case <-req.Context.Done():
+			return req.Context.Err()
+		}
+
+		// only the last 2 of these are kept
+		count(res, 1, 4)
+		<-req.Context.Done()
+		return nil
+	})
+
+	rw, err := RequestCount(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hermodtest.ExpectUnits(t, rw, counted(0, 1)...)
+
+	testServer.DropConnection()
+	waitForDetach(t, recorder)
+	close(release)
+
+	status := hermodtest.ExpectError(t, rw, framing.StatusDataLoss)
+	if status.Message != "3 messages were missed but only 2 were kept" {
+		t.Errorf("got message %q", status.Message)
+	}
+}
@@ -0,0 +1,112 @@
+package hermodtest_test
+
+import (
+	"context"
+	"github.com/palkerecsenyi/hermod/client"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/hermodtest"
+	"github.com/palkerecsenyi/hermod/service"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	server := service.NewServer(nil)
+	RegisterEchoHandler(server, func(req *Echo_Request, res *Echo_Response) error {
+		res.Send(req.Data)
+		return nil
+	})
+	RegisterCountHandler(server, func(req *Count_Request, res *Count_Response) error {
+		count(res, 0, 1)
+		<-release
+		count(res, 1, 2)
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	counter, err := RequestCount(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hermodtest.ExpectUnits(t, counter, counted(0, 1)...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hermodtest.Timeout)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	// the server sends a GoAway message, after which the client doesn't open any more sessions on the connection
+	deadline := time.Now().Add(hermodtest.Timeout)
+	for testServer.Router.State() != client.StateGoingAway {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for GoAway")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rw, err := RequestEcho(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hermodtest.ExpectError(t, rw, framing.StatusUnavailable)
+
+	// sessions that were already open carry on until they finish, and then the server shuts down
+	select {
+	case err := <-shutdown:
+		t.Fatalf("server shut down with a session still open: %v", err)
+	default:
+	}
+
+	close(release)
+	hermodtest.ExpectUnits(t, counter, counted(1, 2)...)
+	hermodtest.ExpectClose(t, counter)
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("shutting down: %s", err)
+		}
+	case <-time.After(hermodtest.Timeout):
+		t.Fatal("timed out waiting for the server to shut down")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server := service.NewServer(nil)
+	RegisterRepeatHandler(server, func(req *Repeat_Request, res *Repeat_Response) error {
+		res.Send(req.Data)
+		<-req.Context.Done()
+		return nil
+	})
+	testServer := hermodtest.NewServer(t, server)
+
+	rw, err := RequestRepeat(testServer.Router)
+	if err != nil {
+		t.Fatal(err)
+	}
+	open(t, rw, Message{Text: "hi"})
+	hermodtest.ExpectUnits(t, rw, Message{Text: "hi"})
+
+	// sessions that don't finish in time are ended when the server is forcefully closed
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	_, errs, err := rw.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if !client.IsRetriable(err) {
+			t.Errorf("got %v, want a retriable error", err)
+		}
+	case <-time.After(hermodtest.Timeout):
+		t.Fatal("session wasn't ended")
+	}
+}
@@ -12,7 +12,8 @@ package main
 import (
 	"flag"
 	"github.com/palkerecsenyi/hermod/compiler"
-	"log"
+	"log/slog"
+	"os"
 )
 
 func main() {
@@ -24,11 +25,17 @@ func main() {
 	flag.Parse()
 
 	if *inputPath == "" {
-		log.Fatalln("--in must be specified")
+		slog.Error("--in must be specified")
+		os.Exit(2)
 	}
 	if *outputPath == "" {
-		log.Fatalln("--out must be specified")
+		slog.Error("--out must be specified")
+		os.Exit(2)
 	}
 
-	compiler.CompileFiles(*inputPath, *outputPath, *packageName, *acronyms)
+	err := compiler.CompileFiles(*inputPath, *outputPath, *packageName, *acronyms)
+	if err != nil {
+		slog.Error("compilation failed", "error", err)
+		os.Exit(1)
+	}
 }
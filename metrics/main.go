@@ -0,0 +1,74 @@
+// Package metrics defines the metrics recorded by Hermod servers and clients. Set HermodConfig.Metrics (on the server)
+// or WebSocketRouter.Metrics (on the client) to a Recorder to receive them. Recorder is a small interface that can be
+// adapted to a metrics library like Prometheus, where each method corresponds to a gauge, counter or histogram. Memory
+// is an in-memory implementation, useful for tests.
+package metrics
+
+import (
+	"time"
+)
+
+// ErrorKind describes the cause of an error.
+type ErrorKind int
+
+const (
+	// ErrorDecode means that a message couldn't be decoded.
+	ErrorDecode ErrorKind = iota
+	// ErrorAuth means that a client couldn't be authenticated, or wasn't allowed to use an endpoint.
+	ErrorAuth
+	// ErrorHandler means that a session ended with an error from its handler (on the client, this is any error that
+	// ended a session and doesn't fit one of the other kinds).
+	ErrorHandler
+	// ErrorEndpointNotFound means that a client tried to use an endpoint that doesn't exist.
+	ErrorEndpointNotFound
+	// ErrorLimit means that a connection or session was refused because a limit (e.g. a rate limit) was reached.
+	ErrorLimit
+)
+
+func (kind ErrorKind) String() string {
+	switch kind {
+	case ErrorDecode:
+		return "decode"
+	case ErrorAuth:
+		return "auth"
+	case ErrorHandler:
+		return "handler"
+	case ErrorEndpointNotFound:
+		return "endpoint_not_found"
+	case ErrorLimit:
+		return "limit"
+	}
+	return "unknown"
+}
+
+// Recorder receives metrics from a server or client. Directions are relative to the side doing the recording, so a
+// message sent by a client is recorded with MessageSent by the client and MessageReceived by the server. Methods are
+// called concurrently and shouldn't block.
+type Recorder interface {
+	// ConnectionOpened and ConnectionClosed are called when a connection opens and closes, for tracking the number of
+	// active connections.
+	ConnectionOpened()
+	ConnectionClosed()
+	// SessionOpened is called when a session of an endpoint is opened. SessionClosed is called once it has ended, with
+	// the time since it was opened (on the server, this is how long the handler ran for).
+	SessionOpened(endpoint uint16)
+	SessionClosed(endpoint uint16, duration time.Duration)
+	// MessageReceived and MessageSent are called for every Data message in a session, with the size of its unit.
+	MessageReceived(endpoint uint16, bytes int)
+	MessageSent(endpoint uint16, bytes int)
+	// Error is called whenever an error occurs. endpoint is 0 if the error isn't specific to an endpoint.
+	Error(kind ErrorKind, endpoint uint16)
+}
+
+type discard struct{}
+
+func (discard) ConnectionOpened()                   {}
+func (discard) ConnectionClosed()                   {}
+func (discard) SessionOpened(uint16)                {}
+func (discard) SessionClosed(uint16, time.Duration) {}
+func (discard) MessageReceived(uint16, int)         {}
+func (discard) MessageSent(uint16, int)             {}
+func (discard) Error(ErrorKind, uint16)             {}
+
+// Discard is a Recorder that ignores every metric. It's used when no Recorder has been set.
+var Discard Recorder = discard{}
@@ -0,0 +1,128 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Memory is a Recorder that keeps every metric in memory, so that they can be checked in tests. Create one with
+// NewMemory.
+type Memory struct {
+	sync.Mutex
+	connections      int
+	sessions         int
+	sessionsOpened   map[uint16]int
+	latencies        map[uint16][]time.Duration
+	messagesReceived map[uint16]int
+	messagesSent     map[uint16]int
+	bytesReceived    map[uint16]int
+	bytesSent        map[uint16]int
+	errors           map[ErrorKind]int
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		sessionsOpened:   map[uint16]int{},
+		latencies:        map[uint16][]time.Duration{},
+		messagesReceived: map[uint16]int{},
+		messagesSent:     map[uint16]int{},
+		bytesReceived:    map[uint16]int{},
+		bytesSent:        map[uint16]int{},
+		errors:           map[ErrorKind]int{},
+	}
+}
+
+func (m *Memory) ConnectionOpened() {
+	m.Lock()
+	defer m.Unlock()
+	m.connections += 1
+}
+
+func (m *Memory) ConnectionClosed() {
+	m.Lock()
+	defer m.Unlock()
+	m.connections -= 1
+}
+
+func (m *Memory) SessionOpened(endpoint uint16) {
+	m.Lock()
+	defer m.Unlock()
+	m.sessions += 1
+	m.sessionsOpened[endpoint] += 1
+}
+
+func (m *Memory) SessionClosed(endpoint uint16, duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.sessions -= 1
+	m.latencies[endpoint] = append(m.latencies[endpoint], duration)
+}
+
+func (m *Memory) MessageReceived(endpoint uint16, bytes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.messagesReceived[endpoint] += 1
+	m.bytesReceived[endpoint] += bytes
+}
+
+func (m *Memory) MessageSent(endpoint uint16, bytes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.messagesSent[endpoint] += 1
+	m.bytesSent[endpoint] += bytes
+}
+
+func (m *Memory) Error(kind ErrorKind, _ uint16) {
+	m.Lock()
+	defer m.Unlock()
+	m.errors[kind] += 1
+}
+
+// ActiveConnections returns the number of connections that are currently open.
+func (m *Memory) ActiveConnections() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.connections
+}
+
+// ActiveSessions returns the number of sessions that are currently open, across all endpoints.
+func (m *Memory) ActiveSessions() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.sessions
+}
+
+// SessionsOpened returns the number of sessions of an endpoint that have been opened.
+func (m *Memory) SessionsOpened(endpoint uint16) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.sessionsOpened[endpoint]
+}
+
+// Latencies returns the duration of every session of an endpoint that has ended, in the order they ended.
+func (m *Memory) Latencies(endpoint uint16) []time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	return append([]time.Duration{}, m.latencies[endpoint]...)
+}
+
+// Messages returns the number of messages received and sent in sessions of an endpoint.
+func (m *Memory) Messages(endpoint uint16) (received, sent int) {
+	m.Lock()
+	defer m.Unlock()
+	return m.messagesReceived[endpoint], m.messagesSent[endpoint]
+}
+
+// Bytes returns the total size of the messages received and sent in sessions of an endpoint.
+func (m *Memory) Bytes(endpoint uint16) (received, sent int) {
+	m.Lock()
+	defer m.Unlock()
+	return m.bytesReceived[endpoint], m.bytesSent[endpoint]
+}
+
+// Errors returns the number of errors of a kind that have occurred.
+func (m *Memory) Errors(kind ErrorKind) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.errors[kind]
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory()
+
+	m.ConnectionOpened()
+	m.SessionOpened(1)
+	m.SessionOpened(2)
+	m.MessageReceived(1, 10)
+	m.MessageSent(1, 4)
+	m.MessageSent(1, 6)
+	m.Error(ErrorDecode, 1)
+
+	if got := m.ActiveConnections(); got != 1 {
+		t.Errorf("got %d active connections, want 1", got)
+	}
+	if got := m.ActiveSessions(); got != 2 {
+		t.Errorf("got %d active sessions, want 2", got)
+	}
+	if received, sent := m.Messages(1); received != 1 || sent != 2 {
+		t.Errorf("got %d received and %d sent messages, want 1 and 2", received, sent)
+	}
+	if received, sent := m.Bytes(1); received != 10 || sent != 10 {
+		t.Errorf("got %d received and %d sent bytes, want 10 and 10", received, sent)
+	}
+	if got := m.Errors(ErrorDecode); got != 1 {
+		t.Errorf("got %d decode errors, want 1", got)
+	}
+	if got := m.Errors(ErrorHandler); got != 0 {
+		t.Errorf("got %d handler errors, want 0", got)
+	}
+
+	m.SessionClosed(1, time.Second)
+	m.ConnectionClosed()
+
+	if got := m.ActiveSessions(); got != 1 {
+		t.Errorf("got %d active sessions, want 1", got)
+	}
+	if got := m.ActiveConnections(); got != 0 {
+		t.Errorf("got %d active connections, want 0", got)
+	}
+	if got := m.SessionsOpened(1); got != 1 {
+		t.Errorf("got %d sessions opened, want 1", got)
+	}
+
+	latencies := m.Latencies(1)
+	if len(latencies) != 1 || latencies[0] != time.Second {
+		t.Errorf("got latencies %v, want [1s]", latencies)
+	}
+	// the returned slice is a copy
+	latencies[0] = 0
+	if m.Latencies(1)[0] != time.Second {
+		t.Error("modifying the returned latencies changed the recorded ones")
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	// Discard must be usable without any setup
+	Discard.ConnectionOpened()
+	Discard.SessionClosed(0, time.Second)
+	Discard.Error(ErrorLimit, 0)
+}
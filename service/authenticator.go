@@ -0,0 +1,265 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/palkerecsenyi/hermod/framing"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrNoCredentials is returned by an Authenticator if the client didn't send any credentials it recognises. When a
+// connection is opened, this leaves the client unauthenticated rather than refusing the connection.
+var ErrNoCredentials = errors.New("no credentials were sent")
+
+// Identity describes an authenticated client.
+type Identity struct {
+	// Subject identifies the client (e.g. a user ID). See AuthAPI.Subject.
+	Subject string
+	// Scopes and Roles are checked against endpoints' AuthPolicy.
+	Scopes []string
+	Roles  []string
+	// Expiry is when the client's credentials stop being valid, or the zero time if they don't expire. Sessions using
+	// them are ended with a StatusUnauthenticated error once they expire, unless the client sends new ones.
+	Expiry time.Time
+	// Claims holds any other details about the client, such as the claims of a JWT.
+	Claims map[string]any
+	// Value can be set to anything the handler needs (e.g. a user loaded from a database). It's returned by
+	// AuthAPI.GetHydratedToken.
+	Value any
+}
+
+// Authenticator verifies a client's credentials. token is the raw token sent by the client, either in the connection
+// URL's `token` query parameter, in an Authentication message, or with a session request, and may be empty. r is the
+// HTTP request that was upgraded to the connection, which is nil if the connection wasn't made over HTTP (see
+// Server.ServeConn). If the credentials are missing, ErrNoCredentials should be returned; any other error refuses
+// them.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token []byte, r *http.Request) (*Identity, error)
+}
+
+// APIKeyAuthenticator authenticates clients using static API keys, sent as the token.
+type APIKeyAuthenticator struct {
+	// Keys maps each API key to the identity of the client it belongs to.
+	Keys map[string]Identity
+	// Header is optional. If it's set, clients connecting over HTTP without a token can send their key in this header
+	// instead (e.g. "X-API-Key").
+	Header string
+}
+
+func (authenticator *APIKeyAuthenticator) Authenticate(_ context.Context, token []byte, r *http.Request) (*Identity, error) {
+	if len(token) == 0 && authenticator.Header != "" && r != nil {
+		token = []byte(r.Header.Get(authenticator.Header))
+	}
+	if len(token) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	// every key is compared, so that the time taken doesn't reveal anything about them
+	var identity *Identity
+	for key, keyIdentity := range authenticator.Keys {
+		if subtle.ConstantTimeCompare(token, []byte(key)) == 1 {
+			keyIdentity := keyIdentity
+			identity = &keyIdentity
+		}
+	}
+
+	if identity == nil {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	return identity, nil
+}
+
+// MTLSAuthenticator authenticates clients using the TLS client certificate they connected with. The server must be
+// set up to verify client certificates (e.g. with tls.RequireAndVerifyClientCert in HermodHTTPConfig.TLSConfig).
+// Tokens are ignored.
+type MTLSAuthenticator struct {
+	// Identify is optional, and returns the identity of the client that the verified certificate belongs to. By
+	// default, the certificate's common name is used as the subject and the certificate is used as the Value. Either
+	// way, the identity expires along with the certificate. If it returns a nil identity, the certificate is treated as
+	// though the client hadn't sent one (so ErrNoCredentials is returned).
+	Identify func(cert *x509.Certificate) (*Identity, error)
+}
+
+func (authenticator *MTLSAuthenticator) Authenticate(_ context.Context, _ []byte, r *http.Request) (*Identity, error) {
+	if r == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	identity := &Identity{
+		Subject: cert.Subject.CommonName,
+		Value:   cert,
+	}
+	if authenticator.Identify != nil {
+		var err error
+		identity, err = authenticator.Identify(cert)
+		if err != nil {
+			return nil, err
+		}
+		if identity == nil {
+			return nil, ErrNoCredentials
+		}
+	}
+
+	if identity.Expiry.IsZero() || cert.NotAfter.Before(identity.Expiry) {
+		identity.Expiry = cert.NotAfter
+	}
+	return identity, nil
+}
+
+// ChainAuthenticators returns an Authenticator that tries each of authenticators in turn, until one of them finds
+// credentials (i.e. doesn't return ErrNoCredentials). Hydrated JWTs are always cached when HermodAuthenticationConfig
+// is used this way.
+func ChainAuthenticators(authenticators ...Authenticator) Authenticator {
+	return authenticatorChain(authenticators)
+}
+
+type authenticatorChain []Authenticator
+
+func (chain authenticatorChain) Authenticate(ctx context.Context, token []byte, r *http.Request) (*Identity, error) {
+	for _, authenticator := range chain {
+		identity, err := authenticator.Authenticate(ctx, token, r)
+		if !errors.Is(err, ErrNoCredentials) {
+			return identity, err
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+type authProvider struct {
+	// goroutines created for endpoint handlers may need to access this concurrently
+	sync.RWMutex
+
+	authenticator Authenticator
+	// request is the HTTP request that was upgraded to the connection, or nil
+	request *http.Request
+	// identity must not be set unless the client's credentials have been verified
+	identity *Identity
+	// subject is the subject of the first identity that was stored. Credentials can only be replaced by ones for the
+	// same subject, even once they've expired, so that a connection or session can't change hands.
+	subject *string
+
+	// the remaining fields track when identity expires (see expiry.go)
+	expiry       time.Time
+	expired      chan struct{}
+	onExpiring   func(remaining time.Duration)
+	warningTimer *time.Timer
+	expiryTimer  *time.Timer
+}
+
+func (provider *authProvider) verifyAndStoreToken(ctx context.Context, token []byte) error {
+	identity, err := provider.authenticator.Authenticate(ctx, token, provider.request)
+	if err != nil {
+		return err
+	}
+	if identity == nil {
+		return fmt.Errorf("authenticator didn't return an identity")
+	}
+
+	provider.Lock()
+	defer provider.Unlock()
+
+	if provider.subject != nil {
+		// credentials without a subject can only be replaced by others without one, from the same authenticator
+		if identity.Subject != *provider.subject {
+			return framing.NewStatus(framing.StatusPermissionDenied, "new credentials belong to a different subject")
+		}
+	} else {
+		subject := identity.Subject
+		provider.subject = &subject
+	}
+
+	provider.identity = identity
+	provider.scheduleExpiry()
+
+	return nil
+}
+
+// getHydratedToken returns the identity's Value. If the identity came from HermodAuthenticationConfig and it doesn't
+// use a cache, the token is hydrated again by calling HermodAuthenticationConfig.TokenHydrator.
+func (provider *authProvider) getHydratedToken() (any, error) {
+	provider.RLock()
+	defer provider.RUnlock()
+
+	if provider.identity == nil {
+		return nil, fmt.Errorf("tried to get hydrated token without a session token being saved")
+	}
+
+	if config, ok := provider.authenticator.(*HermodAuthenticationConfig); ok && !config.UseCache {
+		return config.TokenHydrator(jwt.MapClaims(provider.identity.Claims))
+	}
+	return provider.identity.Value, nil
+}
+
+type AuthAPI struct {
+	*authProvider
+}
+
+func (api *AuthAPI) GetHydratedToken() (any, error) {
+	return api.getHydratedToken()
+}
+
+// Identity returns the identity of the client, or nil if its credentials have expired.
+func (api *AuthAPI) Identity() *Identity {
+	api.RLock()
+	defer api.RUnlock()
+	return api.identity
+}
+
+// Subject returns the subject of the client's identity (for JWTs, its "sub" claim), or an empty string if it doesn't
+// have one.
+func (api *AuthAPI) Subject() string {
+	identity := api.Identity()
+	if identity == nil {
+		return ""
+	}
+	return identity.Subject
+}
+
+// UpdateToken replaces the client's credentials, verifying token with the same Authenticator as before. The new
+// credentials must have the same subject as the original ones (or no subject, if the original ones didn't have one).
+func (api *AuthAPI) UpdateToken(token string) error {
+	return api.verifyAndStoreToken(context.Background(), []byte(token))
+}
+
+// authenticator returns the Authenticator that clients' credentials should be verified with, which is
+// AuthenticationConfig if Authenticator hasn't been set, or nil if neither has.
+func (config *HermodConfig) authenticator() Authenticator {
+	if config.Authenticator != nil {
+		return config.Authenticator
+	}
+	if config.AuthenticationConfig != nil {
+		return config.AuthenticationConfig
+	}
+	return nil
+}
+
+// authenticate verifies a client's credentials, returning ErrNoCredentials if it didn't send any.
+func authenticate(ctx context.Context, token []byte, r *http.Request, config *HermodConfig) (*AuthAPI, error) {
+	authenticator := config.authenticator()
+	if authenticator == nil {
+		if len(token) == 0 {
+			return nil, ErrNoCredentials
+		}
+		return nil, fmt.Errorf("authentication hasn't been configured")
+	}
+
+	auth := &authProvider{
+		authenticator: authenticator,
+		request:       r,
+	}
+	err := auth.verifyAndStoreToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthAPI{
+		auth,
+	}, nil
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/palkerecsenyi/hermod/framing"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUpdateTokenRejectsDifferentSubject(t *testing.T) {
+	config := &HermodConfig{
+		Authenticator: &APIKeyAuthenticator{
+			Keys: map[string]Identity{
+				"alice-1": {Subject: "alice"},
+				"alice-2": {Subject: "alice"},
+				"mallory": {Subject: "mallory"},
+			},
+		},
+	}
+
+	api, err := authenticate(context.Background(), []byte("alice-1"), nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = api.UpdateToken("mallory")
+	assertStatus(t, err, framing.StatusPermissionDenied)
+	if subject := api.Subject(); subject != "alice" {
+		t.Fatalf("got subject %q after rejected refresh, want alice", subject)
+	}
+
+	if err = api.UpdateToken("alice-2"); err != nil {
+		t.Fatalf("refreshing with a token for the same subject: %s", err)
+	}
+
+	// the subject is remembered after the credentials expire, so that the connection can't be taken over then either
+	api.expire(api.expiry)
+	if api.Identity() != nil {
+		t.Fatal("identity wasn't cleared once it expired")
+	}
+	err = api.UpdateToken("mallory")
+	assertStatus(t, err, framing.StatusPermissionDenied)
+}
+
+func TestUpdateTokenRejectsDifferentJWTSubject(t *testing.T) {
+	secret := []byte("secret")
+	sign := func(subject string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"sub": subject,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}).SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	config := &HermodConfig{
+		AuthenticationConfig: &HermodAuthenticationConfig{
+			SigningMethod: func(token *jwt.Token) bool {
+				return token.Method == jwt.SigningMethodHS256
+			},
+			Secret: secret,
+			TokenHydrator: func(claims jwt.MapClaims) (any, error) {
+				return claims["sub"], nil
+			},
+		},
+	}
+
+	api, err := authenticate(context.Background(), []byte(sign("alice")), nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.stop()
+
+	err = api.UpdateToken(sign("mallory"))
+	assertStatus(t, err, framing.StatusPermissionDenied)
+	if err = api.UpdateToken(sign("alice")); err != nil {
+		t.Fatalf("refreshing with a token for the same subject: %s", err)
+	}
+}
+
+func TestUpdateTokenWithoutSubject(t *testing.T) {
+	config := &HermodConfig{
+		Authenticator: &APIKeyAuthenticator{
+			Keys: map[string]Identity{
+				"anonymous-1": {},
+				"anonymous-2": {},
+				"alice":       {Subject: "alice"},
+			},
+		},
+	}
+
+	api, err := authenticate(context.Background(), []byte("anonymous-1"), nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// credentials without a subject can be refreshed with others without a subject
+	if err = api.UpdateToken("anonymous-2"); err != nil {
+		t.Fatalf("refreshing credentials without a subject: %s", err)
+	}
+
+	// but not with ones that have a subject, or the other way round
+	assertStatus(t, api.UpdateToken("alice"), framing.StatusPermissionDenied)
+	if subject := api.Subject(); subject != "" {
+		t.Fatalf("got subject %q after rejected refresh, want none", subject)
+	}
+
+	api, err = authenticate(context.Background(), []byte("alice"), nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(t, api.UpdateToken("anonymous-1"), framing.StatusPermissionDenied)
+}
+
+func TestMTLSAuthenticator(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "alice"},
+		NotAfter: time.Now().Add(time.Hour),
+	}
+	request := &http.Request{
+		TLS: &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		},
+	}
+
+	identity, err := (&MTLSAuthenticator{}).Authenticate(context.Background(), nil, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "alice" || !identity.Expiry.Equal(cert.NotAfter) {
+		t.Errorf("got subject %q expiring at %s, want alice expiring at %s", identity.Subject, identity.Expiry, cert.NotAfter)
+	}
+
+	_, err = (&MTLSAuthenticator{}).Authenticate(context.Background(), nil, &http.Request{})
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("got %v without a certificate, want ErrNoCredentials", err)
+	}
+
+	// certificates that Identify doesn't recognise are treated as missing credentials
+	unrecognised := &MTLSAuthenticator{
+		Identify: func(*x509.Certificate) (*Identity, error) {
+			return nil, nil
+		},
+	}
+	_, err = unrecognised.Authenticate(context.Background(), nil, request)
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("got %v when Identify returned nil, want ErrNoCredentials", err)
+	}
+}
+
+func assertStatus(t *testing.T, err error, code framing.StatusCode) {
+	t.Helper()
+
+	var status *framing.Status
+	if !errors.As(err, &status) {
+		t.Fatalf("got %v, want %s", err, code)
+	}
+	if status.Code != code {
+		t.Fatalf("got %s, want %s", status, code)
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"time"
+)
+
+const defaultExpiryWarning = 30 * time.Second
+
+// timeClaim returns the value of a NumericDate claim (like "exp"), or false if the claim isn't set.
+func timeClaim(claims jwt.MapClaims, key string) (time.Time, bool) {
+	var seconds float64
+	switch value := claims[key].(type) {
+	case float64:
+		seconds = value
+	case json.Number:
+		var err error
+		seconds, err = value.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+	default:
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
+
+// tokenExpiry returns when token stops being accepted according to its "exp" claim (allowing for leeway), or the zero
+// time if it doesn't expire.
+func tokenExpiry(token *jwt.Token, leeway time.Duration) time.Time {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return time.Time{}
+	}
+
+	expiry, ok := timeClaim(claims, "exp")
+	if !ok {
+		return time.Time{}
+	}
+	return expiry.Add(leeway)
+}
+
+// watchExpiry calls onExpiring shortly before the provider's identity expires (see
+// HermodAuthenticationConfig.ExpiryWarning), each time a new token is stored. Call stop once the token is no longer being used.
+func (provider *authProvider) watchExpiry(onExpiring func(remaining time.Duration)) {
+	provider.Lock()
+	defer provider.Unlock()
+
+	provider.onExpiring = onExpiring
+	provider.scheduleExpiry()
+}
+
+// scheduleExpiry starts the timers for the current token, replacing any timers for the previous one. provider must be
+// locked.
+func (provider *authProvider) scheduleExpiry() {
+	provider.stopTimers()
+
+	// a token that's stored after the previous one expired gets a new channel, so that new sessions can use it
+	if provider.expired == nil || provider.hasExpired() {
+		provider.expired = make(chan struct{})
+	}
+
+	provider.expiry = time.Time{}
+	if provider.identity == nil {
+		return
+	}
+	provider.expiry = provider.identity.Expiry
+	if provider.expiry.IsZero() {
+		return
+	}
+
+	expiry := provider.expiry
+	provider.expiryTimer = time.AfterFunc(time.Until(expiry), func() {
+		provider.expire(expiry)
+	})
+
+	if provider.onExpiring == nil {
+		return
+	}
+
+	warning := time.Duration(0)
+	if config, ok := provider.authenticator.(*HermodAuthenticationConfig); ok {
+		warning = config.ExpiryWarning
+	}
+	if warning <= 0 {
+		warning = defaultExpiryWarning
+	}
+	onExpiring := provider.onExpiring
+	provider.warningTimer = time.AfterFunc(time.Until(expiry)-warning, func() {
+		onExpiring(time.Until(expiry))
+	})
+}
+
+// hasExpired returns true if the expired channel has been closed. provider must be locked.
+func (provider *authProvider) hasExpired() bool {
+	select {
+	case <-provider.expired:
+		return true
+	default:
+		return false
+	}
+}
+
+// expire forgets the token and ends the sessions using it, unless it has been replaced by a token with a different
+// expiry.
+func (provider *authProvider) expire(expiry time.Time) {
+	provider.Lock()
+	defer provider.Unlock()
+
+	if !provider.expiry.Equal(expiry) || provider.hasExpired() {
+		return
+	}
+
+	provider.identity = nil
+	close(provider.expired)
+}
+
+// expiredChannel returns a channel that's closed once the current token expires.
+func (provider *authProvider) expiredChannel() <-chan struct{} {
+	provider.Lock()
+	defer provider.Unlock()
+
+	if provider.expired == nil {
+		provider.expired = make(chan struct{})
+	}
+	return provider.expired
+}
+
+// stop stops tracking the token's expiry.
+func (provider *authProvider) stop() {
+	provider.Lock()
+	defer provider.Unlock()
+
+	provider.onExpiring = nil
+	provider.stopTimers()
+}
+
+// stopTimers must be called with provider locked.
+func (provider *authProvider) stopTimers() {
+	if provider.warningTimer != nil {
+		provider.warningTimer.Stop()
+		provider.warningTimer = nil
+	}
+	if provider.expiryTimer != nil {
+		provider.expiryTimer.Stop()
+		provider.expiryTimer = nil
+	}
+}
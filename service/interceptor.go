@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// SessionInfo describes the session an interceptor has been called for.
+type SessionInfo struct {
+	// Endpoint always has an Id, but other fields are only set if the endpoint was registered with Describe (which
+	// generated code always does).
+	Endpoint   *Endpoint
+	SessionId  uint32
+	Metadata   Metadata
+	Headers    http.Header
+	RemoteAddr string
+	Auth       *AuthAPI
+
+	// logger has the connection, endpoint and session IDs as attributes
+	logger *slog.Logger
+}
+
+// UnaryHandler runs the handler of an endpoint without streamed arguments. It's called with the encoded input unit (or
+// nil if there isn't one), and returns the encoded output unit (or nil if the handler didn't send one).
+type UnaryHandler func(ctx context.Context, in []byte) ([]byte, error)
+
+// UnaryInterceptor wraps every session of an endpoint without streamed arguments. It must call next to run the handler,
+// or return an error without calling it to reject the session. Interceptors can change the input and output units, and
+// the context passed to next becomes the handler's Request.Context.
+type UnaryInterceptor func(ctx context.Context, info *SessionInfo, in []byte, next UnaryHandler) ([]byte, error)
+
+// ServerStream is a session's stream of encoded units, as seen by stream interceptors. Interceptors can wrap it (e.g. by
+// embedding it in a struct) to observe or modify every unit received and sent.
+type ServerStream interface {
+	// Context becomes the handler's Request.Context.
+	Context() context.Context
+	// Receive returns the next unit sent by the client. It returns io.EOF once the client has half-closed the session.
+	Receive() ([]byte, error)
+	// Send sends a unit to the client.
+	Send(unit []byte) error
+}
+
+// StreamHandler runs the handler of an endpoint with a streamed argument, until the handler returns.
+type StreamHandler func(stream ServerStream) error
+
+// StreamInterceptor wraps every session of an endpoint with a streamed argument (or of an endpoint registered without
+// Describe). It must call next to run the handler, or return an error without calling it to reject the session.
+type StreamInterceptor func(info *SessionInfo, stream ServerStream, next StreamHandler) error
+
+func chainUnaryInterceptors(interceptors []UnaryInterceptor, info *SessionInfo, handler UnaryHandler) UnaryHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, in []byte) ([]byte, error) {
+			return interceptor(ctx, info, in, next)
+		}
+	}
+
+	return handler
+}
+
+func chainStreamInterceptors(interceptors []StreamInterceptor, info *SessionInfo, handler StreamHandler) StreamHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(stream ServerStream) error {
+			return interceptor(info, stream, next)
+		}
+	}
+
+	return handler
+}
+
+type serverStream struct {
+	context context.Context
+	input   <-chan *[]byte
+	output  *sessionOutput
+}
+
+func (stream *serverStream) Context() context.Context {
+	return stream.context
+}
+
+func (stream *serverStream) Receive() ([]byte, error) {
+	select {
+	case data, ok := <-stream.input:
+		if !ok {
+			return nil, io.EOF
+		}
+		return *data, nil
+	case <-stream.context.Done():
+		return nil, stream.context.Err()
+	}
+}
+
+func (stream *serverStream) Send(unit []byte) error {
+	if err := stream.context.Err(); err != nil {
+		return err
+	}
+
+	stream.output.sendData(unit)
+	return nil
+}
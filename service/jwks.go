@@ -0,0 +1,410 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSRefreshInterval    = time.Hour
+	defaultJWKSMinRefreshInterval = time.Minute
+	defaultJWKSTimeout            = 10 * time.Second
+	// jwksInitialBackoff is how long to wait before fetching the key set again after the first failure. It's doubled
+	// after each further failure, up to MinRefreshInterval.
+	jwksInitialBackoff = time.Second
+)
+
+// JWKS provides keys from a JSON Web Key Set (RFC 7517), such as the one published by an identity provider. Keys are
+// looked up by the token's "kid" header. The set is cached, and fetched again in the background once RefreshInterval
+// has passed (or periodically by Run), or straight away when a token uses a key ID that isn't in the cached set (e.g.
+// after the provider has rotated its keys). If fetching fails, the cached keys carry on being used, and fetching is
+// retried with exponential backoff.
+//
+// Use it by setting HermodAuthenticationConfig.JWKS, or HermodAuthenticationConfig.KeyProvider to JWKS.Key. RSA, EC
+// (P-256, P-384 and P-521), Ed25519 and symmetric (oct) keys are supported.
+type JWKS struct {
+	// URL is where the key set is fetched from. It can be an http:// or https:// URL, or a file:// URL to read a local
+	// file.
+	URL string
+	// Client is used to fetch the key set over HTTP. If it's nil, http.DefaultClient is used.
+	Client *http.Client
+	// Timeout limits how long fetching the key set can take. Default: 10 seconds
+	Timeout time.Duration
+	// RefreshInterval is how long the key set is cached for. Default: 1 hour
+	RefreshInterval time.Duration
+	// MinRefreshInterval limits how often the key set is fetched because of an unknown key ID, so that tokens with
+	// made-up key IDs can't be used to flood the identity provider with requests. It's also the longest time to wait
+	// before retrying after fetching fails. Default: 1 minute
+	MinRefreshInterval time.Duration
+
+	// mutex protects the fields below, and is never held while fetching the key set, so that tokens can be verified
+	// with the cached keys in the meantime
+	mutex sync.Mutex
+	keys  map[string]*jsonWebKey
+	// fetched is when the key set was last fetched successfully
+	fetched time.Time
+	// retryAt is when the key set may next be fetched after a failure
+	retryAt time.Time
+	// failures counts consecutive failures to fetch the key set, the last of which was lastError
+	failures  int
+	lastError error
+	// refreshing is set while the key set is being refreshed in the background
+	refreshing bool
+
+	// fetching is held while fetching the key set, so that concurrent callers share a single request
+	fetching sync.Mutex
+}
+
+// jsonWebKey is a parsed key from the key set.
+type jsonWebKey struct {
+	algorithm string
+	key       any
+}
+
+// Key returns the key to verify token with. It can be used as HermodAuthenticationConfig.KeyProvider.
+func (jwks *JWKS) Key(token *jwt.Token) (any, error) {
+	return jwks.KeyContext(context.Background(), token)
+}
+
+// KeyContext is like Key, but stops waiting for the key set to be fetched once ctx ends.
+func (jwks *JWKS) KeyContext(ctx context.Context, token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	jwks.mutex.Lock()
+	cached := jwks.keys != nil
+	if cached && jwks.stale() && !jwks.refreshing && !time.Now().Before(jwks.retryAt) {
+		// the cached keys are used until they've been replaced
+		jwks.refreshing = true
+		go func() {
+			_ = jwks.refresh(context.Background(), false)
+
+			jwks.mutex.Lock()
+			jwks.refreshing = false
+			jwks.mutex.Unlock()
+		}()
+	}
+	key, ok := jwks.lookup(kid)
+	jwks.mutex.Unlock()
+
+	var err error
+	if !cached {
+		err = jwks.refresh(ctx, false)
+	} else if !ok {
+		err = jwks.refresh(ctx, true)
+	}
+	if err != nil || !ok {
+		jwks.mutex.Lock()
+		key, ok = jwks.lookup(kid)
+		jwks.mutex.Unlock()
+	}
+
+	if !ok {
+		if err != nil {
+			return nil, fmt.Errorf("fetching key set: %w", err)
+		}
+		return nil, fmt.Errorf("key %q not found in key set", kid)
+	}
+
+	if alg, _ := token.Header["alg"].(string); key.algorithm != "" && key.algorithm != alg {
+		return nil, fmt.Errorf("key %q is for %s, not %s", kid, key.algorithm, alg)
+	}
+
+	return key.key, nil
+}
+
+// lookup finds the key with ID kid. Tokens without a key ID can only be used if the key set has a single key. jwks must
+// be locked.
+func (jwks *JWKS) lookup(kid string) (*jsonWebKey, bool) {
+	if kid == "" && len(jwks.keys) == 1 {
+		for _, key := range jwks.keys {
+			return key, true
+		}
+	}
+
+	key, ok := jwks.keys[kid]
+	return key, ok
+}
+
+// stale returns true if the cached key set should be replaced. jwks must be locked.
+func (jwks *JWKS) stale() bool {
+	return jwks.keys == nil || time.Since(jwks.fetched) >= jwks.refreshInterval()
+}
+
+// refreshInterval returns RefreshInterval, or its default.
+func (jwks *JWKS) refreshInterval() time.Duration {
+	if jwks.RefreshInterval <= 0 {
+		return defaultJWKSRefreshInterval
+	}
+	return jwks.RefreshInterval
+}
+
+// Refresh fetches the key set straight away, replacing the cached keys.
+func (jwks *JWKS) Refresh(ctx context.Context) error {
+	jwks.fetching.Lock()
+	defer jwks.fetching.Unlock()
+	return jwks.fetchAndStore(ctx)
+}
+
+// Run refreshes the key set every RefreshInterval (or sooner, to retry after a failure) until ctx ends. It's optional,
+// since the key set is also refreshed when it's used, but it means that tokens never have to wait for the key set to be
+// fetched.
+func (jwks *JWKS) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		_ = jwks.refresh(ctx, false)
+
+		jwks.mutex.Lock()
+		next := jwks.retryAt
+		if jwks.failures == 0 {
+			next = jwks.fetched.Add(jwks.refreshInterval())
+		}
+		jwks.mutex.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// refresh fetches the key set if the cached key set is stale or, if force is true, unless it was fetched less than
+// MinRefreshInterval ago. If fetching has failed recently, the last error is returned without trying again.
+func (jwks *JWKS) refresh(ctx context.Context, force bool) error {
+	jwks.fetching.Lock()
+	defer jwks.fetching.Unlock()
+
+	// the key set may have been refreshed while waiting for another fetch to finish
+	jwks.mutex.Lock()
+	if time.Now().Before(jwks.retryAt) {
+		err := jwks.lastError
+		jwks.mutex.Unlock()
+		return err
+	}
+	if !jwks.stale() && (!force || time.Since(jwks.fetched) < jwks.minRefreshInterval()) {
+		jwks.mutex.Unlock()
+		return nil
+	}
+	jwks.mutex.Unlock()
+
+	return jwks.fetchAndStore(ctx)
+}
+
+// fetchAndStore fetches the key set and replaces the cached keys, or schedules a retry if fetching fails. jwks.fetching
+// must be locked.
+func (jwks *JWKS) fetchAndStore(ctx context.Context) error {
+	keys, err := jwks.fetch(ctx)
+
+	jwks.mutex.Lock()
+	defer jwks.mutex.Unlock()
+
+	if err != nil && ctx.Err() != nil {
+		// the caller gave up, which doesn't mean that the key set can't be fetched
+		return err
+	}
+	if err != nil {
+		backoff := jwksInitialBackoff << jwks.failures
+		if minRefreshInterval := jwks.minRefreshInterval(); backoff > minRefreshInterval || backoff <= 0 {
+			backoff = minRefreshInterval
+		}
+		jwks.failures += 1
+		jwks.lastError = err
+		jwks.retryAt = time.Now().Add(backoff)
+		return err
+	}
+
+	jwks.keys = keys
+	jwks.fetched = time.Now()
+	jwks.failures = 0
+	jwks.lastError = nil
+	jwks.retryAt = time.Time{}
+	return nil
+}
+
+// minRefreshInterval returns MinRefreshInterval, or its default.
+func (jwks *JWKS) minRefreshInterval() time.Duration {
+	if jwks.MinRefreshInterval <= 0 {
+		return defaultJWKSMinRefreshInterval
+	}
+	return jwks.MinRefreshInterval
+}
+
+// fetch reads and parses the key set.
+func (jwks *JWKS) fetch(ctx context.Context) (map[string]*jsonWebKey, error) {
+	location, err := url.Parse(jwks.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if location.Scheme == "file" {
+		data, err := os.ReadFile(location.Path)
+		if err != nil {
+			return nil, err
+		}
+		return parseJWKS(data)
+	}
+
+	timeout := jwks.Timeout
+	if timeout <= 0 {
+		timeout = defaultJWKSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, jwks.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := jwks.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// parseJWKS parses a key set, keyed by key ID. Keys that aren't for signatures, or that can't be used (e.g. because
+// their type or curve isn't supported), are skipped.
+func parseJWKS(data []byte) (map[string]*jsonWebKey, error) {
+	var set struct {
+		Keys []map[string]any `json:"keys"`
+	}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key set: %w", err)
+	}
+
+	keys := map[string]*jsonWebKey{}
+	for _, fields := range set.Keys {
+		if use, ok := fields["use"].(string); ok && use != "sig" {
+			continue
+		}
+
+		key, err := parseJWK(fields)
+		if err != nil {
+			continue
+		}
+
+		kid, _ := fields["kid"].(string)
+		keys[kid] = key
+	}
+
+	return keys, nil
+}
+
+// parseJWK parses a single key, returning an error if it can't be used.
+func parseJWK(fields map[string]any) (*jsonWebKey, error) {
+	kid, _ := fields["kid"].(string)
+	algorithm, _ := fields["alg"].(string)
+
+	param := func(name string) ([]byte, error) {
+		value, _ := fields[name].(string)
+		decoded, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(decoded) == 0 {
+			return nil, fmt.Errorf("key %q has invalid parameter %q", kid, name)
+		}
+		return decoded, nil
+	}
+
+	var key any
+	switch fields["kty"] {
+	case "RSA":
+		n, err := param("n")
+		if err != nil {
+			return nil, err
+		}
+		e, err := param("e")
+		if err != nil {
+			return nil, err
+		}
+
+		key = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	case "EC":
+		var curve elliptic.Curve
+		switch fields["crv"] {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key %q has unsupported curve %v", kid, fields["crv"])
+		}
+
+		x, err := param("x")
+		if err != nil {
+			return nil, err
+		}
+		y, err := param("y")
+		if err != nil {
+			return nil, err
+		}
+
+		key = &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+	case "OKP":
+		if fields["crv"] != "Ed25519" {
+			return nil, fmt.Errorf("key %q has unsupported curve %v", kid, fields["crv"])
+		}
+
+		x, err := param("x")
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %q has invalid parameter \"x\"", kid)
+		}
+
+		key = ed25519.PublicKey(x)
+	case "oct":
+		k, err := param("k")
+		if err != nil {
+			return nil, err
+		}
+
+		key = k
+	default:
+		return nil, fmt.Errorf("key %q has unsupported type %v", kid, fields["kty"])
+	}
+
+	return &jsonWebKey{
+		algorithm: algorithm,
+		key:       key,
+	}, nil
+}
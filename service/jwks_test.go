@@ -0,0 +1,485 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v4"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testKey is a private key, along with its public key in JWK form.
+type testKey struct {
+	kid    string
+	method jwt.SigningMethod
+	signer crypto.Signer
+	jwk    map[string]any
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func newRSAKey(t *testing.T, kid string) *testKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKey{kid, jwt.SigningMethodRS256, key, map[string]any{
+		"kty": "RSA",
+		"kid": kid,
+		"alg": "RS256",
+		"use": "sig",
+		"n":   b64(key.N.Bytes()),
+		"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+	}}
+}
+
+func newECKey(t *testing.T, kid string) *testKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKey{kid, jwt.SigningMethodES256, key, map[string]any{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   b64(key.X.FillBytes(make([]byte, 32))),
+		"y":   b64(key.Y.FillBytes(make([]byte, 32))),
+	}}
+}
+
+func newEd25519Key(t *testing.T, kid string) *testKey {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testKey{kid, jwt.SigningMethodEdDSA, private, map[string]any{
+		"kty": "OKP",
+		"kid": kid,
+		"crv": "Ed25519",
+		"x":   b64(public),
+	}}
+}
+
+func (key *testKey) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	signed, err := token.SignedString(key.signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func keySet(t *testing.T, keys ...map[string]any) []byte {
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// jwksServer serves a key set that can be replaced, and counts the requests for it.
+type jwksServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	set      []byte
+	status   int
+	requests atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, set []byte) *jwksServer {
+	server := &jwksServer{set: set, status: http.StatusOK}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.requests.Add(1)
+
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		w.WriteHeader(server.status)
+		_, _ = w.Write(server.set)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (server *jwksServer) serve(set []byte, status int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.set, server.status = set, status
+}
+
+func asymmetricConfig(jwks *JWKS) *HermodAuthenticationConfig {
+	return &HermodAuthenticationConfig{
+		SigningMethod: func(token *jwt.Token) bool {
+			switch token.Method.(type) {
+			case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA, *jwt.SigningMethodEd25519:
+				return true
+			}
+			return false
+		},
+		JWKS: jwks,
+		TokenHydrator: func(claims jwt.MapClaims) (any, error) {
+			return claims, nil
+		},
+	}
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWKSVerifiesAsymmetricKeys(t *testing.T) {
+	keys := []*testKey{newRSAKey(t, "rsa"), newECKey(t, "ec"), newEd25519Key(t, "ed")}
+	server := newJWKSServer(t, keySet(t, keys[0].jwk, keys[1].jwk, keys[2].jwk))
+	config := asymmetricConfig(&JWKS{URL: server.URL})
+
+	for _, key := range keys {
+		identity, err := config.Authenticate(context.Background(), []byte(key.sign(t, validClaims())), nil)
+		if err != nil {
+			t.Fatalf("%s: %s", key.kid, err)
+		}
+		if identity.Subject != "alice" {
+			t.Errorf("%s: got subject %q, want alice", key.kid, identity.Subject)
+		}
+	}
+
+	// the key set is cached
+	if requests := server.requests.Load(); requests != 1 {
+		t.Errorf("key set was fetched %d times, want 1", requests)
+	}
+}
+
+func TestJWKSLooksUpKeysByID(t *testing.T) {
+	first, second := newRSAKey(t, "first"), newRSAKey(t, "second")
+	server := newJWKSServer(t, keySet(t, first.jwk, second.jwk))
+	config := asymmetricConfig(&JWKS{URL: server.URL})
+
+	for _, key := range []*testKey{first, second} {
+		if _, err := config.ParseToken(key.sign(t, validClaims())); err != nil {
+			t.Errorf("%s: %s", key.kid, err)
+		}
+	}
+
+	// a token signed by one key but claiming to be signed by the other is rejected
+	impostor := &testKey{"second", first.method, first.signer, nil}
+	if _, err := config.ParseToken(impostor.sign(t, validClaims())); err == nil {
+		t.Error("accepted token with the wrong key ID")
+	}
+
+	// tokens without a key ID can't be used when the set has several keys
+	noKid := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims())
+	signed, err := noKid.SignedString(first.signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = config.ParseToken(signed); err == nil {
+		t.Error("accepted token without a key ID")
+	}
+}
+
+func TestJWKSRefreshesOnUnknownKeyID(t *testing.T) {
+	old, rotated := newRSAKey(t, "old"), newRSAKey(t, "new")
+	server := newJWKSServer(t, keySet(t, old.jwk))
+	jwks := &JWKS{URL: server.URL, MinRefreshInterval: 50 * time.Millisecond}
+	config := asymmetricConfig(jwks)
+
+	if _, err := config.ParseToken(old.sign(t, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider rotates its keys
+	server.serve(keySet(t, rotated.jwk), http.StatusOK)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := config.ParseToken(rotated.sign(t, validClaims())); err != nil {
+		t.Fatalf("token signed with rotated key: %s", err)
+	}
+	if _, err := config.ParseToken(old.sign(t, validClaims())); err == nil {
+		t.Error("accepted token signed with a key that has been rotated out")
+	}
+
+	// unknown key IDs can't cause the key set to be fetched more often than MinRefreshInterval
+	before := server.requests.Load()
+	for i := 0; i < 10; i++ {
+		madeUp := &testKey{"made-up", rotated.method, rotated.signer, nil}
+		_, _ = config.ParseToken(madeUp.sign(t, validClaims()))
+	}
+	if requests := server.requests.Load() - before; requests > 1 {
+		t.Errorf("unknown key IDs caused %d fetches, want at most 1", requests)
+	}
+}
+
+func TestJWKSRefreshesPeriodically(t *testing.T) {
+	old, rotated := newECKey(t, "old"), newECKey(t, "new")
+	server := newJWKSServer(t, keySet(t, old.jwk))
+	jwks := &JWKS{URL: server.URL, RefreshInterval: 50 * time.Millisecond, MinRefreshInterval: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go jwks.Run(ctx)
+
+	config := asymmetricConfig(jwks)
+	waitFor(t, func() bool {
+		_, err := config.ParseToken(old.sign(t, validClaims()))
+		return err == nil
+	})
+
+	// MinRefreshInterval stops the unknown key ID from causing a fetch, so the new key only appears once Run has
+	// refreshed the key set
+	server.serve(keySet(t, rotated.jwk), http.StatusOK)
+	waitFor(t, func() bool {
+		_, err := config.ParseToken(rotated.sign(t, validClaims()))
+		return err == nil
+	})
+}
+
+func TestJWKSKeepsCachedKeysWhenFetchingFails(t *testing.T) {
+	key := newRSAKey(t, "key")
+	server := newJWKSServer(t, keySet(t, key.jwk))
+	jwks := &JWKS{URL: server.URL, RefreshInterval: time.Millisecond, MinRefreshInterval: time.Hour}
+	config := asymmetricConfig(jwks)
+
+	if _, err := config.ParseToken(key.sign(t, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	server.serve(nil, http.StatusInternalServerError)
+	time.Sleep(5 * time.Millisecond)
+
+	// the key set is stale, but fetching fails, so the cached keys carry on being used, and fetching backs off instead
+	// of being retried for every token
+	before := server.requests.Load()
+	for i := 0; i < 20; i++ {
+		if _, err := config.ParseToken(key.sign(t, validClaims())); err != nil {
+			t.Fatalf("token signed with cached key: %s", err)
+		}
+	}
+	waitFor(t, func() bool {
+		jwks.mutex.Lock()
+		defer jwks.mutex.Unlock()
+		return jwks.failures > 0 && !jwks.refreshing
+	})
+	if requests := server.requests.Load() - before; requests != 1 {
+		t.Errorf("key set was fetched %d times while failing, want 1", requests)
+	}
+}
+
+func TestJWKSFetchTimesOut(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	key := newRSAKey(t, "key")
+	config := asymmetricConfig(&JWKS{URL: server.URL, Timeout: 50 * time.Millisecond})
+
+	started := time.Now()
+	if _, err := config.ParseToken(key.sign(t, validClaims())); err == nil {
+		t.Fatal("accepted token without fetching the key set")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("fetching the key set took %s, want it to time out after 50ms", elapsed)
+	}
+
+	// the caller's context is used too
+	config.JWKS = &JWKS{URL: server.URL}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := config.Authenticate(ctx, []byte(key.sign(t, validClaims())), nil); err == nil {
+		t.Fatal("accepted token without fetching the key set")
+	}
+}
+
+func TestJWKSRejectsUnsafeAlgorithms(t *testing.T) {
+	key := newRSAKey(t, "key")
+	// the key's alg is left out, so that only the signing method and the key's type stop it being used for HMAC
+	delete(key.jwk, "alg")
+	server := newJWKSServer(t, keySet(t, key.jwk))
+	config := asymmetricConfig(&JWKS{URL: server.URL})
+
+	none := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims())
+	none.Header["kid"] = "key"
+	signed, err := none.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = config.ParseToken(signed); err == nil {
+		t.Error("accepted token with alg none")
+	}
+
+	// HS256 signed with the RSA public key as the secret
+	publicKey, err := x509.MarshalPKIXPublicKey(key.signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+	hmac := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims())
+	hmac.Header["kid"] = "key"
+	signed, err = hmac.SignedString(publicPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = config.ParseToken(signed); err == nil {
+		t.Error("accepted HS256 token signed with the public key")
+	}
+
+	// even if the signing method check allows HMAC, an RSA key can't be used as an HMAC secret
+	config.SigningMethod = func(*jwt.Token) bool {
+		return true
+	}
+	if _, err = config.ParseToken(signed); err == nil {
+		t.Error("accepted HS256 token signed with the public key when the signing method wasn't checked")
+	}
+}
+
+func TestJWKSChecksKeyAlgorithm(t *testing.T) {
+	key := newRSAKey(t, "key")
+	key.jwk["alg"] = "RS512"
+	server := newJWKSServer(t, keySet(t, key.jwk))
+	config := asymmetricConfig(&JWKS{URL: server.URL})
+
+	if _, err := config.ParseToken(key.sign(t, validClaims())); err == nil {
+		t.Error("accepted RS256 token signed with an RS512 key")
+	}
+}
+
+func TestJWKSSkipsUnusableKeys(t *testing.T) {
+	key := newEd25519Key(t, "key")
+	set := keySet(t,
+		map[string]any{"kty": "EC", "kid": "curve", "crv": "P-192", "x": "AA", "y": "AA"},
+		map[string]any{"kty": "OKP", "kid": "x25519", "crv": "X25519", "x": "AA"},
+		map[string]any{"kty": "RSA", "kid": "broken", "n": "!"},
+		map[string]any{"kty": "unknown", "kid": "unknown"},
+		map[string]any{"kty": "RSA", "kid": "encryption", "use": "enc", "n": "AQAB", "e": "AQAB"},
+		key.jwk,
+	)
+
+	keys, err := parseJWKS(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys["key"] == nil {
+		t.Errorf("got keys %v, want only \"key\"", keys)
+	}
+}
+
+func TestJWKSReadsFiles(t *testing.T) {
+	key := newECKey(t, "key")
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keySet(t, key.jwk), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := asymmetricConfig(&JWKS{URL: "file://" + path})
+
+	if _, err := config.ParseToken(key.sign(t, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateClaims(t *testing.T) {
+	key := newRSAKey(t, "key")
+	server := newJWKSServer(t, keySet(t, key.jwk))
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		modify func(config *HermodAuthenticationConfig)
+		valid  bool
+	}{
+		{"expired", jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}, nil, false},
+		{"expired within leeway", jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}, func(config *HermodAuthenticationConfig) {
+			config.Leeway = 2 * time.Minute
+		}, true},
+		{"not valid yet", jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()}, nil, false},
+		{"not valid yet within leeway", jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()}, func(config *HermodAuthenticationConfig) {
+			config.Leeway = 2 * time.Minute
+		}, true},
+		{"issued in the future", jwt.MapClaims{"iat": now.Add(time.Minute).Unix()}, nil, false},
+		{"audience", jwt.MapClaims{"aud": []string{"other", "hermod"}}, func(config *HermodAuthenticationConfig) {
+			config.Audience = "hermod"
+		}, true},
+		{"wrong audience", jwt.MapClaims{"aud": "other"}, func(config *HermodAuthenticationConfig) {
+			config.Audience = "hermod"
+		}, false},
+		{"missing audience", jwt.MapClaims{}, func(config *HermodAuthenticationConfig) {
+			config.Audience = "hermod"
+		}, false},
+		{"issuer", jwt.MapClaims{"iss": "https://idp.example"}, func(config *HermodAuthenticationConfig) {
+			config.Issuer = "https://idp.example"
+		}, true},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example"}, func(config *HermodAuthenticationConfig) {
+			config.Issuer = "https://idp.example"
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := asymmetricConfig(&JWKS{URL: server.URL})
+			if test.modify != nil {
+				test.modify(config)
+			}
+
+			_, err := config.ParseToken(key.sign(t, test.claims))
+			if test.valid && err != nil {
+				t.Errorf("rejected valid token: %s", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("accepted invalid token")
+			}
+		})
+	}
+}
+
+func TestTokenExpiryIncludesLeeway(t *testing.T) {
+	key := newRSAKey(t, "key")
+	server := newJWKSServer(t, keySet(t, key.jwk))
+	config := asymmetricConfig(&JWKS{URL: server.URL})
+	config.Leeway = time.Minute
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	identity, err := config.Authenticate(context.Background(), []byte(key.sign(t, jwt.MapClaims{"exp": expiry.Unix()})), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := expiry.Add(time.Minute); !identity.Expiry.Equal(want) {
+		t.Errorf("got expiry %s, want %s", identity.Expiry, want)
+	}
+}
+
+// waitFor fails the test unless condition becomes true within a second.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
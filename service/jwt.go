@@ -1,70 +1,135 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
-	"sync"
+	"net/http"
+	"strings"
+	"time"
 )
 
 // HermodAuthenticationConfig lets you set up and define parameters for Hermod's JWT-based authentication system. This is
-// highly opinionated, and you don't have to use it! You can also use Hermod's authentication system outside of Hermod
+// highly opinionated, and you don't have to use it! It's an Authenticator, so it can be combined with other
+// authenticators using ChainAuthenticators. You can also use Hermod's authentication system outside of Hermod
 // connections by using the public methods exposed by HermodAuthenticationConfig.
 type HermodAuthenticationConfig struct {
 	// SigningMethod must be defined. It's a function that returns true if the signing method of the token is what you
 	// want it to be, and false if not.
 	SigningMethod func(*jwt.Token) bool
-	// either Secret or SecretProvider must be defined
+	// one of Secret, SecretProvider, KeyProvider or JWKS must be defined
 	Secret []byte
 	// SecretProvider doesn't need to verify the signing method, this is done automatically
 	SecretProvider func(*jwt.Token) ([]byte, error)
+	// KeyProvider returns the key to verify the token with, which can be of any type supported by the token's signing
+	// method (e.g. *rsa.PublicKey for RS256 or *ecdsa.PublicKey for ES256). Set JWKS instead to get keys from a JSON Web
+	// Key Set. It takes precedence over SecretProvider and Secret.
+	KeyProvider func(*jwt.Token) (any, error)
+	// JWKS provides keys from a JSON Web Key Set, and takes precedence over the other ways of providing keys. Unlike
+	// KeyProvider, fetching the key set stops if the connection that sent the token closes.
+	JWKS *JWKS
+
+	// Audience and Issuer, if set, must match the token's "aud" and "iss" claims.
+	Audience string
+	Issuer   string
+	// Leeway allows for clock skew between the server and the token's issuer when checking its "exp", "nbf" and "iat"
+	// claims.
+	Leeway time.Duration
 
 	// TokenHydrator must be defined. It returns a custom type based on a map of pre-validated JWT claims.
 	TokenHydrator func(jwt.MapClaims) (any, error)
 
-	// UseCache determines whether to cache hydrated tokens. If false, only the raw JWT token will be saved for each
+	// UseCache determines whether to cache hydrated tokens. If false, only the JWT's claims will be saved for each
 	// connection and must be rehydrated each time your code asks for it. If your hydrated value is unlikely to change during
 	// a single connection, set this to true.
 	UseCache bool
-}
-
-type authProvider struct {
-	// goroutines created for endpoint handlers may need to access this concurrently
-	sync.RWMutex
 
-	// sessionToken must not be set unless the token is valid and matches the expected secret
-	sessionToken  *jwt.Token
-	hydratedToken any
-	config        *HermodAuthenticationConfig
+	// ExpiryWarning is how long before a token expires (according to its "exp" claim) to send the client a
+	// TokenExpiring frame, giving it a chance to send a new token. Sessions using the token are ended with a
+	// StatusUnauthenticated error once it expires. Default: 30 seconds
+	ExpiryWarning time.Duration
 }
 
-func newAuthProviderFromConfig(authConfig *HermodAuthenticationConfig) *authProvider {
-	return &authProvider{
-		config: authConfig,
-	}
+// ParseToken parses a JWT token, returning the parsed token object. It will use your specified secret or key provider
+// and use the HermodAuthenticationConfig.SigningMethod function to determine whether the correct signing method is
+// used. Its claims are checked against Audience, Issuer and Leeway, and an error is returned (with jwt.Token.Valid set
+// to false) if the token isn't valid.
+func (config *HermodAuthenticationConfig) ParseToken(token string) (*jwt.Token, error) {
+	return config.parseToken(context.Background(), token)
 }
 
-// ParseToken parses a JWT token, returning the parsed token object. It will use your specified secret and use the
-// HermodAuthenticationConfig.SigningMethod function to determine whether the correct signing method is used.
-// It does not check whether the token is valid. You can use jwt.Token.Valid to do this.
-func (config *HermodAuthenticationConfig) ParseToken(token string) (*jwt.Token, error) {
-	return jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+func (config *HermodAuthenticationConfig) parseToken(ctx context.Context, token string) (*jwt.Token, error) {
+	// claims are validated separately, since the parser doesn't support leeway
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation())
+	parsedToken, err := parser.Parse(token, func(token *jwt.Token) (interface{}, error) {
 		if config.SigningMethod(token) == false {
 			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
 		}
 
+		if config.JWKS != nil {
+			return config.JWKS.KeyContext(ctx, token)
+		}
+
+		if config.KeyProvider != nil {
+			return config.KeyProvider(token)
+		}
+
 		if config.SecretProvider != nil {
 			return config.SecretProvider(token)
 		}
 
 		return config.Secret, nil
 	})
+	if err != nil {
+		return parsedToken, err
+	}
+
+	err = config.validateClaims(parsedToken)
+	if err != nil {
+		parsedToken.Valid = false
+		return parsedToken, err
+	}
+
+	return parsedToken, nil
+}
+
+// validateClaims checks the token's time-based claims (allowing for Leeway), audience and issuer.
+func (config *HermodAuthenticationConfig) validateClaims(token *jwt.Token) error {
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return fmt.Errorf("jwt claims could not be parsed as a map")
+	}
+
+	now := time.Now()
+	if expiry, ok := timeClaim(claims, "exp"); ok && !now.Before(expiry.Add(config.Leeway)) {
+		return fmt.Errorf("token has expired")
+	}
+	if notBefore, ok := timeClaim(claims, "nbf"); ok && now.Add(config.Leeway).Before(notBefore) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if issuedAt, ok := timeClaim(claims, "iat"); ok && now.Add(config.Leeway).Before(issuedAt) {
+		return fmt.Errorf("token was issued in the future")
+	}
+
+	if config.Audience != "" && !claims.VerifyAudience(config.Audience, true) {
+		return fmt.Errorf("token has the wrong audience")
+	}
+	if config.Issuer != "" && !claims.VerifyIssuer(config.Issuer, true) {
+		return fmt.Errorf("token has the wrong issuer")
+	}
+
+	return nil
 }
 
 // HydrateToken is a convenience method to parse and validate a JWT and to then 'hydrate' the token. It returns both
 // the hydrated token and the raw parsed JWT. It will return an error if the JWT is not valid. The type of the hydrated
 // token is inferred from the type parameter on HermodAuthenticationConfig.
 func (config *HermodAuthenticationConfig) HydrateToken(token string) (any, *jwt.Token, error) {
-	parsedToken, err := config.ParseToken(token)
+	return config.hydrateToken(context.Background(), token)
+}
+
+func (config *HermodAuthenticationConfig) hydrateToken(ctx context.Context, token string) (any, *jwt.Token, error) {
+	parsedToken, err := config.parseToken(ctx, token)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -79,70 +144,39 @@ func (config *HermodAuthenticationConfig) HydrateToken(token string) (any, *jwt.
 	return nil, parsedToken, fmt.Errorf("jwt was not valid")
 }
 
-func (provider *authProvider) verifyAndStoreToken(token string) error {
-	provider.Lock()
-	defer provider.Unlock()
-
-	providerConfig := provider.config
-	hydratedToken, parsedToken, err := providerConfig.HydrateToken(token)
-
-	if err != nil {
-		return err
-	}
-
-	if providerConfig.UseCache {
-		provider.hydratedToken = hydratedToken
+// Authenticate implements Authenticator by parsing, validating and hydrating token as a JWT. The identity's Claims are
+// the JWT's claims, its Value is the hydrated token and it expires along with the token.
+func (config *HermodAuthenticationConfig) Authenticate(ctx context.Context, token []byte, _ *http.Request) (*Identity, error) {
+	if len(token) == 0 {
+		return nil, ErrNoCredentials
 	}
 
-	provider.sessionToken = parsedToken
-
-	return nil
-}
-
-// getHydratedToken returns a hydrated token, either from cache or by calling HermodAuthenticationConfig.TokenHydrate
-func (provider *authProvider) getHydratedToken() (any, error) {
-	provider.RLock()
-	defer provider.RUnlock()
-
-	if provider.hydratedToken != nil && provider.config.UseCache {
-		return provider.hydratedToken, nil
+	hydratedToken, parsedToken, err := config.hydrateToken(ctx, string(token))
+	if err != nil {
+		return nil, err
 	}
 
-	if provider.sessionToken == nil {
-		return nil, fmt.Errorf("tried to get hydrated token without a session token being saved")
+	claims := parsedToken.Claims.(jwt.MapClaims)
+	identity := &Identity{
+		Expiry: tokenExpiry(parsedToken, config.Leeway),
+		Claims: claims,
+		Value:  hydratedToken,
 	}
+	identity.Subject, _ = claims["sub"].(string)
 
-	if claims, ok := provider.sessionToken.Claims.(jwt.MapClaims); ok {
-		return provider.config.TokenHydrator(claims)
+	if scoped, ok := hydratedToken.(ScopedToken); ok {
+		identity.Scopes = scoped.Scopes()
+	} else if scope, ok := claims["scope"].(string); ok {
+		identity.Scopes = strings.Fields(scope)
 	} else {
-		return nil, fmt.Errorf("session token could not be parsed as a map of claims")
+		identity.Scopes = claimStrings(claims["scp"])
 	}
-}
-
-type AuthAPI struct {
-	*authProvider
-}
 
-func (api *AuthAPI) GetHydratedToken() (any, error) {
-	return api.getHydratedToken()
-}
-
-func (api *AuthAPI) UpdateToken(token string) error {
-	return api.verifyAndStoreToken(token)
-}
-
-func setupRequestAuthentication(token string, config *HermodConfig) (*AuthAPI, error) {
-	if config.AuthenticationConfig == nil {
-		return nil, fmt.Errorf("authentication hasn't been configured")
-	}
-
-	auth := newAuthProviderFromConfig(config.AuthenticationConfig)
-	err := auth.verifyAndStoreToken(token)
-	if err != nil {
-		return nil, err
+	if roles, ok := hydratedToken.(RoleToken); ok {
+		identity.Roles = roles.Roles()
+	} else {
+		identity.Roles = claimStrings(claims["roles"])
 	}
 
-	return &AuthAPI{
-		auth,
-	}, nil
+	return identity, nil
 }
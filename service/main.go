@@ -1,14 +1,16 @@
 // Package service provides a server and an application-layer protocol for transmitting encoded Hermod units. It does
 // not provide a client (at the moment).
 //
-// You can use `service` by adding service endpoints to Hermod YAML files and then calling the generated Register<name>()
-// function to register an endpoint handler. This will get called whenever a client requests that endpoint. Endpoints
+// You can use `service` by adding service endpoints to Hermod YAML files and then calling the generated
+// Register<name>Handler() function to register an endpoint handler with a Server (usually DefaultServer). This will get
+// called whenever a client requests that endpoint. Endpoints
 // have fairly simple interfaces that work in a similar way to net/http, giving you a request and response object. Any
 // errors returned within endpoint handlers are sent as encoded error objects to the client.
 //
 // The package also provides a JWT-based authentication system. This allows clients to send a JWT along with their request,
 // either as a query parameter in the initial session establishment request, or as a separate authentication packet at any
-// time during the request. For more details see HermodAuthenticationConfig.
+// time during the request. For more details see HermodAuthenticationConfig. Other kinds of credentials, such as API keys
+// and TLS client certificates, can be verified by an Authenticator.
 //
 // The server provided by the package is designed to be used to open a single WebSocket connection between a client and the
 // server. All Hermod requests should be transmitted over that single connection to avoid the overhead of performing a
@@ -18,10 +20,17 @@
 package service
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/metrics"
+	"github.com/palkerecsenyi/hermod/tracing"
+	"log/slog"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -34,11 +43,22 @@ type EndpointArgument struct {
 	Streamed bool
 }
 
+// Endpoint describes an endpoint defined in a Hermod YAML file. Arguments without a Unit name aren't used by the
+// endpoint.
 type Endpoint struct {
 	Service *Service
+	Id      uint16
 	Path    string
 	In      EndpointArgument
 	Out     EndpointArgument
+	// Auth is enforced by the server before the handler runs
+	Auth AuthPolicy
+}
+
+// unary returns true if neither of the endpoint's arguments are streamed. Endpoints without a Path haven't been
+// described, so they're assumed to be streamed.
+func (endpoint *Endpoint) unary() bool {
+	return endpoint.Path != "" && !endpoint.In.Streamed && !endpoint.Out.Streamed
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -49,14 +69,116 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ServeConnection(h.config, w, r)
+	h.server.ServeHTTP(w, r)
 }
 
 type HermodConfig struct {
 	WSHandshakeTimeout time.Duration
+	// AllowedOrigins lists the origins (e.g. "https://example.com") that browsers can open WebSocket connections from,
+	// in addition to the server's own origin. If it's empty, connections from other origins are refused (earlier
+	// versions allowed them). "*" allows every origin, which is only safe if clients don't authenticate using cookies.
+	// Requests without an Origin header (i.e. from non-browser clients) are always allowed.
+	AllowedOrigins []string
+	// CheckOrigin, if set, is used instead of AllowedOrigins to decide whether to accept a WebSocket connection. It
+	// returns true if the request's Origin header is allowed.
+	CheckOrigin func(r *http.Request) bool
+	// Subprotocols are the WebSocket subprotocols supported by the server, in order of preference. If the client
+	// requests any of them, the first one in this list is selected.
+	Subprotocols []string
+	// ReadBufferSize and WriteBufferSize are the sizes of each WebSocket connection's I/O buffers, in bytes. They don't
+	// limit the size of messages. If they're 0, 4096 bytes are used.
+	ReadBufferSize, WriteBufferSize int
+	// EnableCompression lets clients negotiate permessage-deflate compression of WebSocket messages.
+	EnableCompression bool
+	// MaxMessageSize is the largest message (in bytes) the server will read from a client. A client that sends a larger
+	// message is disconnected. If it's 0, there's no limit on WebSocket connections (stream connections are always
+	// limited to transport.MaxStreamMessageSize).
+	MaxMessageSize int64
+
+	// PingInterval is how often to send keep-alive pings to each client. If it's 0, no pings are sent and idle connections
+	// are never detected.
+	PingInterval time.Duration
+	// PongTimeout is how long to wait for a pong (or any other message) after a ping is due before regarding the
+	// connection as dead and closing all of its sessions. Only used if PingInterval is set.
+	PongTimeout time.Duration
+	// ResumeGracePeriod is how long to keep sessions of Resumable endpoints running after their connection is lost,
+	// waiting for the client to resume them. If it's 0, sessions can't be resumed.
+	ResumeGracePeriod time.Duration
+	// ResumeBufferSize is the maximum number of messages kept for each resumable session, for re-sending to the client
+	// when it resumes the session. If the client missed more messages than this, resuming fails. Default: 256
+	ResumeBufferSize int
+	// UnaryInterceptors wrap every session of endpoints without streamed arguments, in order (i.e. the first interceptor
+	// is the outermost one).
+	UnaryInterceptors []UnaryInterceptor
+	// StreamInterceptors wrap every session of endpoints with a streamed argument, in order.
+	StreamInterceptors []StreamInterceptor
+
+	// MaxConnections is the maximum number of connections served at once. Further connections are sent a
+	// connection-level StatusResourceExhausted error and closed. If it's 0, there's no limit.
+	MaxConnections int
+	// MaxSessionsPerConnection is the maximum number of sessions open at once in a single connection. Further session
+	// requests are refused with a StatusResourceExhausted error. If it's 0, there's no limit.
+	MaxSessionsPerConnection int
+	// MaxConcurrentHandlers is the maximum number of handlers running at once across all connections (including the
+	// handlers of detached resumable sessions). Further session requests are refused with a StatusResourceExhausted
+	// error. If it's 0, there's no limit.
+	MaxConcurrentHandlers int
+	// MaxBytesInFlight is the maximum total size of Data messages that have been received from clients (across all
+	// connections) but not yet read by handlers. A Data message that would exceed it ends its session with a
+	// StatusResourceExhausted error. If it's 0, there's no limit.
+	MaxBytesInFlight int
+
+	// RateLimits limits how often clients can open sessions of each endpoint, by endpoint ID. Endpoints that aren't in
+	// the map use DefaultRateLimit, or aren't rate limited if it's nil.
+	RateLimits       map[uint16]*RateLimit
+	DefaultRateLimit *RateLimit
+
+	// Metrics receives metrics about the server's connections and sessions. See the metrics package.
+	Metrics metrics.Recorder
+	// Tracer records a span for each session, which is a child of the client's span if the client sent one in the
+	// session's metadata. See the tracing package.
+	Tracer tracing.Tracer
+	// Logger receives the server's log messages, which have "connection", "session", "endpoint" and "flag" attributes
+	// where relevant. If it's nil, slog.Default() is used.
+	Logger *slog.Logger
+
 	// AuthenticationConfig is optional, you can use it to enable a highly opinionated JWT-based authentication system.
-	// If you want anything custom, you'll need to build it on your own for now!
 	AuthenticationConfig *HermodAuthenticationConfig
+	// Authenticator is optional, and verifies clients' credentials in place of AuthenticationConfig. Use it for
+	// anything other than JWTs, e.g. APIKeyAuthenticator or MTLSAuthenticator.
+	Authenticator Authenticator
+}
+
+// metrics returns the Recorder that metrics should be sent to, which is metrics.Discard if none has been set.
+func (config *HermodConfig) metrics() metrics.Recorder {
+	if config.Metrics == nil {
+		return metrics.Discard
+	}
+	return config.Metrics
+}
+
+// logger returns the Logger that log messages should be sent to, which is slog.Default() if none has been set.
+func (config *HermodConfig) logger() *slog.Logger {
+	if config.Logger == nil {
+		return slog.Default()
+	}
+	return config.Logger
+}
+
+// tracer returns the Tracer that spans should be sent to, which is tracing.Noop if none has been set.
+func (config *HermodConfig) tracer() tracing.Tracer {
+	if config.Tracer == nil {
+		return tracing.Noop
+	}
+	return config.Tracer
+}
+
+// spanName returns the name of the spans recorded for sessions of endpoint.
+func spanName(endpoint *Endpoint) string {
+	if endpoint.Path == "" || endpoint.Service == nil {
+		return fmt.Sprintf("hermod endpoint %d", endpoint.Id)
+	}
+	return endpoint.Service.Name + "/" + strings.TrimPrefix(endpoint.Path, "/")
 }
 
 type HermodHTTPConfig struct {
@@ -72,15 +194,20 @@ type HermodHTTPConfig struct {
 	Path string
 }
 
-// StartServer starts a full HTTP server which responds to WebSocket connections at
-// HermodConfig.Path
+// StartServer starts a full HTTP server which responds to WebSocket connections at HermodHTTPConfig.Path, using
+// DefaultServer's endpoints. If config is nil, DefaultServer's config is used.
 func StartServer(addr string, config *HermodConfig, httpConfig *HermodHTTPConfig) error {
-	if config == nil {
-		config = &HermodConfig{
-			WSHandshakeTimeout: 10 * time.Second,
-		}
-	}
+	return DefaultServer.withConfig(config).ListenAndServe(addr, httpConfig)
+}
+
+// Shutdown gracefully shuts down DefaultServer, including servers started with StartServer. See Server.Shutdown.
+func Shutdown(ctx context.Context) error {
+	return DefaultServer.Shutdown(ctx)
+}
 
+// ListenAndServe starts a full HTTP server which responds to WebSocket connections at HermodHTTPConfig.Path. It blocks
+// until the HTTP server fails, or until the server is shut down (see Shutdown), after which it returns ErrServerClosed.
+func (server *Server) ListenAndServe(addr string, httpConfig *HermodHTTPConfig) error {
 	if httpConfig == nil {
 		httpConfig = &HermodHTTPConfig{
 			Path: "/hermod",
@@ -90,23 +217,31 @@ func StartServer(addr string, config *HermodConfig, httpConfig *HermodHTTPConfig
 		}
 	}
 
-	server := &http.Server{
+	httpServer := &http.Server{
 		Handler: &handler{
-			config: config,
+			server: server,
 			path:   httpConfig.Path,
 		},
 		Addr:      addr,
 		TLSConfig: httpConfig.TLSConfig,
 	}
+	if !server.connections.addListener(httpServer) {
+		return ErrServerClosed
+	}
+	defer server.connections.removeListener(httpServer)
+
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
 	if httpConfig.UseWSS {
-		err = server.ServeTLS(lis, httpConfig.CertFile, httpConfig.KeyFile)
+		err = httpServer.ServeTLS(lis, httpConfig.CertFile, httpConfig.KeyFile)
 	} else {
-		err = server.Serve(lis)
+		err = httpServer.Serve(lis)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return ErrServerClosed
 	}
 	if err != nil {
 		return err
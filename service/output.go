@@ -0,0 +1,261 @@
+package service
+
+import (
+	"crypto/rand"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/metrics"
+	"github.com/palkerecsenyi/hermod/tracing"
+	"sync"
+	"time"
+)
+
+// sessionOutput sends a session's outgoing frames to the connection it's attached to. Sessions of Resumable endpoints
+// can be detached from a lost connection and attached to a new one, so they also keep their most recent messages to
+// send again once they've been resumed.
+type sessionOutput struct {
+	sync.Mutex
+	endpointId uint16
+	session    *sessionData
+	store      *resumableSessionStore
+
+	// res, sessions and sessionId identify the connection the session is attached to. res is nil while a resumable
+	// session is detached.
+	res       *Response
+	sessions  *connectionSessions
+	sessionId uint32
+	// metrics records the messages sent on the session
+	metrics metrics.Recorder
+
+	// the remaining fields are only used if the session is resumable (i.e. if token is set)
+	token       []byte
+	sequence    uint32
+	buffer      []framing.MessageFrame
+	bufferSize  int
+	gracePeriod time.Duration
+	// final is the last frame of the session (a Close or an error), kept if the session ends while it's detached
+	final  func(sessionId uint32) []byte
+	expiry *time.Timer
+}
+
+const defaultResumeBufferSize = 256
+
+// makeResumable generates a resume token for the session, and keeps the session available for resumption in store until
+// it finishes.
+func (out *sessionOutput) makeResumable(store *resumableSessionStore, config *HermodConfig) ([]byte, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+
+	out.Lock()
+	out.store = store
+	out.token = token
+	out.gracePeriod = config.ResumeGracePeriod
+	out.bufferSize = config.ResumeBufferSize
+	if out.bufferSize <= 0 {
+		out.bufferSize = defaultResumeBufferSize
+	}
+	out.Unlock()
+
+	store.add(token, out)
+	return token, nil
+}
+
+func (out *sessionOutput) resumable() bool {
+	out.Lock()
+	defer out.Unlock()
+	return out.token != nil
+}
+
+// forget stops the session from being resumed. out must be locked.
+func (out *sessionOutput) forget() {
+	if out.token == nil {
+		return
+	}
+
+	if out.expiry != nil {
+		out.expiry.Stop()
+		out.expiry = nil
+	}
+
+	out.store.remove(out.token)
+}
+
+// sendData sends a Data frame containing data. If the session is resumable, the frame is given a sequence number and
+// kept in case it needs to be sent again.
+func (out *sessionOutput) sendData(data []byte) {
+	out.Lock()
+	defer out.Unlock()
+
+	frame := framing.MessageFrame{
+		EndpointId: out.endpointId,
+		Flag:       framing.Data,
+		Data:       data,
+	}
+
+	if out.token != nil {
+		out.sequence += 1
+		frame.Flag |= framing.DataSequence
+		frame.Sequence = out.sequence
+
+		out.buffer = append(out.buffer, frame)
+		if len(out.buffer) > out.bufferSize {
+			out.buffer = out.buffer[len(out.buffer)-out.bufferSize:]
+		}
+	}
+
+	if out.res == nil {
+		return
+	}
+
+	frame.SessionId = out.sessionId
+	encoded := frame.Encode()
+	out.res.Send(&encoded)
+	out.metrics.MessageSent(out.endpointId, len(data))
+	out.session.span.AddEvent(tracing.MessageEvent, tracing.Message(true, len(data))...)
+}
+
+// sendControl sends a frame that isn't part of the session's output (like a TokenExpiring warning), encoded for the
+// current Session ID. It's dropped if the session is detached.
+func (out *sessionOutput) sendControl(encode func(sessionId uint32) []byte) {
+	out.Lock()
+	defer out.Unlock()
+
+	if out.res == nil {
+		return
+	}
+
+	encoded := encode(out.sessionId)
+	out.res.Send(&encoded)
+}
+
+// sendFinal sends the frame that ends the session (a Close or an error frame), encoded for the current Session ID. If
+// the session is detached, the frame is kept until the client resumes the session. Only the first final frame is kept.
+func (out *sessionOutput) sendFinal(encode func(sessionId uint32) []byte) {
+	out.Lock()
+	defer out.Unlock()
+
+	if out.res == nil {
+		if out.final == nil {
+			out.final = encode
+		}
+		return
+	}
+
+	encoded := encode(out.sessionId)
+	out.res.Send(&encoded)
+	out.forget()
+}
+
+// end removes the session from the connection it's attached to (if any), once its handler has returned.
+func (out *sessionOutput) end() {
+	out.Lock()
+	sessions, sessionId, attached := out.sessions, out.sessionId, out.res != nil
+	out.Unlock()
+
+	if attached {
+		// if there's an error, the session has probably been manually closed elsewhere
+		_ = sessions.endSession(sessionId)
+	}
+}
+
+// detach is called when the connection the session is attached to has been lost. The session keeps running for the
+// grace period, after which it's ended unless it has been resumed.
+func (out *sessionOutput) detach(sessions *connectionSessions, sessionId uint32) {
+	out.Lock()
+	defer out.Unlock()
+
+	// the session may have already been resumed on another connection
+	if out.res == nil || out.sessions != sessions || out.sessionId != sessionId {
+		return
+	}
+
+	out.res = nil
+	out.expiry = time.AfterFunc(out.gracePeriod, out.expire)
+}
+
+func (out *sessionOutput) expire() {
+	out.Lock()
+	if out.res != nil {
+		out.Unlock()
+		return
+	}
+	out.forget()
+	out.Unlock()
+
+	out.session.cancel()
+	out.session.closeInput()
+}
+
+// attach moves the session to a new connection, acknowledges the resume request, and sends any messages the client
+// missed (followed by the session's final frame, if it has already ended).
+func (out *sessionOutput) attach(res *Response, sessions *connectionSessions, request *framing.ResumeFrame) error {
+	out.Lock()
+	defer out.Unlock()
+
+	if request.EndpointId != out.endpointId {
+		return framing.Errorf(framing.StatusNotFound, "session belongs to endpoint %d", out.endpointId)
+	}
+
+	if request.LastSequence > out.sequence {
+		return framing.Errorf(framing.StatusOutOfRange, "message %d hasn't been sent yet", request.LastSequence)
+	}
+
+	if missed := out.sequence - request.LastSequence; missed > uint32(len(out.buffer)) {
+		return framing.Errorf(framing.StatusDataLoss, "%d messages were missed but only %d were kept", missed, len(out.buffer))
+	}
+
+	sessionId, err := sessions.adoptSession(out.session)
+	if err != nil {
+		return err
+	}
+
+	// the session may still be attached to a connection that hasn't been noticed to be dead yet
+	if out.res != nil {
+		out.sessions.detachSession(out.sessionId, out.session)
+	}
+
+	if out.expiry != nil {
+		out.expiry.Stop()
+		out.expiry = nil
+	}
+
+	out.res = res
+	out.sessions = sessions
+	out.sessionId = sessionId
+
+	ack := framing.SessionFrame{
+		EndpointId: request.EndpointId,
+		ClientId:   request.ClientId,
+	}
+	res.Send(ack.AckWithResumeToken(sessionId, out.token))
+
+	// messages the client has received don't need to be kept anymore
+	missed := out.buffer[len(out.buffer)-int(out.sequence-request.LastSequence):]
+	out.buffer = missed
+	for _, frame := range missed {
+		frame.SessionId = sessionId
+		encoded := frame.Encode()
+		res.Send(&encoded)
+	}
+
+	if out.final != nil {
+		encoded := out.final(sessionId)
+		res.Send(&encoded)
+		out.forget()
+		_ = sessions.endSession(sessionId)
+	}
+
+	return nil
+}
+
+// resumeSession attaches the session identified by request.Token to the connection.
+func (c *connectionSessions) resumeSession(store *resumableSessionStore, res *Response, request *framing.ResumeFrame) error {
+	out, ok := store.get(request.Token)
+	if !ok {
+		return framing.NewStatus(framing.StatusNotFound, "session can't be resumed")
+	}
+
+	return out.attach(res, c, request)
+}
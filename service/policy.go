@@ -0,0 +1,146 @@
+package service
+
+import (
+	"fmt"
+	"github.com/palkerecsenyi/hermod/framing"
+)
+
+// AuthMode decides whether clients must be authenticated to use an endpoint.
+type AuthMode int
+
+const (
+	// AuthNone doesn't check authentication at all, leaving it up to the handler.
+	AuthNone AuthMode = iota
+	// AuthOptional lets clients use the endpoint without authenticating, but authenticated clients must still have
+	// the policy's scopes and roles.
+	AuthOptional
+	// AuthRequired refuses sessions from clients that haven't authenticated, or that don't have the policy's scopes and
+	// roles.
+	AuthRequired
+)
+
+func (mode AuthMode) String() string {
+	switch mode {
+	case AuthNone:
+		return "none"
+	case AuthOptional:
+		return "optional"
+	case AuthRequired:
+		return "required"
+	}
+	return "unknown"
+}
+
+// AuthPolicy describes who can use an endpoint. It's declared in YAML using the endpoint's `auth`, `scopes` and `roles`
+// fields, and enforced by the server before the handler (or any interceptor) runs. Sessions that don't satisfy it are
+// refused with a StatusPermissionDenied error.
+type AuthPolicy struct {
+	Mode AuthMode
+	// Scopes and Roles must all be held by the client's token. See AuthAPI.Scopes and AuthAPI.Roles.
+	Scopes []string
+	Roles  []string
+}
+
+// check returns an error if a session authenticated with auth (which is nil if the client hasn't authenticated)
+// doesn't satisfy the policy.
+func (policy *AuthPolicy) check(auth *AuthAPI) error {
+	if policy.Mode == AuthNone {
+		return nil
+	}
+
+	if !auth.authenticated() {
+		if policy.Mode == AuthRequired {
+			return framing.NewStatus(framing.StatusPermissionDenied, "authentication required")
+		}
+		return nil
+	}
+
+	scopes, err := auth.Scopes()
+	if err != nil {
+		return framing.Errorf(framing.StatusPermissionDenied, "getting scopes: %s", err)
+	}
+	for _, scope := range policy.Scopes {
+		if !contains(scopes, scope) {
+			return framing.Errorf(framing.StatusPermissionDenied, "missing scope %q", scope)
+		}
+	}
+
+	roles, err := auth.Roles()
+	if err != nil {
+		return framing.Errorf(framing.StatusPermissionDenied, "getting roles: %s", err)
+	}
+	for _, role := range policy.Roles {
+		if !contains(roles, role) {
+			return framing.Errorf(framing.StatusPermissionDenied, "missing role %q", role)
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopedToken can be implemented by hydrated tokens (see HermodAuthenticationConfig.TokenHydrator) to provide the
+// token's scopes, instead of them being read from the JWT's claims.
+type ScopedToken interface {
+	Scopes() []string
+}
+
+// RoleToken can be implemented by hydrated tokens to provide the token's roles, instead of them being read from the
+// JWT's claims.
+type RoleToken interface {
+	Roles() []string
+}
+
+// authenticated returns true if the client has sent valid credentials. It's safe to call on a nil AuthAPI.
+func (api *AuthAPI) authenticated() bool {
+	if api == nil || api.authProvider == nil {
+		return false
+	}
+	return api.Identity() != nil
+}
+
+// Scopes returns the scopes held by the client. For JWTs, if the hydrated token implements ScopedToken, its scopes are
+// used. Otherwise, they're read from the JWT's "scope" claim (a space-separated string, as in RFC 8693) or "scp" claim
+// (a string or a list of strings).
+func (api *AuthAPI) Scopes() ([]string, error) {
+	identity := api.Identity()
+	if identity == nil {
+		return nil, fmt.Errorf("not authenticated")
+	}
+	return identity.Scopes, nil
+}
+
+// Roles returns the roles held by the client. For JWTs, if the hydrated token implements RoleToken, its roles are
+// used. Otherwise, they're read from the JWT's "roles" claim (a string or a list of strings).
+func (api *AuthAPI) Roles() ([]string, error) {
+	identity := api.Identity()
+	if identity == nil {
+		return nil, fmt.Errorf("not authenticated")
+	}
+	return identity.Roles, nil
+}
+
+// claimStrings converts a claim that's either a single string or a list of strings into a list.
+func claimStrings(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
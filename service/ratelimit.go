@@ -0,0 +1,160 @@
+package service
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitKey decides which clients share a rate limit bucket.
+type RateLimitKey int
+
+const (
+	// RateLimitByConnection gives each connection its own bucket.
+	RateLimitByConnection RateLimitKey = iota
+	// RateLimitBySubject gives each authenticated subject (see AuthAPI.Subject) its own bucket, shared between all of
+	// their connections. Sessions without a subject are limited by IP address instead.
+	RateLimitBySubject
+	// RateLimitByIP gives each IP address its own bucket. Since only the address of the direct peer is known, clients
+	// behind the same proxy share a bucket. If the transport doesn't know the address, each connection gets its own
+	// bucket.
+	RateLimitByIP
+)
+
+// RateLimit limits how often clients can open sessions of an endpoint, using a token bucket: each client can open up to
+// Burst sessions at once, after which they can open Rate sessions per second. Sessions opened above the limit are
+// refused with a StatusResourceExhausted error.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+	Key   RateLimitKey
+}
+
+// rateLimiterSweepInterval is how often buckets that have refilled completely are removed, since they're no different
+// to new buckets.
+const rateLimiterSweepInterval = time.Minute
+
+type rateLimitBucketKey struct {
+	endpoint uint16
+	// only one of connection and key is set, depending on the RateLimitKey and whether the client's address is known
+	connection *connectionSessions
+	key        string
+}
+
+type rateLimitBucket struct {
+	limit  *RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (bucket *rateLimitBucket) refill(now time.Time) {
+	earned := now.Sub(bucket.last).Seconds() * bucket.limit.Rate
+	bucket.tokens = math.Min(float64(bucket.limit.Burst), bucket.tokens+earned)
+	bucket.last = now
+}
+
+// rateLimiter keeps the rate limit buckets of every client, across all connections
+type rateLimiter struct {
+	sync.Mutex
+	buckets   map[rateLimitBucketKey]*rateLimitBucket
+	lastSweep time.Time
+}
+
+// allow takes a token from the session's bucket, returning false if there aren't any left.
+func (limiter *rateLimiter) allow(limit *RateLimit, info *SessionInfo, connection *connectionSessions) bool {
+	key := rateLimitBucketKey{
+		endpoint: info.Endpoint.Id,
+	}
+
+	switch limit.Key {
+	case RateLimitByConnection:
+		key.connection = connection
+	case RateLimitBySubject:
+		if info.Auth != nil {
+			key.key = info.Auth.Subject()
+		}
+		if key.key != "" {
+			key.key = "sub:" + key.key
+			break
+		}
+		fallthrough
+	case RateLimitByIP:
+		// if the transport doesn't know the client's address, every client would share a bucket, so each connection
+		// gets its own instead
+		if ip := remoteIP(info.RemoteAddr); ip != "" {
+			key.key = "ip:" + ip
+		} else {
+			key.connection = connection
+		}
+	}
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	now := time.Now()
+	limiter.sweep(now)
+
+	bucket, ok := limiter.buckets[key]
+	if !ok || bucket.limit != limit {
+		bucket = &rateLimitBucket{
+			limit:  limit,
+			tokens: float64(limit.Burst),
+			last:   now,
+		}
+		limiter.buckets[key] = bucket
+	}
+
+	bucket.refill(now)
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens -= 1
+	return true
+}
+
+// sweep removes full buckets, if it hasn't been done recently. limiter must be locked.
+func (limiter *rateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	limiter.lastSweep = now
+
+	for key, bucket := range limiter.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// removeConnection removes the buckets of a connection that has closed, since they can't be used again.
+func (limiter *rateLimiter) removeConnection(connection *connectionSessions) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	for key := range limiter.buckets {
+		if key.connection == connection {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// remoteIP strips the port from an address, if it has one.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// rateLimit returns the rate limit that applies to an endpoint, if any.
+func (config *HermodConfig) rateLimit(endpointId uint16) *RateLimit {
+	if limit, ok := config.RateLimits[endpointId]; ok {
+		return limit
+	}
+	return config.DefaultRateLimit
+}
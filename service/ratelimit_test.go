@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"github.com/palkerecsenyi/hermod/metrics"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func newTestConnection(limiter *rateLimiter) *connectionSessions {
+	sessions := newSessionsStruct(context.Background(), 0, metrics.NewMemory(), slog.Default(), limiter)
+	return &sessions
+}
+
+func TestRateLimitByIPWithoutAddress(t *testing.T) {
+	limiter := &rateLimiter{buckets: map[rateLimitBucketKey]*rateLimitBucket{}}
+	limit := &RateLimit{Rate: 0.001, Burst: 1, Key: RateLimitByIP}
+	info := &SessionInfo{Endpoint: &Endpoint{Id: 1}}
+
+	first, second := newTestConnection(limiter), newTestConnection(limiter)
+	if !limiter.allow(limit, info, first) {
+		t.Fatal("first session was refused")
+	}
+	if limiter.allow(limit, info, first) {
+		t.Error("second session on the same connection was allowed")
+	}
+
+	// connections without an address don't share a bucket
+	if !limiter.allow(limit, info, second) {
+		t.Error("session on another connection without an address was refused")
+	}
+
+	// but connections with the same IP do
+	info.RemoteAddr = "192.0.2.1:1234"
+	if !limiter.allow(limit, info, first) {
+		t.Fatal("first session from IP was refused")
+	}
+	info.RemoteAddr = "192.0.2.1:5678"
+	if limiter.allow(limit, info, second) {
+		t.Error("second session from the same IP was allowed")
+	}
+}
+
+func TestRateLimitRefills(t *testing.T) {
+	limiter := &rateLimiter{buckets: map[rateLimitBucketKey]*rateLimitBucket{}}
+	limit := &RateLimit{Rate: 50, Burst: 2}
+	info := &SessionInfo{Endpoint: &Endpoint{Id: 1}}
+	connection := newTestConnection(limiter)
+
+	for i := 0; i < 2; i++ {
+		if !limiter.allow(limit, info, connection) {
+			t.Fatalf("session %d within the burst was refused", i)
+		}
+	}
+	if limiter.allow(limit, info, connection) {
+		t.Fatal("session above the burst was allowed")
+	}
+
+	// a token is earned every 20ms
+	time.Sleep(30 * time.Millisecond)
+	if !limiter.allow(limit, info, connection) {
+		t.Error("session was refused after the bucket refilled")
+	}
+}
+
+func TestRateLimitBucketsRemovedWithConnection(t *testing.T) {
+	limiter := &rateLimiter{buckets: map[rateLimitBucketKey]*rateLimitBucket{}}
+	connectionLimit := &RateLimit{Rate: 1, Burst: 1}
+	ipLimit := &RateLimit{Rate: 1, Burst: 1, Key: RateLimitByIP}
+	info := &SessionInfo{Endpoint: &Endpoint{Id: 1}}
+
+	first, second := newTestConnection(limiter), newTestConnection(limiter)
+	limiter.allow(connectionLimit, info, first)
+	limiter.allow(connectionLimit, info, second)
+	limiter.allow(ipLimit, &SessionInfo{Endpoint: &Endpoint{Id: 2}, RemoteAddr: "192.0.2.1:1234"}, first)
+
+	first.endAllSessions()
+
+	if len(limiter.buckets) != 2 {
+		t.Fatalf("got %d buckets, want the other connection's bucket and the IP bucket", len(limiter.buckets))
+	}
+	for key := range limiter.buckets {
+		if key.connection == first {
+			t.Error("closed connection's bucket wasn't removed")
+		}
+	}
+}
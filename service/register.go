@@ -2,14 +2,43 @@ package service
 
 import (
 	"context"
+	"github.com/palkerecsenyi/hermod/framing"
 	"net/http"
 	"sync"
 )
 
+// Metadata is a set of key/value pairs attached to a session. See framing.Metadata.
+type Metadata = framing.Metadata
+
+// Status is a structured error with a status code and optional details. Return one from a handler (or pass it to
+// Response.SendError) to control the code the client receives. See framing.Status.
+type Status = framing.Status
+
+// StatusCode describes the category of a Status. See framing.StatusCode for the available codes.
+type StatusCode = framing.StatusCode
+
+// NewStatus creates a Status with the specified code and message.
+func NewStatus(code StatusCode, message string) *Status {
+	return framing.NewStatus(code, message)
+}
+
+// Errorf creates a Status with the specified code and a message formatted according to format.
+func Errorf(code StatusCode, format string, a ...any) *Status {
+	return framing.Errorf(code, format, a...)
+}
+
 type Request struct {
+	// Context is specific to the session. It's cancelled when the client closes the session, when the handler sends an
+	// error, when the connection closes, or when the client's deadline (if any) passes.
 	Context context.Context
 	Data    chan *[]byte
 	Headers http.Header
+	// Metadata contains the key/value pairs sent by the client when opening the session. It's never nil, but may be
+	// empty.
+	Metadata Metadata
+	// RemoteAddr is the network address of the client (usually "IP:port"), or an empty string if the transport doesn't
+	// know it.
+	RemoteAddr string
 
 	// Auth will be nil if authentication hasn't been set up in HermodConfig or if the WebSocket connection doesn't have
 	// an authentication session assigned to it (either because there was no initial Authorization header or no Hermod
@@ -20,24 +49,108 @@ type Request struct {
 type Response struct {
 	// you're not supposed to write concurrently to a WebSocket connection
 	sync.Mutex
-	sendFunction func(data *[]byte, error bool)
+	sendFunction  func(data *[]byte)
+	errorFunction func(status *Status)
+	info          *SessionInfo
+
+	trailers Metadata
+	// decodeFailed is set by SendDecodeError, so that the error is recorded as a metrics.ErrorDecode
+	decodeFailed bool
 }
 
 func (res *Response) Send(data *[]byte) {
 	res.Lock()
-	res.sendFunction(data, false)
-	res.Unlock()
+	defer res.Unlock()
+	res.sendFunction(data)
 }
 
+// SendError sends an error to the client. If err is (or wraps) a Status, its code and details are sent as-is. Otherwise,
+// the client receives a Status with the framing.StatusUnknown code.
+//
+// When called by a handler, the error isn't sent straight away. Instead, the session's Context is cancelled, and the
+// error is sent once the handler has returned, as if the handler had returned it. This means interceptors see it (and
+// can replace it) before the client does. Only the first error is kept, and the handler should return soon after
+// calling SendError.
 func (res *Response) SendError(err error) {
-	t := []byte(err.Error())
+	status := framing.StatusFromError(err)
+	res.Lock()
+	defer res.Unlock()
+	res.errorFunction(status)
+}
+
+// SendDecodeError sends an error to the client like SendError, for when an incoming message couldn't be decoded. It's
+// recorded as a metrics.ErrorDecode rather than a handler error. Generated code does this automatically.
+func (res *Response) SendDecodeError(err error) {
 	res.Lock()
-	res.sendFunction(&t, true)
+	res.decodeFailed = true
 	res.Unlock()
+
+	res.SendError(err)
+}
+
+// Recover must be deferred directly by goroutines that run (part of) a handler, other than the one the handler was
+// called in. If the goroutine panics, it recovers and sends an Internal error to the client, like a panic in the
+// handler itself would. Generated code does this automatically.
+func (res *Response) Recover() {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	res.SendError(handlerPanicked(res.info, recovered))
 }
 
-var endpointRegistrations = map[uint16]func(*Request, *Response){}
+// SetTrailer sets a key/value pair that will be sent to the client as trailing metadata when the session closes.
+func (res *Response) SetTrailer(key, value string) {
+	res.Lock()
+	defer res.Unlock()
+
+	if res.trailers == nil {
+		res.trailers = Metadata{}
+	}
+	res.trailers.Set(key, value)
+}
+
+func (res *Response) failedToDecode() bool {
+	res.Lock()
+	defer res.Unlock()
+	return res.decodeFailed
+}
+
+func (res *Response) getTrailers() Metadata {
+	res.Lock()
+	defer res.Unlock()
+	return res.trailers
+}
+
+type endpointRegistration struct {
+	handler   func(*Request, *Response)
+	endpoint  Endpoint
+	resumable bool
+}
+
+// EndpointOption configures how sessions of an endpoint are handled. Options are passed to Server.RegisterEndpoint.
+type EndpointOption func(registration *endpointRegistration)
+
+// Resumable lets clients resume the endpoint's sessions on a new connection if their connection is lost, without
+// restarting the handler. The server keeps the most recent messages sent by the handler for
+// HermodConfig.ResumeGracePeriod, and sends the ones the client missed once it resumes the session. Since the handler
+// keeps running while the client is disconnected, its context isn't derived from the connection's.
+func Resumable() EndpointOption {
+	return func(registration *endpointRegistration) {
+		registration.resumable = true
+	}
+}
+
+// Describe tells the server what the endpoint looks like, letting interceptors see its path and whether it's unary or
+// streamed. Generated code always describes endpoints. The endpoint's Id is set automatically.
+func Describe(endpoint Endpoint) EndpointOption {
+	return func(registration *endpointRegistration) {
+		registration.endpoint = endpoint
+	}
+}
 
-func RegisterEndpoint(id uint16, handler func(request *Request, response *Response)) {
-	endpointRegistrations[id] = handler
+// RegisterEndpoint registers a handler with DefaultServer. See Server.RegisterEndpoint.
+func RegisterEndpoint(id uint16, handler func(request *Request, response *Response), options ...EndpointOption) {
+	DefaultServer.RegisterEndpoint(id, handler, options...)
 }
@@ -1,91 +1,198 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"github.com/palkerecsenyi/hermod/encoder"
 	"github.com/palkerecsenyi/hermod/framing"
-	"log"
-	"net/url"
+	"github.com/palkerecsenyi/hermod/metrics"
+	"github.com/palkerecsenyi/hermod/tracing"
+	"net/http"
+	"runtime/debug"
+	"time"
 )
 
-func serveWsConnection(req *Request, res *Response, query url.Values, config *HermodConfig) {
-	// sessions are specific to a particular WS connection
-	sessions := newSessionsStruct()
+// serveSessions handles the messages sent over a connection. r is the HTTP request that was upgraded to the connection,
+// or nil if there wasn't one.
+func (server *Server) serveSessions(sessions *connectionSessions, req *Request, res *Response, r *http.Request) {
+	config := server.Config
+	recorder := config.metrics()
+	logger := sessions.logger
+	defer sessions.endAllSessions()
 
-	if authQuery := query.Get("token"); authQuery != "" {
-		api, err := setupRequestAuthentication(authQuery, config)
-		if err != nil {
-			res.SendError(err)
+	// a bug in handling one connection's messages shouldn't take down the whole server, so the connection is closed
+	// instead
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
 			return
 		}
 
+		logger.Error("panic while serving connection", "panic", recovered, "stack", string(debug.Stack()))
+		res.SendError(framing.NewStatus(framing.StatusInternal, "internal error"))
+	}()
+
+	// messages are handled one at a time, so only the size of the current message counts towards the bytes in flight
+	inFlight := 0
+	defer func() {
+		server.bytesInFlight.release(inFlight)
+	}()
+
+	// the connection's token can be refreshed by sending an Authentication frame before it expires
+	warnExpiring := func(remaining time.Duration) {
+		frame := framing.TokenExpiringFrame{
+			EndpointId: framing.ConnectionEndpoint,
+			Remaining:  remaining,
+		}
+		encoded := frame.Encode()
+		res.Send(&encoded)
+	}
+	defer func() {
+		if req.Auth != nil {
+			req.Auth.stop()
+		}
+	}()
+
+	// authenticators are run even without a token, since they might use the HTTP request itself (e.g. its TLS client
+	// certificate)
+	var token []byte
+	if r != nil {
+		token = []byte(r.URL.Query().Get("token"))
+	}
+	api, err := authenticate(req.Context, token, r, config)
+	if err != nil && !errors.Is(err, ErrNoCredentials) {
+		recorder.Error(metrics.ErrorAuth, 0)
+		res.SendError(err)
+		return
+	}
+	if api != nil {
 		req.Auth = api
+		req.Auth.watchExpiry(warnExpiring)
 	}
 
 	var _data *[]byte
 	for {
+		server.bytesInFlight.release(inFlight)
+		inFlight = 0
+
 		select {
 		case <-req.Context.Done():
 			return
 		case _data = <-req.Data:
 			data := *_data
+			if len(data) < 3 {
+				recorder.Error(metrics.ErrorDecode, 0)
+				res.SendError(framing.Errorf(framing.StatusInvalidArgument, "message is too short (%d bytes)", len(data)))
+				return
+			}
 
 			frame := framing.MessageFrame{}
 
 			frame.EndpointId = encoder.SliceToU16(data[0:2])
-			endpoint, ok := endpointRegistrations[frame.EndpointId]
+			registration, ok := server.endpoints.get(frame.EndpointId)
 			if !ok && frame.EndpointId != framing.AuthenticationEndpoint {
-				res.SendError(fmt.Errorf("endpoint %d not found", frame.EndpointId))
+				recorder.Error(metrics.ErrorEndpointNotFound, frame.EndpointId)
+				res.SendError(framing.Errorf(framing.StatusNotFound, "endpoint %d not found", frame.EndpointId))
 				return
 			}
 
 			frame.Flag = data[2]
-			if frame.Flag == framing.ClientSessionRequest || frame.Flag == framing.ClientSessionRequestWithAuth {
-				ack := framing.SessionFrame{}
-				ack.EndpointId = frame.EndpointId
+			if framing.BaseFlag(frame.Flag) == framing.ClientSessionRequest {
+				request, err := framing.DecodeSessionRequest(data)
+				if err != nil {
+					recorder.Error(metrics.ErrorDecode, frame.EndpointId)
+					res.SendError(err)
+					return
+				}
 
-				ack.ClientId = encoder.SliceToU32(data[3:7])
+				ack := framing.SessionFrame{
+					EndpointId: request.EndpointId,
+					ClientId:   request.ClientId,
+				}
 
-				var err error
-				frame.SessionId, err = sessions.createNewSession()
+				if server.connections.isClosed() {
+					errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, framing.NewStatus(framing.StatusUnavailable, "server is shutting down"))
+					res.Send(&errorFrame)
+					continue
+				}
+
+				if !server.handlers.acquire(1, config.MaxConcurrentHandlers) {
+					recorder.Error(metrics.ErrorLimit, ack.EndpointId)
+					errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, framing.NewStatus(framing.StatusResourceExhausted, "too many concurrent sessions"))
+					res.Send(&errorFrame)
+					continue
+				}
+				releaseHandler := func() {
+					server.handlers.release(1)
+				}
+
+				resumable := registration.resumable && config.ResumeGracePeriod > 0
+				frame.SessionId, err = sessions.createNewSession(res, request.EndpointId, resumable)
 				if err != nil {
-					errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, err.Error())
+					releaseHandler()
+					recorder.Error(metrics.ErrorLimit, ack.EndpointId)
+					errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, framing.StatusFromError(err))
 					res.Send(&errorFrame)
 					continue
 				}
 
-				if frame.Flag == framing.ClientSessionRequestWithAuth {
-					if len(data) == 7 {
-						errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, "expected token but none specified")
-						res.Send(&errorFrame)
-						continue
+				if request.Flag&framing.SessionRequestAuth != 0 {
+					api, err := authenticate(req.Context, []byte(request.Token), r, config)
+					if errors.Is(err, ErrNoCredentials) {
+						err = fmt.Errorf("expected token but none specified")
 					}
 
-					token := string(data[7:])
-					if token == "" {
-						errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, "token was empty")
-						res.Send(&errorFrame)
-						continue
+					if err == nil {
+						err = sessions.setSessionAuth(frame.SessionId, api.authProvider)
 					}
 
-					var api *AuthAPI
-					api, err = setupRequestAuthentication(token, config)
 					if err != nil {
-						errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, err.Error())
+						releaseHandler()
+						recorder.Error(metrics.ErrorAuth, ack.EndpointId)
+						_ = sessions.endSession(frame.SessionId)
+						errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, framing.NewStatus(framing.StatusUnauthenticated, err.Error()))
 						res.Send(&errorFrame)
 						continue
 					}
+				}
 
-					err = sessions.setSessionAuth(frame.SessionId, api.authProvider)
+				if resumable {
+					sd, _ := sessions.getSessionData(frame.SessionId)
+					token, err := sd.output.makeResumable(server.resumable, config)
 					if err != nil {
-						errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, err.Error())
+						releaseHandler()
+						_ = sessions.endSession(frame.SessionId)
+						errorFrame := framing.CreateErrorClient(ack.EndpointId, ack.ClientId, framing.Errorf(framing.StatusInternal, "generating resume token: %s", err))
 						res.Send(&errorFrame)
 						continue
 					}
+
+					res.Send(ack.AckWithResumeToken(frame.SessionId, token))
+				} else {
+					res.Send(ack.Ack(frame.SessionId))
 				}
 
-				res.Send(ack.Ack(frame.SessionId))
-				sessions.initiateNewSession(req, res, frame, endpoint)
+				sessions.initiateNewSession(req, res, frame, request, registration, server, releaseHandler)
+				continue
+			}
+
+			if frame.Flag == framing.ResumeSession {
+				request, err := framing.DecodeResumeFrame(data)
+				if err != nil {
+					recorder.Error(metrics.ErrorDecode, frame.EndpointId)
+					res.SendError(err)
+					return
+				}
+
+				if server.connections.isClosed() {
+					err = framing.NewStatus(framing.StatusUnavailable, "server is shutting down")
+				} else {
+					err = sessions.resumeSession(server.resumable, res, request)
+				}
+				if err != nil {
+					errorFrame := framing.CreateErrorClient(request.EndpointId, request.ClientId, framing.StatusFromError(err))
+					res.Send(&errorFrame)
+				}
 				continue
 			}
 
@@ -95,20 +202,40 @@ func serveWsConnection(req *Request, res *Response, query url.Values, config *He
 					return
 				}
 
-				token := string(data[3:])
-				api, err := setupRequestAuthentication(token, config)
+				// if the connection has already been authenticated, the token is replaced in place, so that sessions
+				// using the old one carry on with the new one
+				token := data[3:]
+				var err error
+				if req.Auth != nil {
+					err = req.Auth.verifyAndStoreToken(req.Context, token)
+				} else {
+					req.Auth, err = authenticate(req.Context, token, r, config)
+				}
 				if err != nil {
+					recorder.Error(metrics.ErrorAuth, 0)
+
+					// if the old token is still valid, the connection carries on using it, and the client can try again
+					if req.Auth != nil && req.Auth.Identity() != nil {
+						errorFrame := framing.CreateErrorClient(framing.AuthenticationEndpoint, 0, framing.StatusFromError(err))
+						res.Send(&errorFrame)
+						continue
+					}
+
 					res.SendError(err)
 					return
 				}
+				req.Auth.watchExpiry(warnExpiring)
 
-				req.Auth = api
-
-				ackFrame := framing.NewAuthenticationAck(token)
+				ackFrame := framing.NewAuthenticationAck(string(token))
 				res.Send(ackFrame.Encode())
 				continue
 			}
 
+			if len(data) < 7 {
+				recorder.Error(metrics.ErrorDecode, frame.EndpointId)
+				res.SendError(framing.Errorf(framing.StatusInvalidArgument, "message is too short (%d bytes)", len(data)))
+				return
+			}
 			frame.SessionId = encoder.SliceToU32(data[3:7])
 
 			if frame.Flag == framing.Close {
@@ -119,21 +246,38 @@ func serveWsConnection(req *Request, res *Response, query url.Values, config *He
 
 			sd, err := sessions.getSessionData(frame.SessionId)
 			if err != nil {
-				errorFrame := framing.CreateErrorSession(frame.EndpointId, frame.SessionId, err.Error())
+				errorFrame := framing.CreateErrorSession(frame.EndpointId, frame.SessionId, framing.NewStatus(framing.StatusNotFound, err.Error()))
 				res.Send(&errorFrame)
 				continue
 			}
 
+			if frame.Flag == framing.HalfClose {
+				sd.closeInput()
+				continue
+			}
+
 			if frame.Flag == framing.Data {
 				encodedUnit := data[7:]
 				if len(encodedUnit) == 0 {
-					log.Println("received malformed message with unit size 0")
+					logger.Warn("received malformed message with unit size 0", "endpoint", frame.EndpointId, "session", frame.SessionId)
+					continue
+				}
+
+				// the client can't be told to resend the message, so the session can't carry on without it
+				if !server.bytesInFlight.acquire(len(encodedUnit), config.MaxBytesInFlight) {
+					recorder.Error(metrics.ErrorLimit, frame.EndpointId)
+					_ = sessions.endSession(frame.SessionId)
+					errorFrame := framing.CreateErrorSession(frame.EndpointId, frame.SessionId, framing.NewStatus(framing.StatusResourceExhausted, "too many bytes in flight"))
+					res.Send(&errorFrame)
 					continue
 				}
+				inFlight = len(encodedUnit)
+				recorder.MessageReceived(frame.EndpointId, len(encodedUnit))
+				sd.span.AddEvent(tracing.MessageEvent, tracing.Message(false, len(encodedUnit))...)
 
-				sd.channel <- &encodedUnit
+				sd.deliver(&encodedUnit)
 			} else {
-				log.Printf("unrecognised flag %b\n", frame.Flag)
+				logger.Warn("unrecognised flag", "endpoint", frame.EndpointId, "session", frame.SessionId, "flag", frame.Flag)
 			}
 		}
 	}
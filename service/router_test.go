@@ -0,0 +1,207 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/transport"
+	"testing"
+	"time"
+)
+
+// serveAuthenticated serves a connection authenticated using API keys, returning the client's end of it.
+func serveAuthenticated(t *testing.T, keys map[string]Identity) transport.Conn {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	server := NewServer(&HermodConfig{
+		Authenticator: &APIKeyAuthenticator{Keys: keys},
+	})
+	serverConn, clientConn := transport.Pipe()
+	go server.ServeConn(ctx, serverConn)
+	return clientConn
+}
+
+// receive returns the next message from conn, ignoring any TokenExpiring messages.
+func receive(t *testing.T, conn transport.Conn) (transport.MessageType, []byte) {
+	t.Helper()
+
+	type response struct {
+		messageType transport.MessageType
+		message     []byte
+		err         error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		for {
+			messageType, message, err := conn.ReadMessage()
+			// warnings about the token expiring can arrive at any time
+			if err == nil && len(message) >= 3 && message[2] == framing.TokenExpiring {
+				continue
+			}
+			responses <- response{messageType, message, err}
+			return
+		}
+	}()
+
+	select {
+	case r := <-responses:
+		if r.err != nil {
+			t.Fatalf("reading message: %s", r.err)
+		}
+		return r.messageType, r.message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return 0, nil
+	}
+}
+
+// sendToken sends an Authentication message, and returns the server's response.
+func sendToken(t *testing.T, conn transport.Conn, token string) (transport.MessageType, []byte) {
+	t.Helper()
+
+	frame := framing.AuthenticationFrame{Token: token}
+	if err := conn.WriteMessage(transport.BinaryMessage, frame.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	return receive(t, conn)
+}
+
+func expectTokenAccepted(t *testing.T, conn transport.Conn, token string) {
+	t.Helper()
+
+	_, message := sendToken(t, conn, token)
+	ack := framing.NewAuthenticationAck(token)
+	if !bytes.Equal(message, *ack.Encode()) {
+		t.Fatalf("got %v, want token %q to be acknowledged", message, token)
+	}
+}
+
+func expectTokenRejected(t *testing.T, conn transport.Conn, token string, code framing.StatusCode) {
+	t.Helper()
+
+	messageType, message := sendToken(t, conn, token)
+	if messageType != transport.BinaryMessage || len(message) < 7 {
+		t.Fatalf("got %q, want an error message", message)
+	}
+	if encoder.SliceToU16(message[0:2]) != framing.ConnectionEndpoint || framing.BaseFlag(message[2]) != framing.ErrorClientID || encoder.SliceToU32(message[3:7]) != 0 {
+		t.Fatalf("got %v, want an ErrorClientID message for the connection", message)
+	}
+
+	status, err := framing.DecodeError(message[2], message[7:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(t, status, code)
+}
+
+func TestRefreshWithDifferentSubjectKeepsConnection(t *testing.T) {
+	conn := serveAuthenticated(t, map[string]Identity{
+		"alice-1": {Subject: "alice"},
+		"alice-2": {Subject: "alice"},
+		"mallory": {Subject: "mallory"},
+	})
+
+	expectTokenAccepted(t, conn, "alice-1")
+	expectTokenRejected(t, conn, "mallory", framing.StatusPermissionDenied)
+	expectTokenRejected(t, conn, "invalid", framing.StatusUnknown)
+
+	// the connection is still open, with the original credentials
+	expectTokenAccepted(t, conn, "alice-2")
+}
+
+func TestRefreshWithoutSubject(t *testing.T) {
+	conn := serveAuthenticated(t, map[string]Identity{
+		"anonymous-1": {},
+		"anonymous-2": {},
+		"alice":       {Subject: "alice"},
+	})
+
+	expectTokenAccepted(t, conn, "anonymous-1")
+	expectTokenAccepted(t, conn, "anonymous-2")
+	expectTokenRejected(t, conn, "alice", framing.StatusPermissionDenied)
+	expectTokenAccepted(t, conn, "anonymous-1")
+}
+
+func TestFailedRefreshAfterExpiryClosesConnection(t *testing.T) {
+	conn := serveAuthenticated(t, map[string]Identity{
+		"alice":   {Subject: "alice", Expiry: time.Now().Add(20 * time.Millisecond)},
+		"mallory": {Subject: "mallory"},
+	})
+
+	expectTokenAccepted(t, conn, "alice")
+	time.Sleep(50 * time.Millisecond)
+
+	// there are no valid credentials left to carry on with
+	messageType, message := sendToken(t, conn, "mallory")
+	if messageType != transport.TextMessage {
+		t.Fatalf("got %v, want the connection to be closed with an error", message)
+	}
+}
+
+func TestFailedFirstAuthenticationClosesConnection(t *testing.T) {
+	conn := serveAuthenticated(t, map[string]Identity{
+		"alice": {Subject: "alice"},
+	})
+
+	messageType, message := sendToken(t, conn, "invalid")
+	if messageType != transport.TextMessage {
+		t.Fatalf("got %v, want the connection to be closed with an error", message)
+	}
+}
+
+// requestSession sends a session request for endpoint 1, and returns the server's response.
+func requestSession(t *testing.T, conn transport.Conn, clientId uint32) []byte {
+	t.Helper()
+
+	request := framing.SessionFrame{EndpointId: 1, Flag: framing.ClientSessionRequest, ClientId: clientId}
+	encoded, err := request.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.WriteMessage(transport.BinaryMessage, encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	_, message := receive(t, conn)
+	return message
+}
+
+func TestShutdownRefusesNewSessions(t *testing.T) {
+	server := NewServer(nil)
+	server.RegisterEndpoint(1, func(req *Request, res *Response) {
+		<-req.Context.Done()
+	})
+
+	serverConn, conn := transport.Pipe()
+	go server.ServeConn(context.Background(), serverConn)
+
+	// the open session stops the connection from being closed straight away
+	if ack := requestSession(t, conn, 1); framing.BaseFlag(ack[2]) != framing.ServerSessionAck {
+		t.Fatalf("got %v, want the session to be acknowledged", ack)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = server.Shutdown(ctx)
+	}()
+
+	_, goAway := receive(t, conn)
+	if _, err := framing.DecodeGoAwayFrame(goAway); err != nil {
+		t.Fatalf("got %v, want a GoAway message: %s", goAway, err)
+	}
+
+	message := requestSession(t, conn, 2)
+	if len(message) < 7 || framing.BaseFlag(message[2]) != framing.ErrorClientID || encoder.SliceToU32(message[3:7]) != 2 {
+		t.Fatalf("got %v, want an ErrorClientID message", message)
+	}
+	status, err := framing.DecodeError(message[2], message[7:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertStatus(t, status, framing.StatusUnavailable)
+}
@@ -1,17 +1,55 @@
 package service
 
 import (
-	"github.com/gorilla/websocket"
-	"log"
+	"context"
+	"github.com/palkerecsenyi/hermod/transport"
+	"log/slog"
+	"time"
 )
 
-func wsSendError(conn *websocket.Conn, err error) {
-	e := conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+func connSendError(logger *slog.Logger, conn transport.Conn, err error) {
+	e := conn.WriteMessage(transport.TextMessage, []byte(err.Error()))
 	if e != nil {
-		log.Println(e)
+		logger.Warn("failed to send connection error", "error", e)
 	}
 }
 
-func wsSendBinary(conn *websocket.Conn, data *[]byte) {
-	_ = conn.WriteMessage(websocket.BinaryMessage, *data)
+func connSendBinary(conn transport.Conn, data *[]byte) {
+	_ = conn.WriteMessage(transport.BinaryMessage, *data)
+}
+
+// connKeepAlive pings the client every interval until ctx ends, and sets a read deadline so that reads fail if no pong
+// (or other message) arrives within timeout of the next ping being due. It returns a function that must be called after
+// every successful read to extend the deadline. If interval is 0 or the connection doesn't support keep-alive, it's
+// disabled.
+func connKeepAlive(ctx context.Context, c transport.Conn, interval, timeout time.Duration) func() {
+	conn, ok := c.(transport.KeepAliveConn)
+	if interval <= 0 || !ok {
+		return func() {}
+	}
+
+	extendDeadline := func() {
+		_ = conn.SetReadDeadline(time.Now().Add(interval + timeout))
+	}
+	extendDeadline()
+	conn.SetPongHandler(extendDeadline)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := conn.Ping(time.Now().Add(timeout))
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return extendDeadline
 }
@@ -1,27 +1,40 @@
 package service
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"github.com/gorilla/websocket"
+	"github.com/palkerecsenyi/hermod/metrics"
+	"github.com/palkerecsenyi/hermod/transport"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
 )
 
 type handler struct {
-	config *HermodConfig
+	server *Server
 	path   string
 }
 
-// ServeConnection is made public to allow Hermod users to manually choose when to upgrade an HTTP connection to WebSocket/Hermod.
-// Pass in the same HermodConfig as with service.StartServer, as well as http.ResponseWriter and http.Request, and ServeConnection
-// will attempt to upgrade the HTTP connection to a WebSocket, and start responding to Hermod requests. ServeConnection will
-// continue blocking until the WebSocket connection closes (e.g. if the underlying http.Request's context ends)
-func ServeConnection(config *HermodConfig, w http.ResponseWriter, r *http.Request) {
+// ServeHTTP upgrades the HTTP connection to a WebSocket, and responds to Hermod requests until the WebSocket connection
+// closes (e.g. if the underlying http.Request's context ends). This lets a Server be used with an existing HTTP server,
+// alongside conventional HTTP endpoints.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if server.connections.isClosed() {
+		http.Error(w, "This Hermod server is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+
 	upgrader := websocket.Upgrader{
-		HandshakeTimeout: config.WSHandshakeTimeout,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		HandshakeTimeout:  server.Config.WSHandshakeTimeout,
+		ReadBufferSize:    server.Config.ReadBufferSize,
+		WriteBufferSize:   server.Config.WriteBufferSize,
+		Subprotocols:      server.Config.Subprotocols,
+		EnableCompression: server.Config.EnableCompression,
+		CheckOrigin:       server.Config.checkOrigin,
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -30,33 +43,126 @@ func ServeConnection(config *HermodConfig, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	server.serveConn(r.Context(), transport.NewWebSocketConn(conn), r)
+}
+
+// ServeConnection is made public to allow Hermod users to manually choose when to upgrade an HTTP connection to WebSocket/Hermod.
+// Pass in the same HermodConfig as with service.StartServer, as well as http.ResponseWriter and http.Request, and ServeConnection
+// will attempt to upgrade the HTTP connection to a WebSocket, and start responding to Hermod requests using DefaultServer's
+// endpoints. ServeConnection will continue blocking until the WebSocket connection closes (e.g. if the underlying
+// http.Request's context ends)
+func ServeConnection(config *HermodConfig, w http.ResponseWriter, r *http.Request) {
+	DefaultServer.withConfig(config).ServeHTTP(w, r)
+}
+
+// ServeConn responds to Hermod requests over an established connection of any transport, and blocks until the
+// connection closes or ctx ends. Since there's no HTTP request, Request.Headers are empty and clients can only
+// authenticate by sending an Authentication message.
+func (server *Server) ServeConn(ctx context.Context, conn transport.Conn) {
+	server.serveConn(ctx, conn, nil)
+}
+
+// ServeConn serves conn using DefaultServer's endpoints and the specified config. See Server.ServeConn.
+func ServeConn(ctx context.Context, config *HermodConfig, conn transport.Conn) {
+	DefaultServer.withConfig(config).ServeConn(ctx, conn)
+}
+
+// ServeListener accepts connections from listener (e.g. a TCP or Unix socket listener) and serves each of them using
+// length-prefixed messages (see transport.NewStreamConn). It blocks until listener fails or is closed. The listener is
+// closed when the server is shut down, after which ServeListener returns ErrServerClosed.
+func (server *Server) ServeListener(listener net.Listener) error {
+	if !server.connections.addListener(listener) {
+		return ErrServerClosed
+	}
+	defer server.connections.removeListener(listener)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if server.connections.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		go server.ServeConn(context.Background(), transport.NewStreamConn(conn))
+	}
+}
+
+// ServeListener serves listener using DefaultServer's endpoints and the specified config. See Server.ServeListener.
+func ServeListener(config *HermodConfig, listener net.Listener) error {
+	return DefaultServer.withConfig(config).ServeListener(listener)
+}
+
+// connectionIds is used to give each connection a unique ID, so that log messages about it can be correlated
+var connectionIds atomic.Uint64
+
+// serveConn serves conn until it closes. r is the HTTP request that was upgraded to conn, or nil if there wasn't one.
+func (server *Server) serveConn(parent context.Context, conn transport.Conn, r *http.Request) {
+	config := server.Config
+	logger := config.logger().With("connection", connectionIds.Add(1))
+
 	defer func() {
 		_ = conn.Close()
 	}()
 
-	ctx := r.Context()
+	// ctx is cancelled once the connection can no longer be read from, which ends every session within it
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
 	request := Request{
 		Context: ctx,
-		Headers: r.Header,
+		Headers: http.Header{},
 		Data:    make(chan *[]byte),
 	}
+	if r != nil {
+		request.Headers = r.Header
+	}
+	if addrConn, ok := conn.(transport.AddrConn); ok {
+		request.RemoteAddr = addrConn.RemoteAddr().String()
+	}
+	if limitConn, ok := conn.(transport.ReadLimitConn); ok && config.MaxMessageSize > 0 {
+		limitConn.SetReadLimit(config.MaxMessageSize)
+	}
 	response := Response{
-		sendFunction: func(data *[]byte, error bool) {
-			if error {
-				wsSendError(conn, errors.New(string(*data)))
-			} else {
-				wsSendBinary(conn, data)
-			}
+		sendFunction: func(data *[]byte) {
+			connSendBinary(conn, data)
+		},
+		errorFunction: func(status *Status) {
+			// connection-level errors are sent as plain text, so only the message is included
+			connSendError(logger, conn, errors.New(status.Message))
 		},
 	}
 
+	// sessions are specific to a particular connection
+	sessions := newSessionsStruct(ctx, config.MaxSessionsPerConnection, config.metrics(), logger, server.rateLimiter)
+	err := server.connections.add(conn, &servedConnection{sessions: &sessions, res: &response}, config.MaxConnections)
+	if err != nil {
+		if err != ErrServerClosed {
+			config.metrics().Error(metrics.ErrorLimit, 0)
+			logger.Warn("refused connection", "error", err)
+			connSendError(logger, conn, err)
+		}
+		return
+	}
+	defer server.connections.remove(conn)
+
+	config.metrics().ConnectionOpened()
+	defer config.metrics().ConnectionClosed()
+	logger.Debug("connection opened", "remote_addr", request.RemoteAddr)
+	defer logger.Debug("connection closed")
+
 	done := make(chan bool)
 	go func(c chan bool) {
-		serveWsConnection(&request, &response, r.URL.Query(), config)
-		c <- true
+		server.serveSessions(&sessions, &request, &response, r)
+		close(c)
 	}(done)
 
+	extendDeadline := connKeepAlive(ctx, conn, config.PingInterval, config.PongTimeout)
+
 	go func(r *Request) {
+		defer cancel()
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -66,24 +172,58 @@ func ServeConnection(config *HermodConfig, w http.ResponseWriter, r *http.Reques
 			default:
 				messageType, data, err := conn.ReadMessage()
 				if err != nil {
-					wsSendError(conn, errors.New("400: message could not be read"))
+					// there's no point trying to tell the client if the connection has timed out or closed
+					var netError net.Error
+					isTimeout := errors.As(err, &netError) && netError.Timeout()
+					if !isTimeout && !errors.Is(err, transport.ErrClosed) {
+						response.SendError(errors.New("400: message could not be read"))
+					}
 					return
 				}
+				extendDeadline()
 
 				// If the message is text-based (for some reason), assume it's base64-encoded
-				if messageType == websocket.TextMessage {
+				if messageType == transport.TextMessage {
 					data, err = base64.StdEncoding.DecodeString(string(data))
 					if err != nil {
-						wsSendError(conn, errors.New("400: base64-encoded message could not be read"))
+						response.SendError(errors.New("400: base64-encoded message could not be read"))
 						return
 					}
 				}
 
-				r.Data <- &data
+				select {
+				case r.Data <- &data:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}(&request)
 
 	<-done
-	close(request.Data)
+}
+
+// checkOrigin returns true if the WebSocket connection request came from an allowed origin (see
+// HermodConfig.AllowedOrigins).
+func (config *HermodConfig) checkOrigin(r *http.Request) bool {
+	if config.CheckOrigin != nil {
+		return config.CheckOrigin(r)
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(originURL.Host, r.Host)
 }
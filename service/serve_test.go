@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"no origin", nil, "", true},
+		{"same host", nil, "https://hermod.example", true},
+		{"same host, different case", nil, "https://HERMOD.example", true},
+		{"cross origin", nil, "https://evil.example", false},
+		{"different port", nil, "https://hermod.example:8080", false},
+		{"malformed origin", nil, "://", false},
+		{"allowed origin", []string{"https://other.example"}, "https://other.example", true},
+		{"other origin with allow list", []string{"https://other.example"}, "https://evil.example", false},
+		{"wildcard", []string{"*"}, "https://evil.example", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &HermodConfig{AllowedOrigins: test.allowed}
+			r := httptest.NewRequest(http.MethodGet, "https://hermod.example/hermod", nil)
+			if test.origin != "" {
+				r.Header.Set("Origin", test.origin)
+			}
+
+			if got := config.checkOrigin(r); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckOriginOverride(t *testing.T) {
+	config := &HermodConfig{
+		AllowedOrigins: []string{"*"},
+		CheckOrigin: func(r *http.Request) bool {
+			return false
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "https://hermod.example/hermod", nil)
+	if config.checkOrigin(r) {
+		t.Error("CheckOrigin wasn't used instead of AllowedOrigins")
+	}
+}
+
+func TestServeHTTPRefusesCrossOrigin(t *testing.T) {
+	server := httptest.NewServer(NewServer(&HermodConfig{}))
+	t.Cleanup(server.Close)
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	header := http.Header{"Origin": {"https://evil.example"}}
+	_, response, err := websocket.DefaultDialer.DialContext(context.Background(), url, header)
+	if err == nil {
+		t.Fatal("connection from another origin was accepted")
+	}
+	if response == nil || response.StatusCode != http.StatusForbidden {
+		t.Errorf("got response %v, want 403 Forbidden", response)
+	}
+
+	header = http.Header{"Origin": {server.URL}}
+	conn, _, err := websocket.DefaultDialer.DialContext(context.Background(), url, header)
+	if err != nil {
+		t.Fatalf("connection from the server's own origin was refused: %s", err)
+	}
+	_ = conn.Close()
+}
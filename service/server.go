@@ -0,0 +1,319 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/transport"
+	"io"
+	"sync"
+	"time"
+)
+
+// Server owns a set of endpoint handlers, the config used to serve them, and the connections being served. One process
+// can run several Servers with different handlers. Most users only need one, so DefaultServer is provided, and the
+// package-level functions (RegisterEndpoint, StartServer, ServeConnection, etc.) all use it.
+type Server struct {
+	// Config must not be modified while the server is serving connections.
+	Config *HermodConfig
+
+	// these are pointers so that copies of the server made by withConfig share them
+	endpoints   *endpointRegistry
+	resumable   *resumableSessionStore
+	connections *connectionSet
+	// handlers and bytesInFlight enforce HermodConfig.MaxConcurrentHandlers and HermodConfig.MaxBytesInFlight
+	handlers      *limiter
+	bytesInFlight *limiter
+	rateLimiter   *rateLimiter
+}
+
+// ErrServerClosed is returned by ListenAndServe and ServeListener once the server has been shut down or closed.
+var ErrServerClosed = errors.New("hermod: server closed")
+
+// DefaultServer is used by the package-level functions, and can be passed to generated Register<Endpoint>Handler
+// functions.
+var DefaultServer = NewServer(nil)
+
+// NewServer creates a Server without any endpoints. If config is nil, a default config is used.
+func NewServer(config *HermodConfig) *Server {
+	if config == nil {
+		config = &HermodConfig{
+			WSHandshakeTimeout: 10 * time.Second,
+			PingInterval:       30 * time.Second,
+			PongTimeout:        10 * time.Second,
+			ResumeGracePeriod:  30 * time.Second,
+		}
+	}
+
+	return &Server{
+		Config: config,
+		endpoints: &endpointRegistry{
+			endpoints: map[uint16]endpointRegistration{},
+		},
+		resumable: &resumableSessionStore{
+			sessions: map[string]*sessionOutput{},
+		},
+		connections: &connectionSet{
+			connections: map[transport.Conn]*servedConnection{},
+			listeners:   map[io.Closer]struct{}{},
+		},
+		handlers:      &limiter{},
+		bytesInFlight: &limiter{},
+		rateLimiter: &rateLimiter{
+			buckets: map[rateLimitBucketKey]*rateLimitBucket{},
+		},
+	}
+}
+
+// withConfig returns a copy of the server (sharing its endpoints, sessions and connections) that uses config instead,
+// unless config is nil. It's used by the package-level functions that take a config.
+func (server *Server) withConfig(config *HermodConfig) *Server {
+	if config == nil {
+		return server
+	}
+
+	s := *server
+	s.Config = config
+	return &s
+}
+
+// RegisterEndpoint sets the handler for an endpoint, replacing any existing handler. It's usually called by generated
+// Register<Endpoint>Handler functions. It's safe to call while the server is serving connections.
+func (server *Server) RegisterEndpoint(id uint16, handler func(request *Request, response *Response), options ...EndpointOption) {
+	registration := endpointRegistration{
+		handler: handler,
+	}
+	for _, option := range options {
+		option(&registration)
+	}
+	registration.endpoint.Id = id
+
+	server.endpoints.Lock()
+	defer server.endpoints.Unlock()
+	server.endpoints.endpoints[id] = registration
+}
+
+// Close stops the server from accepting any more connections, and immediately closes every listener and connection,
+// ending all sessions (including resumable ones). Use Shutdown to let sessions finish first. A closed server can't be
+// used again.
+func (server *Server) Close() {
+	for conn := range server.connections.close() {
+		_ = conn.Close()
+	}
+	server.resumable.endAll()
+}
+
+// shutdownPollInterval is how often Shutdown checks whether connections have finished their sessions
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown gracefully shuts the server down, e.g. during a rolling deploy. It stops accepting new connections (closing
+// every listener used with ListenAndServe or ServeListener) and new sessions, and sends a GoAway message to every
+// client, telling it to open any further sessions elsewhere. Each connection is closed once its sessions have
+// finished. If ctx ends first, the server is forcefully closed (see Close) and ctx's error is returned.
+func (server *Server) Shutdown(ctx context.Context) error {
+	connections := server.connections.close()
+
+	goAway := framing.GoAwayFrame{}
+	if deadline, ok := ctx.Deadline(); ok {
+		goAway.Timeout = time.Until(deadline)
+	}
+	encoded := goAway.Encode()
+	for _, served := range connections {
+		served.res.Send(&encoded)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if server.connections.closeIdle() {
+			server.resumable.endAll()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			server.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+type endpointRegistry struct {
+	sync.RWMutex
+	endpoints map[uint16]endpointRegistration
+}
+
+func (registry *endpointRegistry) get(id uint16) (endpointRegistration, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	registration, ok := registry.endpoints[id]
+	return registration, ok
+}
+
+// resumableSessionStore contains every resumable session that hasn't finished yet, by resume token
+type resumableSessionStore struct {
+	sync.Mutex
+	sessions map[string]*sessionOutput
+}
+
+func (store *resumableSessionStore) add(token []byte, out *sessionOutput) {
+	store.Lock()
+	defer store.Unlock()
+	store.sessions[string(token)] = out
+}
+
+func (store *resumableSessionStore) get(token []byte) (*sessionOutput, bool) {
+	store.Lock()
+	defer store.Unlock()
+
+	out, ok := store.sessions[string(token)]
+	return out, ok
+}
+
+func (store *resumableSessionStore) remove(token []byte) {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.sessions, string(token))
+}
+
+// endAll ends every resumable session, since they can't be resumed once the server has been shut down.
+func (store *resumableSessionStore) endAll() {
+	store.Lock()
+	outputs := make([]*sessionOutput, 0, len(store.sessions))
+	for _, out := range store.sessions {
+		outputs = append(outputs, out)
+	}
+	store.Unlock()
+
+	for _, out := range outputs {
+		out.Lock()
+		out.forget()
+		out.Unlock()
+
+		out.session.cancel()
+		out.session.closeInput()
+	}
+}
+
+// connectionSet contains every connection that's currently being served, and every listener accepting new ones. Once
+// it's been closed, no more connections or listeners can be added.
+type connectionSet struct {
+	sync.Mutex
+	connections map[transport.Conn]*servedConnection
+	listeners   map[io.Closer]struct{}
+	closed      bool
+}
+
+// servedConnection is what's needed to gracefully shut down a connection
+type servedConnection struct {
+	sessions *connectionSessions
+	// res is used to send messages to the connection, so that they aren't written concurrently with session messages
+	res *Response
+}
+
+// add adds conn to the set. It fails with ErrServerClosed if the set has been closed, or with a StatusResourceExhausted
+// error if there are already max connections (unless max is 0).
+func (set *connectionSet) add(conn transport.Conn, served *servedConnection, max int) error {
+	set.Lock()
+	defer set.Unlock()
+
+	if set.closed {
+		return ErrServerClosed
+	}
+	if max > 0 && len(set.connections) >= max {
+		return framing.NewStatus(framing.StatusResourceExhausted, "too many connections")
+	}
+	set.connections[conn] = served
+	return nil
+}
+
+func (set *connectionSet) remove(conn transport.Conn) {
+	set.Lock()
+	defer set.Unlock()
+	delete(set.connections, conn)
+}
+
+// addListener adds listener to the set, unless the set has been closed.
+func (set *connectionSet) addListener(listener io.Closer) bool {
+	set.Lock()
+	defer set.Unlock()
+
+	if set.closed {
+		return false
+	}
+	set.listeners[listener] = struct{}{}
+	return true
+}
+
+func (set *connectionSet) removeListener(listener io.Closer) {
+	set.Lock()
+	defer set.Unlock()
+	delete(set.listeners, listener)
+}
+
+// isClosed returns true once the server has started shutting down, after which new sessions must be refused.
+func (set *connectionSet) isClosed() bool {
+	set.Lock()
+	defer set.Unlock()
+	return set.closed
+}
+
+// close closes every listener and stops any more connections from being added. It returns the connections currently
+// being served.
+func (set *connectionSet) close() map[transport.Conn]*servedConnection {
+	set.Lock()
+	defer set.Unlock()
+
+	set.closed = true
+	for listener := range set.listeners {
+		_ = listener.Close()
+	}
+	set.listeners = map[io.Closer]struct{}{}
+
+	connections := make(map[transport.Conn]*servedConnection, len(set.connections))
+	for conn, served := range set.connections {
+		connections[conn] = served
+	}
+	return connections
+}
+
+// closeIdle closes every connection without any sessions, and returns true once there are no connections left.
+func (set *connectionSet) closeIdle() bool {
+	set.Lock()
+	defer set.Unlock()
+
+	for conn, served := range set.connections {
+		if served.sessions.count() == 0 {
+			_ = conn.Close()
+		}
+	}
+	return len(set.connections) == 0
+}
+
+// limiter keeps track of how much of a limited resource (like concurrent handlers) is being used across all connections
+type limiter struct {
+	sync.Mutex
+	used int
+}
+
+// acquire reserves n units of the resource, unless that would make the total exceed max. If max is 0, it always
+// succeeds.
+func (l *limiter) acquire(n, max int) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if max > 0 && l.used+n > max {
+		return false
+	}
+	l.used += n
+	return true
+}
+
+func (l *limiter) release(n int) {
+	l.Lock()
+	defer l.Unlock()
+	l.used -= n
+}
@@ -1,14 +1,26 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"github.com/palkerecsenyi/hermod/framing"
+	"github.com/palkerecsenyi/hermod/metrics"
+	"github.com/palkerecsenyi/hermod/tracing"
+	"log/slog"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func newSessionsStruct() connectionSessions {
+func newSessionsStruct(ctx context.Context, maxSessions int, recorder metrics.Recorder, logger *slog.Logger, limiter *rateLimiter) connectionSessions {
 	return connectionSessions{
-		sessions: map[uint32]sessionData{},
+		context:     ctx,
+		sessions:    map[uint32]*sessionData{},
+		maxSessions: maxSessions,
+		metrics:     recorder,
+		logger:      logger,
+		rateLimiter: limiter,
 	}
 }
 
@@ -17,43 +29,152 @@ func newSessionsStruct() connectionSessions {
 // for each endpoint function call (which occurs once for each session).
 type connectionSessions struct {
 	sync.RWMutex
-	sessions map[uint32]sessionData
+	// context is the connection's context, which each session's context is derived from
+	context  context.Context
+	sessions map[uint32]*sessionData
+	// maxSessions is the maximum number of sessions in the connection, or 0 if there's no limit
+	maxSessions int
+	// metrics receives metrics about the connection's sessions
+	metrics metrics.Recorder
+	// logger has the connection's ID as an attribute
+	logger *slog.Logger
+	// rateLimiter holds the connection's rate limit buckets, which are removed once the connection closes
+	rateLimiter *rateLimiter
+	// nextId is the Session ID to try next. IDs are assigned in order (wrapping around) so that they aren't reused
+	// straight away.
+	nextId uint32
 }
 
 type sessionData struct {
 	channel chan *[]byte
 	auth    *authProvider
+	output  *sessionOutput
+	// span records the session for tracing. It's set once the handler has been started.
+	span tracing.Span
+
+	// context is cancelled when the session ends for any reason (the client closing it, the handler returning or
+	// sending an error, or the connection closing)
+	context context.Context
+	cancel  context.CancelFunc
+
+	// channelMutex makes sure that channel can't be closed while a message is being delivered on it
+	channelMutex  sync.Mutex
+	channelClosed bool
 }
 
-func (c *connectionSessions) createNewSession() (uint32, error) {
-	c.Lock()
-	defer c.Unlock()
+// deliver sends data to the session's handler. It blocks until the handler reads it, or until the session ends.
+func (sd *sessionData) deliver(data *[]byte) {
+	sd.channelMutex.Lock()
+	defer sd.channelMutex.Unlock()
+
+	if sd.channelClosed {
+		return
+	}
+
+	select {
+	case sd.channel <- data:
+	case <-sd.context.Done():
+	}
+}
 
-	sessionId := uint32(0)
+// closeInput closes the session's data channel, if it hasn't been closed already.
+func (sd *sessionData) closeInput() {
+	sd.channelMutex.Lock()
+	defer sd.channelMutex.Unlock()
+
+	if sd.channelClosed {
+		return
+	}
+
+	close(sd.channel)
+	sd.channelClosed = true
+}
+
+// nextSessionId finds an unused Session ID, failing if the connection already has the maximum number of sessions. c
+// must be locked.
+func (c *connectionSessions) nextSessionId() (uint32, error) {
+	if c.maxSessions > 0 && len(c.sessions) >= c.maxSessions {
+		return 0, framing.NewStatus(framing.StatusResourceExhausted, "too many sessions in connection")
+	}
+	// session IDs are 32-bit, so there are 1<<32 of them
+	if uint64(len(c.sessions)) >= 1<<32 {
+		return 0, framing.NewStatus(framing.StatusResourceExhausted, "no more session IDs available")
+	}
+
+	// since there's at least one unused ID, this always finishes (and usually on the first attempt)
 	for {
-		if _, ok := c.sessions[sessionId]; ok {
-			sessionId += 1
-		} else {
-			break
-		}
+		sessionId := c.nextId
+		c.nextId += 1
 
-		if sessionId > 0xffffffff {
-			return 0, fmt.Errorf("no more session IDs available")
+		if _, ok := c.sessions[sessionId]; !ok {
+			return sessionId, nil
 		}
 	}
+}
+
+// createNewSession creates a session whose frames are sent using res. Resumable sessions aren't ended when the
+// connection closes, so their context isn't derived from the connection's.
+func (c *connectionSessions) createNewSession(res *Response, endpointId uint16, resumable bool) (uint32, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	sessionId, err := c.nextSessionId()
+	if err != nil {
+		return 0, err
+	}
 
-	_, found := c.sessions[sessionId]
-	// just to double-check
-	if found {
-		return 0, fmt.Errorf("session id %d already in use", sessionId)
+	parent := c.context
+	if resumable {
+		parent = context.Background()
 	}
 
-	c.sessions[sessionId] = sessionData{
+	ctx, cancel := context.WithCancel(parent)
+	sd := &sessionData{
 		channel: make(chan *[]byte),
+		context: ctx,
+		cancel:  cancel,
 	}
+	sd.output = &sessionOutput{
+		endpointId: endpointId,
+		session:    sd,
+		res:        res,
+		sessions:   c,
+		sessionId:  sessionId,
+		metrics:    c.metrics,
+	}
+
+	c.sessions[sessionId] = sd
 	return sessionId, nil
 }
 
+// adoptSession adds an existing session (which is being resumed) to the connection, and returns its new Session ID.
+func (c *connectionSessions) adoptSession(sd *sessionData) (uint32, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	sessionId, err := c.nextSessionId()
+	if err != nil {
+		return 0, err
+	}
+
+	c.sessions[sessionId] = sd
+	return sessionId, nil
+}
+
+// detachSession removes a session from the connection without ending it. It returns false if sessionId doesn't refer
+// to sd (anymore).
+func (c *connectionSessions) detachSession(sessionId uint32, sd *sessionData) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.sessions[sessionId] != sd {
+		return false
+	}
+
+	delete(c.sessions, sessionId)
+	return true
+}
+
 func (c *connectionSessions) setSessionAuth(sessionId uint32, auth *authProvider) error {
 	c.Lock()
 	defer c.Unlock()
@@ -64,7 +185,6 @@ func (c *connectionSessions) setSessionAuth(sessionId uint32, auth *authProvider
 	}
 
 	sd.auth = auth
-	c.sessions[sessionId] = sd
 	return nil
 }
 
@@ -77,28 +197,65 @@ func (c *connectionSessions) getSessionData(sessionId uint32) (*sessionData, err
 		return nil, fmt.Errorf("session id %d not found", sessionId)
 	}
 
-	return &sd, nil
+	return sd, nil
 }
 
+// endSession removes the session, cancels its context and closes its data channel. It returns an error if the session
+// has already been ended.
 func (c *connectionSessions) endSession(sessionId uint32) error {
-	sd, err := c.getSessionData(sessionId)
-	if err != nil {
-		return err
-	}
-
 	c.Lock()
-	defer c.Unlock()
-	// these must happen together to avoid duplicate channel closure (a fatal error)
-	// therefore, these calls should only be made through a call to this endSession function
-	close(sd.channel)
+	sd, ok := c.sessions[sessionId]
+	if !ok {
+		c.Unlock()
+		return fmt.Errorf("session id %d not found", sessionId)
+	}
 	delete(c.sessions, sessionId)
+	c.Unlock()
+
+	// the context must be cancelled first so that any blocked calls to deliver return and release the channel mutex
+	sd.cancel()
+	sd.closeInput()
 	return nil
 }
 
-func (c *connectionSessions) initiateNewSession(req *Request, res *Response, frame framing.MessageFrame, endpoint func(*Request, *Response)) {
+// count returns the number of sessions currently open in the connection.
+func (c *connectionSessions) count() int {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.sessions)
+}
+
+// endAllSessions ends every session in the connection. It's called when the connection closes. Resumable sessions are
+// detached instead, so that they can be resumed on another connection.
+func (c *connectionSessions) endAllSessions() {
+	c.rateLimiter.removeConnection(c)
+
+	c.RLock()
+	sessions := make(map[uint32]*sessionData, len(c.sessions))
+	for sessionId, sd := range c.sessions {
+		sessions[sessionId] = sd
+	}
+	c.RUnlock()
+
+	for sessionId, sd := range sessions {
+		if sd.output.resumable() {
+			if c.detachSession(sessionId, sd) {
+				sd.output.detach(c, sessionId)
+			}
+			continue
+		}
+
+		_ = c.endSession(sessionId)
+	}
+}
+
+// initiateNewSession runs the session's handler in a new goroutine. finished is called once it has returned.
+func (c *connectionSessions) initiateNewSession(req *Request, res *Response, frame framing.MessageFrame, sessionRequest *framing.SessionFrame, registration endpointRegistration, server *Server, finished func()) {
+	config := server.Config
 	sd, err := c.getSessionData(frame.SessionId)
 	if err != nil {
-		errorFrame := framing.CreateErrorSession(frame.EndpointId, frame.SessionId, err.Error())
+		finished()
+		errorFrame := framing.CreateErrorSession(frame.EndpointId, frame.SessionId, framing.NewStatus(framing.StatusNotFound, err.Error()))
 		res.Send(&errorFrame)
 		return
 	}
@@ -110,36 +267,299 @@ func (c *connectionSessions) initiateNewSession(req *Request, res *Response, fra
 		}
 	}
 
-	forwardReq := Request{
-		Context: req.Context,
-		Data:    sd.channel,
-		Headers: req.Headers,
-		Auth:    localAuthProvider,
+	metadata := sessionRequest.Metadata
+	if metadata == nil {
+		metadata = Metadata{}
+	}
+
+	// the client's timeout is relative to when it sent the request, so the deadline should be calculated as early as
+	// possible
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if sessionRequest.Timeout > 0 {
+		ctx, cancel = context.WithDeadline(sd.context, time.Now().Add(sessionRequest.Timeout))
+	} else {
+		ctx, cancel = context.WithCancel(sd.context)
+	}
+
+	// the session's span is a child of the client's, if it sent one. Handlers can pass ctx on to any sessions they open
+	// themselves, so that they're part of the same trace.
+	if parent, ok := tracing.ParseTraceparent(metadata.Get(tracing.TraceparentKey)); ok {
+		ctx = tracing.ContextWithSpanContext(ctx, parent)
 	}
+	ctx, sd.span = config.tracer().Start(ctx, spanName(&registration.endpoint), tracing.SpanKindServer, tracing.Attribute{
+		Key:   "hermod.endpoint",
+		Value: fmt.Sprint(frame.EndpointId),
+	})
+
+	info := &SessionInfo{
+		Endpoint:   &registration.endpoint,
+		SessionId:  frame.SessionId,
+		Metadata:   metadata,
+		Headers:    req.Headers,
+		RemoteAddr: req.RemoteAddr,
+		Auth:       localAuthProvider,
+		logger:     c.logger.With("endpoint", frame.EndpointId, "session", frame.SessionId),
+	}
+
+	// handlerStatus is the first error sent by the handler, which is returned to the interceptors once the handler has
+	// returned
+	var handlerStatus *Status
 	forwardRes := Response{
-		sendFunction: func(dataToSend *[]byte, error bool) {
-			if error {
-				errorFrame := framing.CreateErrorSession(frame.EndpointId, frame.SessionId, string(*dataToSend))
-				res.Send(&errorFrame)
-				return
+		info: info,
+		errorFunction: func(status *Status) {
+			if handlerStatus == nil {
+				handlerStatus = status
 			}
+			// the client regards the session as terminated, so there's no point in the handler continuing
+			sd.cancel()
+		},
+	}
 
-			responseFrame := framing.MessageFrame{
-				EndpointId: frame.EndpointId,
-				SessionId:  frame.SessionId,
-				Flag:       framing.Data,
-				Data:       *dataToSend,
+	callHandler := func(ctx context.Context, data chan *[]byte, send func(unit []byte)) (err error) {
+		defer recoverHandlerPanic(info, &err)
+
+		forwardRes.Lock()
+		forwardRes.sendFunction = func(dataToSend *[]byte) {
+			send(*dataToSend)
+		}
+		forwardRes.Unlock()
+
+		registration.handler(&Request{
+			Context:    ctx,
+			Data:       data,
+			Headers:    req.Headers,
+			Metadata:   metadata,
+			RemoteAddr: req.RemoteAddr,
+			Auth:       localAuthProvider,
+		}, &forwardRes)
+
+		forwardRes.Lock()
+		defer forwardRes.Unlock()
+		if handlerStatus != nil {
+			return handlerStatus
+		}
+		return nil
+	}
+
+	runUnary := func() error {
+		var in []byte
+		if registration.endpoint.In.Unit.Name != "" {
+			select {
+			case data, ok := <-sd.channel:
+				if ok {
+					in = *data
+				}
+			case <-ctx.Done():
+				return nil
 			}
-			encoded := responseFrame.Encode()
-			res.Send(&encoded)
-		},
+		}
+
+		handler := chainUnaryInterceptors(config.UnaryInterceptors, info, func(ctx context.Context, in []byte) ([]byte, error) {
+			data := make(chan *[]byte, 1)
+			if in != nil {
+				data <- &in
+			}
+			close(data)
+
+			var out []byte
+			err := callHandler(ctx, data, func(unit []byte) {
+				// unary endpoints only send one unit
+				if out == nil {
+					out = unit
+				}
+			})
+			return out, err
+		})
+
+		out, err := handler(ctx, in)
+		if err != nil {
+			return err
+		}
+
+		if out != nil {
+			sd.output.sendData(out)
+		}
+		return nil
+	}
+
+	runStream := func() error {
+		stream := &serverStream{
+			context: ctx,
+			input:   sd.channel,
+			output:  sd.output,
+		}
+
+		handler := chainStreamInterceptors(config.StreamInterceptors, info, func(stream ServerStream) error {
+			ctx := stream.Context()
+
+			// the handler reads units from a channel, which is fed from the (possibly wrapped) stream
+			data := make(chan *[]byte)
+			go func() {
+				defer close(data)
+
+				// a panic in a stream interceptor's Receive ends the session like one in the handler would
+				var err error
+				defer func() {
+					if err != nil {
+						forwardRes.SendError(err)
+					}
+				}()
+				defer recoverHandlerPanic(info, &err)
+
+				for {
+					unit, err := stream.Receive()
+					if err != nil {
+						return
+					}
+
+					select {
+					case data <- &unit:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+
+			return callHandler(ctx, data, func(unit []byte) {
+				_ = stream.Send(unit)
+			})
+		})
+
+		return handler(stream)
 	}
 
+	// errorKind is changed if the session is refused before the handler runs, so that it isn't counted as a handler
+	// error
+	errorKind := metrics.ErrorHandler
+	run := func() (err error) {
+		// panics in interceptors are recovered here, while the ones in the handler are recovered by callHandler (so that
+		// interceptors see them as errors)
+		defer recoverHandlerPanic(info, &err)
+
+		if err := registration.endpoint.Auth.check(info.Auth); err != nil {
+			errorKind = metrics.ErrorAuth
+			return err
+		}
+
+		if limit := config.rateLimit(info.Endpoint.Id); limit != nil && !server.rateLimiter.allow(limit, info, c) {
+			errorKind = metrics.ErrorLimit
+			return framing.NewStatus(framing.StatusResourceExhausted, "rate limit exceeded")
+		}
+
+		if registration.endpoint.unary() {
+			return runUnary()
+		}
+		return runStream()
+	}
+
+	// the session is ended once the token it was authenticated with expires, unless the token is refreshed first
+	var tokenExpired <-chan struct{}
+	if localAuthProvider.authenticated() {
+		tokenExpired = localAuthProvider.expiredChannel()
+	}
+	if req.Auth == nil && sd.auth != nil {
+		sd.auth.watchExpiry(func(remaining time.Duration) {
+			sd.output.sendControl(func(sessionId uint32) []byte {
+				frame := framing.TokenExpiringFrame{
+					EndpointId: frame.EndpointId,
+					SessionId:  sessionId,
+					Remaining:  remaining,
+				}
+				return frame.Encode()
+			})
+		})
+	}
+	var expired atomic.Bool
+
 	go func() {
-		endpoint(&forwardReq, &forwardRes)
-		// if there's an error, the session has probably been manually closed elsewhere
-		_ = c.endSession(frame.SessionId)
-		closeMessage := frame.Close()
-		res.Send(&closeMessage)
+		defer finished()
+		defer cancel()
+		if sd.auth != nil {
+			defer sd.auth.stop()
+		}
+
+		if tokenExpired != nil {
+			go func() {
+				select {
+				case <-ctx.Done():
+				case <-tokenExpired:
+					expired.Store(true)
+					sd.cancel()
+				}
+			}()
+		}
+
+		recorder := config.metrics()
+		started := time.Now()
+		recorder.SessionOpened(frame.EndpointId)
+
+		err := run()
+		sd.output.end()
+
+		if expired.Load() {
+			err = framing.NewStatus(framing.StatusUnauthenticated, "token expired")
+			errorKind = metrics.ErrorAuth
+		} else if errorKind == metrics.ErrorHandler && forwardRes.failedToDecode() {
+			errorKind = metrics.ErrorDecode
+		}
+
+		recorder.SessionClosed(frame.EndpointId, time.Since(started))
+		if err != nil {
+			recorder.Error(errorKind, frame.EndpointId)
+		}
+		sd.span.End(err)
+
+		// the client regards the session as terminated once it receives an error, so there's no need to close it
+		if ctx.Err() == context.DeadlineExceeded {
+			sd.output.sendFinal(func(sessionId uint32) []byte {
+				return framing.CreateErrorSession(frame.EndpointId, sessionId, framing.NewStatus(framing.StatusDeadlineExceeded, "session deadline exceeded"))
+			})
+			return
+		}
+
+		if err != nil {
+			sd.output.sendFinal(func(sessionId uint32) []byte {
+				return framing.CreateErrorSession(frame.EndpointId, sessionId, framing.StatusFromError(err))
+			})
+			return
+		}
+
+		trailers := forwardRes.getTrailers()
+		if _, err := trailers.Encode(); err != nil {
+			sd.output.sendFinal(func(sessionId uint32) []byte {
+				return framing.CreateErrorSession(frame.EndpointId, sessionId, framing.Errorf(framing.StatusInternal, "encoding trailers: %s", err))
+			})
+			return
+		}
+
+		sd.output.sendFinal(func(sessionId uint32) []byte {
+			closeFrame := framing.MessageFrame{
+				EndpointId: frame.EndpointId,
+				SessionId:  sessionId,
+			}
+			// the trailers have already been checked, so encoding can't fail
+			closeMessage, _ := closeFrame.CloseWithTrailers(trailers)
+			return closeMessage
+		})
 	}()
 }
+
+// recoverHandlerPanic recovers from a panic in a handler (or its interceptors) and stores an Internal error in err, which
+// is sent to the client like any other error. This stops a bug in a single handler from taking down the whole server.
+// It must be deferred directly.
+func recoverHandlerPanic(info *SessionInfo, err *error) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	*err = handlerPanicked(info, recovered)
+}
+
+// handlerPanicked logs a panic recovered from a handler and returns the error to send to the client. The panic value
+// isn't sent, since it could contain internal details.
+func handlerPanicked(info *SessionInfo, recovered any) *Status {
+	info.logger.Error("panic in handler", "panic", recovered, "stack", string(debug.Stack()))
+	return framing.NewStatus(framing.StatusInternal, "internal error")
+}
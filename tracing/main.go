@@ -0,0 +1,161 @@
+// Package tracing propagates trace context between Hermod clients and servers, and records a span for each session.
+// Set HermodConfig.Tracer (on the server) or WebSocketRouter.Tracer (on the client) to a Tracer to enable it. Tracer is
+// a small interface that can be adapted to a tracing library like OpenTelemetry. Memory is an in-memory implementation,
+// useful for tests.
+//
+// The client sends its span's context to the server in the session's metadata, using the W3C Trace Context format
+// (https://www.w3.org/TR/trace-context/) under the "traceparent" key. The server's span is a child of the client's.
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// TraceparentKey is the metadata key the span context of a session is sent under.
+const TraceparentKey = "traceparent"
+
+// SpanContext identifies a span within a trace. The zero value is invalid, and means that there's no span.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid returns true if both the trace and span ID are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent encodes the span context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	var flags byte
+	if sc.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent decodes a W3C traceparent header value. It returns false if the value is malformed, or if the
+// span context it contains is invalid.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(value, "-")
+	// future versions may append fields, but version 00 has exactly 4
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 != 0
+
+	return sc, sc.IsValid()
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc, which Tracer.Start uses as the parent of new spans.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context carried by ctx, which is invalid if there isn't one.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// SpanKind describes which side of a session a span was recorded on.
+type SpanKind int
+
+const (
+	// SpanKindClient is a span recorded by a client for a session it opened.
+	SpanKindClient SpanKind = iota
+	// SpanKindServer is a span recorded by a server for a session it handled.
+	SpanKindServer
+)
+
+func (kind SpanKind) String() string {
+	switch kind {
+	case SpanKindClient:
+		return "client"
+	case SpanKindServer:
+		return "server"
+	}
+	return "unknown"
+}
+
+// Attribute is a key-value pair describing a span or an event.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// Tracer creates spans.
+type Tracer interface {
+	// Start starts a span. Its parent is the span context carried by ctx (see ContextWithSpanContext), if there is
+	// one, and otherwise it starts a new trace. It returns a copy of ctx carrying the new span's context.
+	Start(ctx context.Context, name string, kind SpanKind, attributes ...Attribute) (context.Context, Span)
+}
+
+// Span records a single session. Its methods are called concurrently.
+type Span interface {
+	// SpanContext returns the span's context, which is sent to the server by clients.
+	SpanContext() SpanContext
+	// AddEvent records something that happened during the span, such as a message being sent or received.
+	AddEvent(name string, attributes ...Attribute)
+	// End finishes the span. err is the error that ended the session, or nil if it ended successfully.
+	End(err error)
+}
+
+type noop struct{}
+
+func (noop) Start(ctx context.Context, _ string, _ SpanKind, _ ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{SpanContextFromContext(ctx)}
+}
+
+// noopSpan passes on its parent's span context, so that traces are still propagated.
+type noopSpan struct {
+	parent SpanContext
+}
+
+func (span noopSpan) SpanContext() SpanContext { return span.parent }
+func (noopSpan) AddEvent(string, ...Attribute) {}
+func (noopSpan) End(error)                     {}
+
+// Noop is a Tracer that doesn't record any spans, but still propagates the span context it's given. It's used when no
+// Tracer has been set.
+var Noop Tracer = noop{}
+
+// MessageEvent is the name of the events recorded for each Data message in a session. They have the attributes
+// "message.type" (SENT or RECEIVED) and "message.uncompressed_size".
+const MessageEvent = "message"
+
+// Message returns the attributes of a MessageEvent.
+func Message(sent bool, size int) []Attribute {
+	messageType := "RECEIVED"
+	if sent {
+		messageType = "SENT"
+	}
+	return []Attribute{
+		{Key: "message.type", Value: messageType},
+		{Key: "message.uncompressed_size", Value: fmt.Sprint(size)},
+	}
+}
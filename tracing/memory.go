@@ -0,0 +1,107 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// Memory is a Tracer that keeps every span in memory, so that they can be checked in tests. Create one with NewMemory.
+type Memory struct {
+	sync.Mutex
+	spans []MemorySpan
+}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Event is an event recorded in a MemorySpan.
+type Event struct {
+	Name       string
+	Attributes []Attribute
+	Time       time.Time
+}
+
+// MemorySpan is a span recorded by Memory.
+type MemorySpan struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanContext
+	Attributes []Attribute
+	Events     []Event
+	Err        error
+	Start      time.Time
+	End        time.Time
+}
+
+func (m *Memory) Start(ctx context.Context, name string, kind SpanKind, attributes ...Attribute) (context.Context, Span) {
+	parent := SpanContextFromContext(ctx)
+
+	span := &memorySpan{
+		tracer: m,
+		data: MemorySpan{
+			Name:       name,
+			Kind:       kind,
+			Parent:     parent,
+			Attributes: attributes,
+			Start:      time.Now(),
+		},
+	}
+	span.data.Context.TraceID = parent.TraceID
+	span.data.Context.Sampled = true
+	if !parent.IsValid() {
+		_, _ = rand.Read(span.data.Context.TraceID[:])
+	}
+	_, _ = rand.Read(span.data.Context.SpanID[:])
+
+	return ContextWithSpanContext(ctx, span.data.Context), span
+}
+
+// Spans returns every span that has ended, in the order they ended.
+func (m *Memory) Spans() []MemorySpan {
+	m.Lock()
+	defer m.Unlock()
+	return append([]MemorySpan{}, m.spans...)
+}
+
+// memorySpan records a span until it ends, when its data is added to the tracer.
+type memorySpan struct {
+	sync.Mutex
+	data   MemorySpan
+	ended  bool
+	tracer *Memory
+}
+
+func (span *memorySpan) SpanContext() SpanContext {
+	return span.data.Context
+}
+
+func (span *memorySpan) AddEvent(name string, attributes ...Attribute) {
+	span.Lock()
+	defer span.Unlock()
+	span.data.Events = append(span.data.Events, Event{
+		Name:       name,
+		Attributes: attributes,
+		Time:       time.Now(),
+	})
+}
+
+func (span *memorySpan) End(err error) {
+	span.Lock()
+	if span.ended {
+		span.Unlock()
+		return
+	}
+	span.ended = true
+	span.data.Err = err
+	span.data.End = time.Now()
+	data := span.data
+	span.Unlock()
+
+	span.tracer.Lock()
+	span.tracer.spans = append(span.tracer.spans, data)
+	span.tracer.Unlock()
+}
@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	tracer := NewMemory()
+
+	ctx, parent := tracer.Start(context.Background(), "parent", SpanKindClient)
+	_, child := tracer.Start(ctx, "child", SpanKindServer, Attribute{Key: "key", Value: "value"})
+	child.AddEvent(MessageEvent, Message(true, 5)...)
+
+	childErr := errors.New("failed")
+	child.End(childErr)
+	// ending a span again is ignored
+	child.End(nil)
+	parent.End(nil)
+
+	spans := tracer.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+
+	childSpan, parentSpan := spans[0], spans[1]
+	if childSpan.Name != "child" || parentSpan.Name != "parent" {
+		t.Fatalf("got spans %q and %q, want child and parent", childSpan.Name, parentSpan.Name)
+	}
+	if !parentSpan.Context.IsValid() || parentSpan.Parent.IsValid() {
+		t.Errorf("parent span has context %v and parent %v", parentSpan.Context, parentSpan.Parent)
+	}
+	if childSpan.Parent != parentSpan.Context {
+		t.Errorf("got child's parent %v, want %v", childSpan.Parent, parentSpan.Context)
+	}
+	if childSpan.Context.TraceID != parentSpan.Context.TraceID || childSpan.Context.SpanID == parentSpan.Context.SpanID {
+		t.Errorf("child span has context %v, parent has %v", childSpan.Context, parentSpan.Context)
+	}
+	if childSpan.Kind != SpanKindServer || len(childSpan.Attributes) != 1 {
+		t.Errorf("got child kind %v and attributes %v", childSpan.Kind, childSpan.Attributes)
+	}
+	if childSpan.Err != childErr {
+		t.Errorf("got child error %v, want %v", childSpan.Err, childErr)
+	}
+	if len(childSpan.Events) != 1 || childSpan.Events[0].Name != MessageEvent {
+		t.Errorf("got child events %v", childSpan.Events)
+	}
+	if childSpan.End.Before(childSpan.Start) {
+		t.Errorf("child span ended at %v, before it started at %v", childSpan.End, childSpan.Start)
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	_, span := NewMemory().Start(context.Background(), "span", SpanKindClient)
+
+	parsed, ok := ParseTraceparent(span.SpanContext().Traceparent())
+	if !ok || parsed != span.SpanContext() {
+		t.Errorf("got %v (%t), want %v", parsed, ok, span.SpanContext())
+	}
+
+	for _, invalid := range []string{"", "00-abc", "00-00000000000000000000000000000000-0000000000000000-01"} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("parsed invalid traceparent %q", invalid)
+		}
+	}
+}
+
+func TestNoopPropagatesParent(t *testing.T) {
+	_, parent := NewMemory().Start(context.Background(), "parent", SpanKindClient)
+	ctx := ContextWithSpanContext(context.Background(), parent.SpanContext())
+
+	ctx, span := Noop.Start(ctx, "child", SpanKindServer)
+	if span.SpanContext() != parent.SpanContext() || SpanContextFromContext(ctx) != parent.SpanContext() {
+		t.Errorf("noop span has context %v, want %v", span.SpanContext(), parent.SpanContext())
+	}
+	span.End(nil)
+}
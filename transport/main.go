@@ -0,0 +1,70 @@
+// Package transport abstracts the connection that Hermod messages are sent over. The Hermod protocol only needs a
+// full-duplex, message-oriented connection, so the server and client can use any Conn implementation. Implementations
+// are provided for WebSocket (the default), length-prefixed messages over stream sockets (e.g. TCP or Unix sockets),
+// and in-memory pipes (useful for tests).
+package transport
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// MessageType describes how a message should be interpreted. Hermod sends all of its frames as BinaryMessage, and uses
+// TextMessage for fatal connection-level errors.
+type MessageType int
+
+// The values are the same as the corresponding WebSocket opcodes.
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// ErrClosed is returned by Conns when reading from or writing to a connection that has been closed.
+var ErrClosed = errors.New("connection closed")
+
+// closedError turns the error returned by a network connection that has been closed locally into ErrClosed.
+func closedError(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return ErrClosed
+	}
+	return err
+}
+
+// Conn is a full-duplex connection that carries discrete messages.
+//
+// ReadMessage is only ever called from one goroutine at a time, and so is WriteMessage. However, ReadMessage,
+// WriteMessage and Close may be called concurrently with each other.
+type Conn interface {
+	// ReadMessage blocks until the next message arrives, or until the connection fails.
+	ReadMessage() (MessageType, []byte, error)
+	// WriteMessage sends a single message.
+	WriteMessage(messageType MessageType, data []byte) error
+	// Close closes the connection, making any blocked calls to ReadMessage return an error.
+	Close() error
+}
+
+// KeepAliveConn is implemented by Conns that support keep-alive pings. Connections that don't implement it are never
+// pinged, so dead connections might not be detected.
+type KeepAliveConn interface {
+	Conn
+	// Ping asks the other party to respond with a pong. It must be safe to call concurrently with WriteMessage.
+	Ping(deadline time.Time) error
+	// SetPongHandler sets a function that's called from within ReadMessage whenever a pong is received.
+	SetPongHandler(handler func())
+	// SetReadDeadline makes ReadMessage fail if no message (or pong) arrives before t.
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadLimitConn is implemented by Conns that can refuse to read messages above a certain size. Once a message exceeds
+// the limit, ReadMessage fails and the connection can't be used anymore.
+type ReadLimitConn interface {
+	Conn
+	SetReadLimit(limit int64)
+}
+
+// AddrConn is implemented by Conns that know the network address of the other party.
+type AddrConn interface {
+	Conn
+	RemoteAddr() net.Addr
+}
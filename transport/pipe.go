@@ -0,0 +1,75 @@
+package transport
+
+import "sync"
+
+type pipeMessage struct {
+	messageType MessageType
+	data        []byte
+}
+
+type pipeConn struct {
+	in  <-chan pipeMessage
+	out chan<- pipeMessage
+
+	// closed is shared by both ends of the pipe, so closing either end closes both
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// Pipe creates an in-memory connection. Messages written to one end can be read from the other. Closing either end
+// closes both.
+func Pipe() (Conn, Conn) {
+	a := make(chan pipeMessage)
+	b := make(chan pipeMessage)
+	closed := make(chan struct{})
+	closeOnce := &sync.Once{}
+
+	return &pipeConn{
+		in:        a,
+		out:       b,
+		closed:    closed,
+		closeOnce: closeOnce,
+	}, &pipeConn{
+		in:        b,
+		out:       a,
+		closed:    closed,
+		closeOnce: closeOnce,
+	}
+}
+
+func (c *pipeConn) ReadMessage() (MessageType, []byte, error) {
+	select {
+	case message := <-c.in:
+		return message.messageType, message.data, nil
+	case <-c.closed:
+		return 0, nil, ErrClosed
+	}
+}
+
+func (c *pipeConn) WriteMessage(messageType MessageType, data []byte) error {
+	// the caller may re-use data once WriteMessage returns
+	message := pipeMessage{
+		messageType: messageType,
+		data:        append([]byte{}, data...),
+	}
+
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case c.out <- message:
+		return nil
+	case <-c.closed:
+		return ErrClosed
+	}
+}
+
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
@@ -0,0 +1,142 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream connections mirror WebSocket's ping and pong control messages.
+const (
+	pingMessage MessageType = 9
+	pongMessage MessageType = 10
+)
+
+// MaxStreamMessageSize is the largest message a stream connection will read, unless a lower limit is set with
+// SetReadLimit. Larger messages cause ReadMessage to fail, since the length prefix is most likely corrupt.
+const MaxStreamMessageSize = 64 << 20
+
+type streamConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMutex  sync.Mutex
+	pongHandler func()
+	readLimit   int64
+}
+
+// NewStreamConn sends messages over a stream-oriented connection (like TCP or a Unix socket). Each message is prefixed
+// with its length (32 bits) and its MessageType (8 bits).
+func NewStreamConn(conn net.Conn) KeepAliveConn {
+	return &streamConn{
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		readLimit: MaxStreamMessageSize,
+	}
+}
+
+// DialStream connects to address on the named network (e.g. "tcp" or "unix") and wraps the connection with
+// NewStreamConn.
+func DialStream(ctx context.Context, network, address string) (KeepAliveConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewStreamConn(conn), nil
+}
+
+func (c *streamConn) ReadMessage() (MessageType, []byte, error) {
+	header := make([]byte, 5)
+	for {
+		_, err := io.ReadFull(c.reader, header)
+		if err != nil {
+			return 0, nil, closedError(err)
+		}
+
+		length := encoder.SliceToU32(header[0:4])
+		if int64(length) > c.readLimit {
+			return 0, nil, fmt.Errorf("message of %d bytes exceeds maximum size", length)
+		}
+
+		data := make([]byte, length)
+		_, err = io.ReadFull(c.reader, data)
+		if err != nil {
+			return 0, nil, closedError(err)
+		}
+
+		messageType := MessageType(header[4])
+		switch messageType {
+		case pingMessage:
+			err = c.write(pongMessage, nil, time.Time{})
+			if err != nil {
+				return 0, nil, err
+			}
+		case pongMessage:
+			if c.pongHandler != nil {
+				c.pongHandler()
+			}
+		default:
+			return messageType, data, nil
+		}
+	}
+}
+
+// write sends a message. If deadline isn't zero, the write fails if it doesn't complete in time.
+func (c *streamConn) write(messageType MessageType, data []byte, deadline time.Time) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if !deadline.IsZero() {
+		_ = c.conn.SetWriteDeadline(deadline)
+		defer func() {
+			_ = c.conn.SetWriteDeadline(time.Time{})
+		}()
+	}
+
+	var message []byte
+	message = *encoder.Add32ToSlice(uint32(len(data)), &message)
+	message = append(message, uint8(messageType))
+	message = append(message, data...)
+
+	_, err := c.conn.Write(message)
+	return closedError(err)
+}
+
+func (c *streamConn) WriteMessage(messageType MessageType, data []byte) error {
+	return c.write(messageType, data, time.Time{})
+}
+
+func (c *streamConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *streamConn) Ping(deadline time.Time) error {
+	return c.write(pingMessage, nil, deadline)
+}
+
+func (c *streamConn) SetPongHandler(handler func()) {
+	c.pongHandler = handler
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetReadLimit lowers the maximum size of messages that can be read. It can't be raised above MaxStreamMessageSize.
+func (c *streamConn) SetReadLimit(limit int64) {
+	if limit > MaxStreamMessageSize {
+		limit = MaxStreamMessageSize
+	}
+	c.readLimit = limit
+}
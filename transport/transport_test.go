@@ -0,0 +1,365 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/palkerecsenyi/hermod/encoder"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connPair creates two connected Conns.
+type connPair func(t *testing.T) (Conn, Conn)
+
+func pipePair(*testing.T) (Conn, Conn) {
+	return Pipe()
+}
+
+func streamPair(t *testing.T) (Conn, Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	client, err := DialStream(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accepting connection failed")
+	}
+
+	serverConn := NewStreamConn(server)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = serverConn.Close()
+	})
+	return client, serverConn
+}
+
+func webSocketPair(t *testing.T) (Conn, Conn) {
+	accepted := make(chan Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		accepted <- NewWebSocketConn(conn)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := DialWebSocket(context.Background(), "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := <-accepted
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = serverConn.Close()
+	})
+	return client, serverConn
+}
+
+var connPairs = map[string]connPair{
+	"pipe":      pipePair,
+	"stream":    streamPair,
+	"websocket": webSocketPair,
+}
+
+type readResult struct {
+	messageType MessageType
+	data        []byte
+	err         error
+}
+
+// readAsync reads a single message from conn in the background.
+func readAsync(conn Conn) <-chan readResult {
+	result := make(chan readResult, 1)
+	go func() {
+		messageType, data, err := conn.ReadMessage()
+		result <- readResult{messageType, data, err}
+	}()
+	return result
+}
+
+func await(t *testing.T, results <-chan readResult) readResult {
+	t.Helper()
+
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return readResult{}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, pair := range connPairs {
+		t.Run(name, func(t *testing.T) {
+			a, b := pair(t)
+
+			messages := []struct {
+				messageType MessageType
+				data        []byte
+			}{
+				{BinaryMessage, []byte{0, 1, 2, 0xff}},
+				{TextMessage, []byte("fatal error")},
+				{BinaryMessage, bytes.Repeat([]byte{7}, 100000)},
+				{BinaryMessage, []byte{}},
+			}
+
+			// both directions work
+			for _, conns := range [][2]Conn{{a, b}, {b, a}} {
+				from, to := conns[0], conns[1]
+				for _, message := range messages {
+					read := readAsync(to)
+					if err := from.WriteMessage(message.messageType, message.data); err != nil {
+						t.Fatal(err)
+					}
+
+					result := await(t, read)
+					if result.err != nil {
+						t.Fatal(result.err)
+					}
+					if result.messageType != message.messageType || !bytes.Equal(result.data, message.data) {
+						t.Errorf("got %d message of %d bytes, want %d message of %d bytes", result.messageType, len(result.data), message.messageType, len(message.data))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	for name, pair := range connPairs {
+		t.Run(name, func(t *testing.T) {
+			a, b := pair(t)
+			limitConn, ok := b.(ReadLimitConn)
+			if !ok {
+				t.Skip("connection doesn't support read limits")
+			}
+			limitConn.SetReadLimit(10)
+
+			read := readAsync(b)
+			if err := a.WriteMessage(BinaryMessage, make([]byte, 10)); err != nil {
+				t.Fatal(err)
+			}
+			if result := await(t, read); result.err != nil {
+				t.Fatalf("message at the limit was rejected: %s", result.err)
+			}
+
+			read = readAsync(b)
+			// writing may fail once the other side has given up on the connection
+			_ = a.WriteMessage(BinaryMessage, make([]byte, 11))
+			if result := await(t, read); result.err == nil {
+				t.Error("message over the limit was read")
+			}
+		})
+	}
+}
+
+func TestStreamReadLimitCap(t *testing.T) {
+	raw, other := net.Pipe()
+	defer raw.Close()
+	conn := NewStreamConn(other).(*streamConn)
+	defer conn.Close()
+
+	// the limit can't be raised, so a corrupt length prefix can't make the connection allocate a huge buffer
+	conn.SetReadLimit(MaxStreamMessageSize * 2)
+	if conn.readLimit != MaxStreamMessageSize {
+		t.Errorf("got read limit %d, want %d", conn.readLimit, MaxStreamMessageSize)
+	}
+
+	read := readAsync(conn)
+	var header []byte
+	header = *encoder.Add32ToSlice(MaxStreamMessageSize+1, &header)
+	header = append(header, byte(BinaryMessage))
+	if _, err := raw.Write(header); err != nil {
+		t.Fatal(err)
+	}
+
+	result := await(t, read)
+	if result.err == nil || !strings.Contains(result.err.Error(), "exceeds maximum size") {
+		t.Errorf("got %v, want the message to be refused", result.err)
+	}
+}
+
+func TestStreamFraming(t *testing.T) {
+	raw, other := net.Pipe()
+	defer raw.Close()
+	conn := NewStreamConn(other)
+	defer conn.Close()
+
+	// each message is its length (32 bits), then its type (8 bits), then its data
+	go func() {
+		_ = conn.WriteMessage(TextMessage, []byte("hi"))
+	}()
+	buffer := make([]byte, 7)
+	_ = raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(raw, buffer); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 0, 2, byte(TextMessage), 'h', 'i'}; !bytes.Equal(buffer, want) {
+		t.Errorf("got %v, want %v", buffer, want)
+	}
+
+	// pings are answered with pongs without being returned by ReadMessage
+	read := readAsync(conn)
+	go func() {
+		_, _ = raw.Write([]byte{0, 0, 0, 0, byte(pingMessage), 0, 0, 0, 1, byte(BinaryMessage), 42})
+	}()
+	if _, err := io.ReadFull(raw, buffer[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 0, 0, byte(pongMessage)}; !bytes.Equal(buffer[:5], want) {
+		t.Errorf("got %v, want a pong", buffer[:5])
+	}
+	if result := await(t, read); result.err != nil || result.messageType != BinaryMessage || !bytes.Equal(result.data, []byte{42}) {
+		t.Errorf("got %+v, want the binary message sent after the ping", result)
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	for name, pair := range connPairs {
+		t.Run(name, func(t *testing.T) {
+			a, b := pair(t)
+			pinger, ok := a.(KeepAliveConn)
+			if !ok {
+				t.Skip("connection doesn't support keep-alive pings")
+			}
+
+			pong := make(chan struct{}, 1)
+			pinger.SetPongHandler(func() {
+				pong <- struct{}{}
+			})
+
+			// pongs are sent from within ReadMessage on one side, and handled from within ReadMessage on the other,
+			// without either returning
+			ponged := readAsync(a)
+			pinged := readAsync(b)
+			if err := pinger.Ping(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-pong:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for pong")
+			}
+
+			select {
+			case result := <-ponged:
+				t.Fatalf("ReadMessage returned after a pong: %+v", result)
+			case result := <-pinged:
+				t.Fatalf("ReadMessage returned after a ping: %+v", result)
+			default:
+			}
+
+			// normal messages still arrive afterwards
+			if err := b.WriteMessage(BinaryMessage, []byte{1}); err != nil {
+				t.Fatal(err)
+			}
+			if result := await(t, ponged); result.err != nil || !bytes.Equal(result.data, []byte{1}) {
+				t.Errorf("got %+v, want the message sent after the pong", result)
+			}
+		})
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	for name, pair := range connPairs {
+		t.Run(name, func(t *testing.T) {
+			a, _ := pair(t)
+			keepAliveConn, ok := a.(KeepAliveConn)
+			if !ok {
+				t.Skip("connection doesn't support read deadlines")
+			}
+
+			if err := keepAliveConn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+
+			result := await(t, readAsync(a))
+			var netError net.Error
+			if !errors.As(result.err, &netError) || !netError.Timeout() {
+				t.Errorf("got %v, want a timeout", result.err)
+			}
+		})
+	}
+}
+
+func TestClosed(t *testing.T) {
+	for name, pair := range connPairs {
+		t.Run(name, func(t *testing.T) {
+			a, _ := pair(t)
+
+			// a read that's blocked when the connection is closed fails
+			read := readAsync(a)
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if result := await(t, read); !errors.Is(result.err, ErrClosed) {
+				t.Errorf("got %v from blocked read, want ErrClosed", result.err)
+			}
+
+			if _, _, err := a.ReadMessage(); !errors.Is(err, ErrClosed) {
+				t.Errorf("got %v from read after closing, want ErrClosed", err)
+			}
+			if err := a.WriteMessage(BinaryMessage, []byte{1}); !errors.Is(err, ErrClosed) {
+				t.Errorf("got %v from write after closing, want ErrClosed", err)
+			}
+		})
+	}
+}
+
+func TestPipeClosesBothEnds(t *testing.T) {
+	a, b := Pipe()
+	_ = a.Close()
+
+	if _, _, err := b.ReadMessage(); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v, want ErrClosed", err)
+	}
+	if err := b.WriteMessage(BinaryMessage, []byte{1}); !errors.Is(err, ErrClosed) {
+		t.Errorf("got %v, want ErrClosed", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("closing the other end: %s", err)
+	}
+}
+
+func TestPipeCopiesMessages(t *testing.T) {
+	a, b := Pipe()
+	read := readAsync(b)
+
+	data := []byte{1, 2, 3}
+	if err := a.WriteMessage(BinaryMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	// the writer can re-use data once WriteMessage returns
+	data[0] = 9
+
+	if result := await(t, read); !bytes.Equal(result.data, []byte{1, 2, 3}) {
+		t.Errorf("got %v, want the message as it was written", result.data)
+	}
+}
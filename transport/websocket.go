@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"time"
+)
+
+type webSocketConn struct {
+	conn *websocket.Conn
+}
+
+// NewWebSocketConn wraps an established WebSocket connection.
+func NewWebSocketConn(conn *websocket.Conn) KeepAliveConn {
+	return &webSocketConn{
+		conn: conn,
+	}
+}
+
+// DialWebSocket opens a WebSocket connection to url.
+func DialWebSocket(ctx context.Context, url string, header http.Header) (KeepAliveConn, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWebSocketConn(conn), nil
+}
+
+func (c *webSocketConn) ReadMessage() (MessageType, []byte, error) {
+	messageType, data, err := c.conn.ReadMessage()
+	return MessageType(messageType), data, closedError(err)
+}
+
+func (c *webSocketConn) WriteMessage(messageType MessageType, data []byte) error {
+	return closedError(c.conn.WriteMessage(int(messageType), data))
+}
+
+func (c *webSocketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *webSocketConn) Ping(deadline time.Time) error {
+	// WriteControl is safe to call concurrently with other writes
+	return c.conn.WriteControl(websocket.PingMessage, nil, deadline)
+}
+
+func (c *webSocketConn) SetPongHandler(handler func()) {
+	c.conn.SetPongHandler(func(string) error {
+		handler()
+		return nil
+	})
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *webSocketConn) SetReadLimit(limit int64) {
+	c.conn.SetReadLimit(limit)
+}